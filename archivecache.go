@@ -0,0 +1,172 @@
+package keepcurrent
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// ArchiveCache buffers the data of the sources wrapped with WithArchiveCache
+// in memory, so that extracting different members of the same archive, e.g.
+// with FromTarGz, downloads it once per version rather than once per member.
+// Memory use is bounded by maxBytes across all of the sources, evicting the
+// data fetched least recently first. Data larger than that is not buffered.
+type ArchiveCache struct {
+	maxBytes  int64
+	freshness time.Duration
+
+	mx      sync.Mutex
+	entries map[*archiveCacheSource]*archiveEntry
+	size    int64
+}
+
+// archiveEntry is the data buffered for a source.
+type archiveEntry struct {
+	data []byte
+	md   Metadata
+	// version is when the data was last modified, or when it was fetched if
+	// the source doesn't tell
+	version time.Time
+	// checked is when the source was last fetched from
+	checked time.Time
+}
+
+// NewArchiveCache constructs an ArchiveCache holding up to maxBytes of data.
+// Within freshness of fetching from a source, the buffered data is served as
+// is. After that, the source is fetched from again, conditionally on the
+// version buffered, and the data is replaced only if it has changed.
+func NewArchiveCache(maxBytes int64, freshness time.Duration) *ArchiveCache {
+	return &ArchiveCache{maxBytes: maxBytes, freshness: freshness, entries: make(map[*archiveCacheSource]*archiveEntry)}
+}
+
+type archiveCacheSource struct {
+	s     Source
+	cache *ArchiveCache
+
+	// mx makes concurrent fetches wait for the one in progress to buffer the
+	// data rather than download it again
+	mx sync.Mutex
+}
+
+// WithArchiveCache makes a source buffer its data in the cache, to share the
+// wrapped source among several extracting sources, e.g.
+//
+//	archive := WithArchiveCache(cache)(FromWeb(url))
+//	config, rules := FromTarGz(archive, "config.json"), FromTarGz(archive, "rules.json")
+//
+// The data is modified since ifNewerThan if the version buffered is, as told
+// by the modification time at the source, or else by when it was fetched, in
+// which case the runner which fetched it gets it once more, as it synced
+// before.
+func WithArchiveCache(cache *ArchiveCache) SourceMiddleware {
+	return func(s Source) Source {
+		return &archiveCacheSource{s: s, cache: cache}
+	}
+}
+
+func (s *archiveCacheSource) Fetch(ifNewerThan time.Time) (io.ReadCloser, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	now := time.Now()
+	e := s.cache.get(s)
+	if e != nil && now.Sub(e.checked) < s.cache.freshness {
+		return e.open(ifNewerThan)
+	}
+	since := ifNewerThan
+	if e != nil {
+		since = e.version
+	}
+	rc, err := s.s.Fetch(since)
+	if err == ErrUnmodified && e != nil {
+		s.cache.checked(s, now)
+		return e.open(ifNewerThan)
+	}
+	if err != nil {
+		return nil, err
+	}
+	md := metadataOf(rc)
+	data, err := ioutil.ReadAll(io.LimitReader(rc, s.cache.maxBytes+1))
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	if int64(len(data)) > s.cache.maxBytes {
+		// Too large to buffer, so pass it on as it's read
+		s.cache.remove(s)
+		return withMetadata(chainedCloser{ioutil.NopCloser(io.MultiReader(bytes.NewReader(data), rc)), rc}, md), nil
+	}
+	rc.Close()
+	e = &archiveEntry{data: data, md: md, version: md.ModTime, checked: now}
+	if e.version.IsZero() {
+		e.version = now
+	}
+	s.cache.put(s, e)
+	return e.open(ifNewerThan)
+}
+
+// Describe implements DescribedSource
+func (s *archiveCacheSource) Describe() string {
+	return describe(s.s) + " buffered"
+}
+
+// ResetConditions implements ResettableSource
+func (s *archiveCacheSource) ResetConditions() {
+	resetConditions(s.s)
+}
+
+// open returns the data buffered if modified since ifNewerThan.
+func (e *archiveEntry) open(ifNewerThan time.Time) (io.ReadCloser, error) {
+	if !ifNewerThan.IsZero() && !e.version.After(ifNewerThan) {
+		return nil, ErrUnmodified
+	}
+	return withMetadata(ioutil.NopCloser(bytes.NewReader(e.data)), e.md), nil
+}
+
+func (c *ArchiveCache) get(s *archiveCacheSource) *archiveEntry {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.entries[s]
+}
+
+// checked records that the data buffered for s is current as of now.
+func (c *ArchiveCache) checked(s *archiveCacheSource, now time.Time) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if e := c.entries[s]; e != nil {
+		c.entries[s] = &archiveEntry{data: e.data, md: e.md, version: e.version, checked: now}
+	}
+}
+
+// put buffers the data for s in place of any older version, and evicts the
+// data of other sources fetched least recently to stay within maxBytes.
+func (c *ArchiveCache) put(s *archiveCacheSource, e *archiveEntry) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.removeLocked(s)
+	c.entries[s] = e
+	c.size += int64(len(e.data))
+	for c.size > c.maxBytes {
+		var oldest *archiveCacheSource
+		for other, oe := range c.entries {
+			if other != s && (oldest == nil || oe.checked.Before(c.entries[oldest].checked)) {
+				oldest = other
+			}
+		}
+		c.removeLocked(oldest)
+	}
+}
+
+func (c *ArchiveCache) remove(s *archiveCacheSource) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.removeLocked(s)
+}
+
+func (c *ArchiveCache) removeLocked(s *archiveCacheSource) {
+	if e := c.entries[s]; e != nil {
+		c.size -= int64(len(e.data))
+		delete(c.entries, s)
+	}
+}
@@ -0,0 +1,147 @@
+package keepcurrent
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// jitterRand is the default source of the jitter of JitteredExpBackoff,
+// seeded once, so that processes started together don't retry in lockstep.
+var jitterRand = &lockedRand{r: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// lockedRand makes a *rand.Rand safe for concurrent use.
+type lockedRand struct {
+	mx sync.Mutex
+	r  *rand.Rand
+}
+
+func (l *lockedRand) Float64() float64 {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	return l.r.Float64()
+}
+
+// ExpBackoff returns an OnSourceError handler which does exponential backoff
+// starting with base, doubles for every retry, and stops retrying after 'stop'
+// attempts.
+func ExpBackoff(base time.Duration, stop int) func(err error, tries int) time.Duration {
+	return ExpBackoffThenFail(base, stop, func(err error) {})
+}
+
+// ExpBackoffThenFail does the same as ExpBackoff but also calls the onFail
+// callback when it stops retrying. Like StopAfter, it gives up right away on
+// permanent errors.
+func ExpBackoffThenFail(base time.Duration, stop int, onFail func(err error)) func(err error, tries int) time.Duration {
+	return StopAfter(func(err error, tries int) time.Duration {
+		return base * (1 << (tries - 1))
+	}, stop, onFail)
+}
+
+// ConstantBackoff returns an OnSourceError handler which always waits d before
+// trying again. It never gives up by itself, see ConstantBackoffThenFail.
+func ConstantBackoff(d time.Duration) func(err error, tries int) time.Duration {
+	return func(err error, tries int) time.Duration {
+		return d
+	}
+}
+
+// ConstantBackoffThenFail is the same as ConstantBackoff but stops retrying
+// after 'stop' attempts and calls onFail, as StopAfter.
+func ConstantBackoffThenFail(d time.Duration, stop int, onFail func(err error)) func(err error, tries int) time.Duration {
+	return StopAfter(ConstantBackoff(d), stop, onFail)
+}
+
+// LinearBackoff returns an OnSourceError handler which waits step after the
+// first failure, two steps after the second, and so on, but never more than
+// max. A non-positive step always waits max. It never gives up by itself, see
+// LinearBackoffThenFail.
+func LinearBackoff(step, max time.Duration) func(err error, tries int) time.Duration {
+	return func(err error, tries int) time.Duration {
+		if step <= 0 || time.Duration(tries) > max/step {
+			return max
+		}
+		return step * time.Duration(tries)
+	}
+}
+
+// LinearBackoffThenFail is the same as LinearBackoff but stops retrying after
+// 'stop' attempts and calls onFail, as StopAfter.
+func LinearBackoffThenFail(step, max time.Duration, stop int, onFail func(err error)) func(err error, tries int) time.Duration {
+	return StopAfter(LinearBackoff(step, max), stop, onFail)
+}
+
+// JitteredExpBackoff returns an OnSourceError handler which does exponential
+// backoff starting with base and doubling for every retry up to max, with each
+// wait randomly adjusted by up to the jitter fraction in either direction,
+// e.g. 0.2 for ±20%. The result never exceeds max. It never gives up by
+// itself, see JitteredExpBackoffThenFail.
+func JitteredExpBackoff(base, max time.Duration, jitter float64) func(err error, tries int) time.Duration {
+	return JitteredExpBackoffWithRand(base, max, jitter, nil)
+}
+
+// JitteredExpBackoffThenFail is the same as JitteredExpBackoff but stops
+// retrying after 'stop' attempts and calls onFail, as StopAfter.
+func JitteredExpBackoffThenFail(base, max time.Duration, jitter float64, stop int, onFail func(err error)) func(err error, tries int) time.Duration {
+	return StopAfter(JitteredExpBackoff(base, max, jitter), stop, onFail)
+}
+
+// JitteredExpBackoffWithRand is the same as JitteredExpBackoff but draws the
+// jitter from rnd, e.g. one seeded by a test for deterministic waits, or one
+// per runner to avoid contending on a shared source. rnd must not be used
+// elsewhere, though the handler may be shared. A nil rnd uses a package-level
+// source seeded once.
+func JitteredExpBackoffWithRand(base, max time.Duration, jitter float64, rnd *rand.Rand) func(err error, tries int) time.Duration {
+	src := jitterRand
+	if rnd != nil {
+		src = &lockedRand{r: rnd}
+	}
+	return func(err error, tries int) time.Duration {
+		d := base
+		for i := 1; i < tries && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			d = max
+		}
+		d += time.Duration(float64(d) * jitter * (2*src.Float64() - 1))
+		if d > max {
+			d = max
+		}
+		if d <= 0 {
+			d = 1
+		}
+		return d
+	}
+}
+
+// StopAfter wraps an OnSourceError handler to stop retrying after 'stop'
+// attempts, or right away if the error is permanent, i.e. it or any error it
+// wraps has a Temporary method returning false, such as an *HTTPStatusError
+// for a 404. Network errors are always retried though, as they tell
+// temporary from permanent in a way that doesn't fit polling, e.g. a refused
+// connection is not temporary to them. If not nil, onFail is called with the
+// last error when it gives up.
+func StopAfter(policy func(err error, tries int) time.Duration, stop int, onFail func(err error)) func(err error, tries int) time.Duration {
+	return func(err error, tries int) time.Duration {
+		if tries >= stop || isPermanent(err) {
+			if onFail != nil {
+				onFail(err)
+			}
+			return 0
+		}
+		return policy(err, tries)
+	}
+}
+
+// isPermanent tells if retrying is no use for the error, see StopAfter.
+func isPermanent(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return false
+	}
+	var temporary interface{ Temporary() bool }
+	return errors.As(err, &temporary) && !temporary.Temporary()
+}
@@ -0,0 +1,85 @@
+package keepcurrent
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoffPolicies(t *testing.T) {
+	err := errors.New("fail")
+	constant := ConstantBackoff(time.Second)
+	assert.Equal(t, time.Second, constant(err, 1))
+	assert.Equal(t, time.Second, constant(err, 100))
+
+	linear := LinearBackoff(time.Second, 3*time.Second)
+	assert.Equal(t, time.Second, linear(err, 1))
+	assert.Equal(t, 2*time.Second, linear(err, 2))
+	assert.Equal(t, 3*time.Second, linear(err, 3))
+	assert.Equal(t, 3*time.Second, linear(err, 100))
+	assert.Equal(t, 3*time.Second, LinearBackoff(0, 3*time.Second)(err, 1), "zero step should wait max")
+
+	jittered := JitteredExpBackoff(time.Second, 10*time.Second, 0.5)
+	for tries := 1; tries < 100; tries++ {
+		d := jittered(err, tries)
+		assert.True(t, d > 0)
+		assert.True(t, d <= 10*time.Second)
+	}
+	noJitter := JitteredExpBackoff(time.Second, 10*time.Second, 0)
+	assert.Equal(t, time.Second, noJitter(err, 1))
+	assert.Equal(t, 4*time.Second, noJitter(err, 3))
+	assert.Equal(t, 10*time.Second, noJitter(err, 5))
+	seeded := func() func(error, int) time.Duration {
+		return JitteredExpBackoffWithRand(time.Second, 10*time.Second, 0.5, rand.New(rand.NewSource(1)))
+	}
+	first, second := seeded(), seeded()
+	for tries := 1; tries < 10; tries++ {
+		assert.Equal(t, first(err, tries), second(err, tries), "same seed should make the same waits")
+	}
+
+	var gaveUp error
+	limited := StopAfter(linear, 3, func(err error) { gaveUp = err })
+	assert.Equal(t, 2*time.Second, limited(err, 2))
+	assert.Nil(t, gaveUp)
+	assert.Equal(t, time.Duration(0), limited(err, 3))
+	assert.Equal(t, err, gaveUp)
+	assert.Equal(t, time.Duration(0), StopAfter(constant, 1, nil)(err, 1))
+
+	var gaveUpCount int
+	onFail := func(err error) { gaveUpCount++ }
+	for _, policy := range []func(error, int) time.Duration{
+		ConstantBackoffThenFail(time.Second, 2, onFail),
+		LinearBackoffThenFail(time.Second, 3*time.Second, 2, onFail),
+		JitteredExpBackoffThenFail(time.Second, 10*time.Second, 0.5, 2, onFail),
+	} {
+		assert.True(t, policy(err, 1) > 0)
+		assert.Equal(t, time.Duration(0), policy(err, 2))
+	}
+	assert.Equal(t, 3, gaveUpCount)
+}
+
+func TestBackoffPermanentErrors(t *testing.T) {
+	var gaveUp error
+	policy := ExpBackoffThenFail(time.Second, 5, func(err error) { gaveUp = err })
+
+	transient := &HTTPStatusError{StatusCode: http.StatusServiceUnavailable}
+	assert.Equal(t, time.Second, policy(transient, 1), "transient error should be retried")
+	assert.Equal(t, time.Second, policy(&HTTPStatusError{StatusCode: http.StatusTooManyRequests}, 1))
+	assert.Nil(t, gaveUp)
+
+	permanent := fmt.Errorf("wrapped: %w", &HTTPStatusError{StatusCode: http.StatusNotFound})
+	assert.Equal(t, time.Duration(0), policy(permanent, 1), "permanent error should not be retried")
+	assert.Equal(t, permanent, gaveUp)
+
+	_, err := net.Dial("tcp", "127.0.0.1:1")
+	if assert.Error(t, err) {
+		assert.Equal(t, time.Second, policy(err, 1), "network errors should be retried")
+	}
+	assert.Equal(t, time.Second, policy(errors.New("fail"), 1))
+}
@@ -0,0 +1,108 @@
+package keepcurrent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+type batchedSink struct {
+	inner      Sink
+	maxUpdates int
+	maxWait    time.Duration
+
+	mx       sync.Mutex
+	pending  []byte
+	md       Metadata
+	updates  int
+	timer    *time.Timer
+	batch    int
+	flushErr error
+}
+
+// ToBatched makes a sink get the data only after maxUpdates updates or maxWait
+// since the first pending update, whichever comes first. Only the most recent
+// data is kept and forwarded, as the sinks always reflect the current state
+// of the source. A zero maxUpdates or maxWait disables the respective limit.
+//
+// An error forwarding the data is returned by UpdateFrom if it triggered the
+// forwarding, otherwise by the next call to UpdateFrom. The pending data is
+// forwarded when the runner stops, see FlushingSink.
+func ToBatched(maxUpdates int, maxWait time.Duration) SinkMiddleware {
+	return func(inner Sink) Sink {
+		return &batchedSink{inner: inner, maxUpdates: maxUpdates, maxWait: maxWait}
+	}
+}
+
+func (s *batchedSink) UpdateFrom(r io.Reader) error {
+	return s.UpdateWithMetadata(r, Metadata{})
+}
+
+// UpdateWithMetadata implements MetadataSink, forwarding the metadata of the
+// latest data along with it.
+func (s *batchedSink) UpdateWithMetadata(r io.Reader, md Metadata) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	err, s.flushErr = s.flushErr, nil
+	s.pending, s.md = data, md
+	s.updates++
+	if s.maxUpdates > 0 && s.updates >= s.maxUpdates {
+		return s.flushLocked()
+	}
+	if s.timer == nil && s.maxWait > 0 {
+		batch := s.batch
+		s.timer = time.AfterFunc(s.maxWait, func() {
+			s.mx.Lock()
+			defer s.mx.Unlock()
+			if s.batch == batch {
+				s.flushErr = s.flushLocked()
+			}
+		})
+	}
+	return err
+}
+
+func (s *batchedSink) flushLocked() error {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if s.pending == nil {
+		return nil
+	}
+	data := s.pending
+	s.pending = nil
+	s.updates = 0
+	s.batch++
+	return updateSink(context.Background(), s.inner, bytes.NewReader(data), s.md)
+}
+
+// Flush implements FlushingSink, forwarding the pending data if any, so that
+// the last update isn't lost when the runner stops.
+func (s *batchedSink) Flush() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	err := s.flushErr
+	s.flushErr = nil
+	if flushErr := s.flushLocked(); flushErr != nil {
+		return flushErr
+	}
+	return err
+}
+
+// ReusableReader implements ReusableReaderSink
+func (s *batchedSink) ReusableReader() bool {
+	return true
+}
+
+func (s *batchedSink) String() string {
+	return fmt.Sprintf("batched %v", s.inner)
+}
@@ -0,0 +1,122 @@
+// Package bolt syncs data with a value in a bbolt embedded database, e.g. to
+// mirror the config from upstream into the local store the rest of the app
+// reads from.
+package bolt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/getlantern/keepcurrent"
+	"go.etcd.io/bbolt"
+)
+
+var (
+	// ErrBucketNotFound is returned by sources constructed by FromBolt when
+	// the bucket doesn't exist.
+	ErrBucketNotFound = errors.New("bucket not found")
+	// ErrKeyNotFound is returned by sources constructed by FromBolt when the
+	// key doesn't exist in the bucket.
+	ErrKeyNotFound = errors.New("key not found")
+)
+
+type boltSink struct {
+	db     *bbolt.DB
+	bucket []byte
+	key    []byte
+}
+
+// ToBolt constructs a sink which puts the data as the value of the key in the
+// bucket of the database, creating the bucket if it doesn't exist.
+func ToBolt(db *bbolt.DB, bucket, key []byte) keepcurrent.Sink {
+	return &boltSink{db, bucket, key}
+}
+
+func (s *boltSink) UpdateFrom(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(s.bucket)
+		if err != nil {
+			return err
+		}
+		return b.Put(s.key, data)
+	})
+}
+
+// ReusableReader implements keepcurrent.ReusableReaderSink
+func (s *boltSink) ReusableReader() bool {
+	return true
+}
+
+func (s *boltSink) String() string {
+	return fmt.Sprintf("bolt sink to key %q of bucket %q in %v", s.key, s.bucket, s.db.Path())
+}
+
+type boltSource struct {
+	db     *bbolt.DB
+	bucket []byte
+	key    []byte
+
+	mx   sync.Mutex
+	hash []byte
+}
+
+// FromBolt constructs a source which reads the value of the key in the bucket
+// of the database in a read transaction. As bbolt doesn't keep when a value
+// was modified, it's unmodified if its SHA-256 hash is the same as when last
+// fetched, whoever wrote it. A missing bucket or key fails the fetch with
+// ErrBucketNotFound or ErrKeyNotFound.
+func FromBolt(db *bbolt.DB, bucket, key []byte) keepcurrent.Source {
+	return &boltSource{db: db, bucket: bucket, key: key}
+}
+
+func (s *boltSource) Fetch(ifNewerThan time.Time) (io.ReadCloser, error) {
+	var data []byte
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+		if b == nil {
+			return ErrBucketNotFound
+		}
+		value := b.Get(s.key)
+		if value == nil {
+			return ErrKeyNotFound
+		}
+		// The value is only valid within the transaction
+		data = append([]byte{}, value...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(data)
+	s.mx.Lock()
+	unmodified := bytes.Equal(s.hash, hash[:])
+	s.hash = hash[:]
+	s.mx.Unlock()
+	if unmodified && !ifNewerThan.IsZero() {
+		return nil, keepcurrent.ErrUnmodified
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// ResetConditions implements keepcurrent.ResettableSource, so that a value
+// which failed to be delivered isn't unmodified when fetched again.
+func (s *boltSource) ResetConditions() {
+	s.mx.Lock()
+	s.hash = nil
+	s.mx.Unlock()
+}
+
+// Describe implements keepcurrent.DescribedSource
+func (s *boltSource) Describe() string {
+	return fmt.Sprintf("key %q of bolt bucket %q in %v", s.key, s.bucket, s.db.Path())
+}
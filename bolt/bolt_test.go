@@ -0,0 +1,84 @@
+package bolt
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/keepcurrent"
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/bbolt"
+)
+
+func TestBolt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keep_current_bolt_test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	db, err := bbolt.Open(filepath.Join(dir, "test.db"), 0600, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	bucket, key := []byte("config"), []byte("global")
+	source := FromBolt(db, bucket, key)
+	_, err = source.Fetch(time.Time{})
+	assert.Equal(t, ErrBucketNotFound, err)
+	assert.NoError(t, db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucket(bucket)
+		return err
+	}))
+	_, err = source.Fetch(time.Time{})
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	mirrored := make(chan []byte, 1)
+	upstream := keepcurrent.FromReader(strings.NewReader("v1"))
+	keepcurrent.New(upstream, ToBolt(db, bucket, key)).InitFrom(upstream)
+	runner := keepcurrent.New(source, keepcurrent.ToChannel(mirrored))
+	runner.InitFrom(source)
+	assert.Equal(t, "v1", string(<-mirrored))
+
+	runner.InitFrom(source)
+	assert.EqualValues(t, 1, runner.UnmodifiedCount(), "same value should be unmodified")
+
+	assert.NoError(t, ToBolt(db, bucket, key).UpdateFrom(strings.NewReader("v2")))
+	runner.InitFrom(source)
+	assert.Equal(t, "v2", string(<-mirrored))
+
+	// The value failing to be delivered should be fetched again
+	flaky := &flakySink{}
+	runner = keepcurrent.New(source, flaky)
+	assert.True(t, runner.Sync().Changed)
+	assert.NoError(t, ToBolt(db, bucket, key).UpdateFrom(strings.NewReader("v3")))
+	flaky.err = errors.New("unavailable")
+	assert.False(t, runner.Sync().Changed)
+	flaky.err = nil
+	assert.True(t, runner.Sync().Changed)
+	assert.Equal(t, "v3", flaky.received)
+	assert.Contains(t, source.(keepcurrent.DescribedSource).Describe(), `key "global" of bolt bucket "config"`)
+}
+
+type flakySink struct {
+	err      error
+	received string
+}
+
+func (s *flakySink) UpdateFrom(r io.Reader) error {
+	if s.err != nil {
+		return s.err
+	}
+	b, err := ioutil.ReadAll(r)
+	s.received = string(b)
+	return err
+}
+
+func (s *flakySink) String() string {
+	return "flaky sink"
+}
@@ -0,0 +1,133 @@
+package keepcurrent
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type cacheSource struct {
+	s         Source
+	cachePath string
+}
+
+// WithCache makes a source keep the last data fetched successfully in the
+// file at cachePath, to survive outages of the source.
+//
+// When fetching from the source fails, the cached data is returned instead,
+// with Metadata.Stale set, unless the caller already has data newer than the
+// cache. Runner.StaleSince tells when a runner has been syncing such data.
+// The time the cache was written is also used as ifNewerThan when fetching
+// from the source, so that after a restart the data is only downloaded again
+// if it has changed since, otherwise the cached data is returned.
+func WithCache(cachePath string) SourceMiddleware {
+	return func(s Source) Source {
+		return &cacheSource{s, cachePath}
+	}
+}
+
+func (s *cacheSource) Fetch(ifNewerThan time.Time) (io.ReadCloser, error) {
+	return s.fetch(ifNewerThan, s.s.Fetch)
+}
+
+// fetch fetches from the source with the given function, falling back to the
+// cache.
+func (s *cacheSource) fetch(ifNewerThan time.Time, fetch func(time.Time) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	var cacheTime time.Time
+	if fi, err := os.Stat(s.cachePath); err == nil {
+		cacheTime = fi.ModTime()
+	}
+	since := ifNewerThan
+	if !cacheTime.IsZero() {
+		since = cacheTime
+	}
+	start := time.Now()
+	rc, err := fetch(since)
+	switch {
+	case err == ErrUnmodified && ifNewerThan.Before(cacheTime):
+		// The cache is current but the caller doesn't have it yet
+		return s.openCache(false)
+	case err == ErrUnmodified:
+		return nil, err
+	case err != nil && ifNewerThan.Before(cacheTime):
+		return s.openCache(true)
+	case err != nil:
+		return nil, err
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(s.cachePath), "."+filepath.Base(s.cachePath)+"-")
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return withMetadata(&cacheWriter{rc, tmpFile, s.cachePath, start, false}, metadataOf(rc)), nil
+}
+
+// Describe implements DescribedSource
+func (s *cacheSource) Describe() string {
+	return fmt.Sprintf("%v cached at %v", describe(s.s), absPath(s.cachePath))
+}
+
+// ResetConditions implements ResettableSource
+func (s *cacheSource) ResetConditions() {
+	resetConditions(s.s)
+}
+
+func (s *cacheSource) openCache(stale bool) (io.ReadCloser, error) {
+	f, err := os.Open(s.cachePath)
+	if err != nil {
+		return nil, err
+	}
+	return withMetadata(f, Metadata{Stale: stale}), nil
+}
+
+// cacheWriter copies the data to the temporary file as it's read, and replaces
+// the cache with it once all data is read.
+type cacheWriter struct {
+	io.ReadCloser
+	tmpFile   *os.File
+	cachePath string
+	fetchedAt time.Time
+	complete  bool
+}
+
+func (w *cacheWriter) Read(p []byte) (int, error) {
+	n, err := w.ReadCloser.Read(p)
+	if n > 0 && w.tmpFile != nil {
+		if _, werr := w.tmpFile.Write(p[:n]); werr != nil {
+			w.discard()
+		}
+	}
+	if err == io.EOF {
+		w.complete = true
+	}
+	return n, err
+}
+
+func (w *cacheWriter) Close() error {
+	err := w.ReadCloser.Close()
+	if w.tmpFile == nil {
+		return err
+	}
+	if !w.complete {
+		w.discard()
+		return err
+	}
+	// Failing to update the cache doesn't fail the fetch
+	name := w.tmpFile.Name()
+	if w.tmpFile.Close() != nil ||
+		os.Chtimes(name, w.fetchedAt, w.fetchedAt) != nil ||
+		os.Rename(name, w.cachePath) != nil {
+		os.Remove(name)
+	}
+	w.tmpFile = nil
+	return err
+}
+
+func (w *cacheWriter) discard() {
+	w.tmpFile.Close()
+	os.Remove(w.tmpFile.Name())
+	w.tmpFile = nil
+}
@@ -0,0 +1,47 @@
+package keepcurrent
+
+import "time"
+
+// Clock is the source of time of a runner. Replace it to control the time in
+// tests, e.g. with keepcurrenttest.FakeClock.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// NewTicker returns a ticker which ticks every d, like time.NewTicker.
+	NewTicker(d time.Duration) Ticker
+	// After returns a channel which receives the time once d has elapsed,
+	// like time.After.
+	After(d time.Duration) <-chan time.Time
+}
+
+// Ticker is the ticker returned by a Clock.
+type Ticker interface {
+	// C returns the channel on which the ticks are delivered.
+	C() <-chan time.Time
+	// Stop turns off the ticker.
+	Stop()
+	// Reset stops the ticker and resets its period to d.
+	Reset(d time.Duration)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
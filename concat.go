@@ -0,0 +1,104 @@
+package keepcurrent
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"time"
+)
+
+type concatSource struct {
+	sources   []Source
+	separator []byte
+}
+
+// FromConcat constructs a source which streams the data of all given sources
+// back-to-back, in order. It's unmodified only if all of the sources are
+// unmodified. Otherwise, the unmodified ones are fetched again
+// unconditionally, i.e. with a zero ifNewerThan, to make up the whole data.
+func FromConcat(sources ...Source) Source {
+	return FromConcatWithSeparator(nil, sources...)
+}
+
+// FromConcatWithSeparator is the same as FromConcat but inserts the separator
+// between the data of each source.
+func FromConcatWithSeparator(separator []byte, sources ...Source) Source {
+	return &concatSource{sources, separator}
+}
+
+func (s *concatSource) Fetch(ifNewerThan time.Time) (io.ReadCloser, error) {
+	rcs, err := fetchAll(s.sources, ifNewerThan)
+	if err != nil {
+		return nil, err
+	}
+	readers := make([]io.Reader, 0, 2*len(rcs))
+	for i, rc := range rcs {
+		if i > 0 && len(s.separator) > 0 {
+			readers = append(readers, bytes.NewReader(s.separator))
+		}
+		readers = append(readers, rc)
+	}
+	return &concatReader{io.MultiReader(readers...), rcs}, nil
+}
+
+// Describe implements DescribedSource
+func (s *concatSource) Describe() string {
+	return "concatenation of " + describeAll(s.sources)
+}
+
+// ResetConditions implements ResettableSource
+func (s *concatSource) ResetConditions() {
+	resetConditions(s.sources...)
+}
+
+// describeAll describes all of the sources as a list.
+func describeAll(sources []Source) string {
+	descs := make([]string, 0, len(sources))
+	for _, s := range sources {
+		descs = append(descs, describe(s))
+	}
+	return strings.Join(descs, ", ")
+}
+
+// fetchAll fetches from all of the sources, or returns ErrUnmodified if all of
+// them are unmodified. Otherwise, the unmodified ones are fetched again
+// unconditionally.
+func fetchAll(sources []Source, ifNewerThan time.Time) (chainedCloser, error) {
+	rcs := make(chainedCloser, len(sources))
+	modified := false
+	for i, source := range sources {
+		rc, err := source.Fetch(ifNewerThan)
+		if err == ErrUnmodified {
+			continue
+		}
+		if err != nil {
+			rcs.Close()
+			return nil, err
+		}
+		rcs[i] = rc
+		modified = true
+	}
+	if !modified {
+		return nil, ErrUnmodified
+	}
+	for i, source := range sources {
+		if rcs[i] == nil {
+			rc, err := source.Fetch(time.Time{})
+			if err != nil {
+				rcs.Close()
+				return nil, err
+			}
+			rcs[i] = rc
+		}
+	}
+	return rcs, nil
+}
+
+type concatReader struct {
+	io.Reader
+	rcs chainedCloser
+}
+
+func (r *concatReader) Close() error {
+	return r.rcs.Close()
+}
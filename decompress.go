@@ -0,0 +1,109 @@
+package keepcurrent
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type decompressor struct {
+	magic   []byte
+	factory func(io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	decompressorsMx sync.RWMutex
+	decompressors   = []decompressor{
+		{[]byte{0x1f, 0x8b}, func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		}},
+		{[]byte{0x28, 0xb5, 0x2f, 0xfd}, func(r io.Reader) (io.ReadCloser, error) {
+			dec, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return dec.IOReadCloser(), nil
+		}},
+		{[]byte("BZh"), func(r io.Reader) (io.ReadCloser, error) {
+			return ioutil.NopCloser(bzip2.NewReader(r)), nil
+		}},
+	}
+)
+
+// RegisterDecompressor registers the factory of a decompressor for the data
+// starting with magic for AutoDecompress, in addition to the built-in gzip,
+// zstd and bzip2. The factory reads the data from the start, including the
+// magic. A later registration takes precedence over earlier ones and
+// the built-in ones for the same data.
+func RegisterDecompressor(magic []byte, factory func(io.Reader) (io.ReadCloser, error)) {
+	decompressorsMx.Lock()
+	decompressors = append(decompressors, decompressor{append([]byte(nil), magic...), factory})
+	decompressorsMx.Unlock()
+}
+
+type autoDecompressSource struct {
+	s Source
+}
+
+// AutoDecompress wraps a source to decompress the data by the format told by
+// its first bytes, as registered with RegisterDecompressor. Data in no known
+// format is passed on as is. Only the first bytes are buffered to tell the
+// format, the rest is decompressed as it's read.
+func AutoDecompress(s Source) Source {
+	return &autoDecompressSource{s}
+}
+
+func (s *autoDecompressSource) Fetch(ifNewerThan time.Time) (io.ReadCloser, error) {
+	rc, err := s.s.Fetch(ifNewerThan)
+	if err != nil {
+		return nil, err
+	}
+	decompressorsMx.RLock()
+	candidates := decompressors
+	decompressorsMx.RUnlock()
+	magicLen := 0
+	for _, d := range candidates {
+		if len(d.magic) > magicLen {
+			magicLen = len(d.magic)
+		}
+	}
+	br := bufio.NewReaderSize(rc, magicLen)
+	magic, err := br.Peek(magicLen)
+	if err != nil && err != io.EOF {
+		rc.Close()
+		return nil, err
+	}
+	md := metadataOf(rc)
+	for i := len(candidates) - 1; i >= 0; i-- {
+		if !bytes.HasPrefix(magic, candidates[i].magic) {
+			continue
+		}
+		dec, err := candidates[i].factory(br)
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		// The type is likely that of the compressed data, e.g.
+		// application/gzip, so leave it to the runner to sniff
+		md.ContentEncoding, md.ContentType = "", ""
+		return withMetadata(chainedCloser{dec, rc}, md), nil
+	}
+	return withMetadata(chainedCloser{ioutil.NopCloser(br), rc}, md), nil
+}
+
+// Describe implements DescribedSource
+func (s *autoDecompressSource) Describe() string {
+	return describe(s.s) + " decompressed"
+}
+
+// ResetConditions implements ResettableSource
+func (s *autoDecompressSource) ResetConditions() {
+	resetConditions(s.s)
+}
@@ -0,0 +1,174 @@
+package keepcurrent
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type dirTarGzSink struct {
+	dir string
+}
+
+// ToDirTarGz constructs a sink which extracts the gzipped tarball into dir,
+// creating it if necessary. Only regular files and directories are extracted,
+// and files in dir which are not in the tarball are left alone.
+//
+// The SHA-256 hash of every extracted file is recorded in a manifest next to
+// dir, named after it with a ".manifest.json" suffix, which is replaced
+// atomically after each file. If the extraction is interrupted, e.g. by a
+// crash, the next one only rewrites the files which are missing or changed
+// since, rather than everything. A file which already has the content of the
+// member is never written, not even to a temporary file.
+func ToDirTarGz(dir string) Sink {
+	return &dirTarGzSink{dir}
+}
+
+func (s *dirTarGzSink) manifestPath() string {
+	return filepath.Clean(s.dir) + ".manifest.json"
+}
+
+func (s *dirTarGzSink) UpdateFrom(r io.Reader) error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	manifest := make(map[string]string)
+	if b, err := ioutil.ReadFile(s.manifestPath()); err == nil {
+		// Start over if the manifest is corrupted
+		if json.Unmarshal(b, &manifest) != nil {
+			manifest = make(map[string]string)
+		}
+	}
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gzr.Close()
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(os.PathSeparator)) {
+			return fmt.Errorf("illegal file path in tarball: %v", hdr.Name)
+		}
+		target := filepath.Join(s.dir, name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			hash, changed, err := extractFile(tr, target, hdr.Size, manifest[name])
+			if err != nil {
+				return err
+			}
+			if changed {
+				manifest[name] = hash
+				if err := s.writeManifest(manifest); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// extractFile writes the data of the given size to the target file unless the
+// file already has the same content, in which case it's not written at all.
+// It returns the hash of the data and whether it differs from knownHash, the
+// hash recorded in the manifest.
+func extractFile(r io.Reader, target string, size int64, knownHash string) (string, bool, error) {
+	hasher := sha256.New()
+	r = io.TeeReader(r, hasher)
+	if f, err := os.Open(target); err == nil {
+		defer f.Close()
+		same, rest, err := sameContent(r, f, size)
+		if err != nil {
+			return "", false, err
+		}
+		if same {
+			hash := hex.EncodeToString(hasher.Sum(nil))
+			return hash, hash != knownHash, nil
+		}
+		r = rest
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", false, err
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(target), "."+filepath.Base(target)+"-")
+	if err != nil {
+		return "", false, err
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = io.Copy(tmpFile, r)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if err := os.Chmod(tmpFile.Name(), 0644); err != nil {
+		return "", false, err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), true, os.Rename(tmpFile.Name(), target)
+}
+
+// sameContent reads the data of the given size for as long as it's the same
+// as the content of the file. It returns whether all of it is, and if not, a
+// reader of the whole data, made of the part which was the same read back
+// from the file, followed by the rest of the data.
+func sameContent(r io.Reader, f *os.File, size int64) (bool, io.Reader, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return false, nil, err
+	}
+	if fi.Size() != size {
+		return false, r, nil
+	}
+	buf, fileBuf := make([]byte, 32<<10), make([]byte, 32<<10)
+	var same int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			return true, nil, nil
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return false, nil, err
+		}
+		if _, err := io.ReadFull(f, fileBuf[:n]); err != nil || !bytes.Equal(buf[:n], fileBuf[:n]) {
+			return false, io.MultiReader(io.NewSectionReader(f, 0, same), bytes.NewReader(buf[:n]), r), nil
+		}
+		same += int64(n)
+	}
+}
+
+func (s *dirTarGzSink) writeManifest(manifest map[string]string) error {
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(s.manifestPath(), b)
+}
+
+// ReusableReader implements ReusableReaderSink
+func (s *dirTarGzSink) ReusableReader() bool {
+	return true
+}
+
+func (s *dirTarGzSink) String() string {
+	return "tar.gz directory sink to " + absPath(s.dir)
+}
@@ -0,0 +1,129 @@
+package keepcurrent
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type dirSource struct {
+	dir     string
+	pattern string
+
+	mx    sync.Mutex
+	names []string
+	reset bool
+}
+
+// FromDir constructs a source which concatenates the files in dir matching
+// the pattern, as in filepath.Match, in the lexical order of their names,
+// e.g. to assemble the config from fragments in a conf.d directory.
+// Subdirectories are skipped. It's modified if any of the files is modified
+// since ifNewerThan, or if a file was added or removed since the data was
+// last read in full, even if the remaining files look older. An empty
+// directory makes for empty data.
+func FromDir(dir, pattern string) Source {
+	return &dirSource{dir: dir, pattern: pattern}
+}
+
+func (s *dirSource) Fetch(ifNewerThan time.Time) (io.ReadCloser, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, dirPattern(s.pattern)))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	var names []string
+	var modTime time.Time
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if fi.IsDir() {
+			continue
+		}
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+		names = append(names, filepath.Base(path))
+	}
+	if !ifNewerThan.IsZero() && !modTime.After(ifNewerThan) && s.sameNames(names) && !s.isReset() {
+		return nil, ErrUnmodified
+	}
+	files := make(chainedCloser, 0, len(names))
+	readers := make([]io.Reader, 0, len(names))
+	for _, name := range names {
+		f, err := os.Open(filepath.Join(s.dir, name))
+		if err != nil {
+			files.Close()
+			return nil, err
+		}
+		files = append(files, f)
+		readers = append(readers, f)
+	}
+	r := &dirReader{Reader: io.MultiReader(readers...), files: files, s: s, names: names}
+	return withMetadata(r, Metadata{ModTime: modTime}), nil
+}
+
+// dirPattern returns the pattern to match all files if it's empty.
+func dirPattern(p string) string {
+	if p == "" {
+		return "*"
+	}
+	return p
+}
+
+func (s *dirSource) sameNames(names []string) bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return strings.Join(s.names, "/") == strings.Join(names, "/")
+}
+
+func (s *dirSource) setNames(names []string) {
+	s.mx.Lock()
+	s.names, s.reset = names, false
+	s.mx.Unlock()
+}
+
+func (s *dirSource) isReset() bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.reset
+}
+
+// Describe implements DescribedSource
+func (s *dirSource) Describe() string {
+	return filepath.Join(absPath(s.dir), dirPattern(s.pattern))
+}
+
+// ResetConditions implements ResettableSource
+func (s *dirSource) ResetConditions() {
+	s.mx.Lock()
+	s.reset = true
+	s.mx.Unlock()
+}
+
+// dirReader remembers which files made up the data once it's read in full,
+// so that a failed read is retried rather than considered unmodified.
+type dirReader struct {
+	io.Reader
+	files chainedCloser
+	s     *dirSource
+	names []string
+}
+
+func (r *dirReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		r.s.setNames(r.names)
+	}
+	return n, err
+}
+
+func (r *dirReader) Close() error {
+	return r.files.Close()
+}
@@ -0,0 +1,160 @@
+package keepcurrent
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// ErrNoCandidates is returned by a source constructed by FromDiscovered when
+// the discovery lists no URLs to fetch from.
+var ErrNoCandidates = errors.New("no candidate URLs discovered")
+
+type discoveredSource struct {
+	discovery Source
+	parse     func([]byte) ([]string, error)
+	refresh   time.Duration
+	opts      WebOptions
+
+	mx         sync.Mutex
+	candidates []string
+	discovered time.Time
+	sources    map[string]Source
+	active     string
+}
+
+// FromDiscovered constructs a source which fetches a list of candidate URLs
+// from the discovery source, parsed by parse, and then fetches the data from
+// the web from the first of them which succeeds, the same way as
+// FromFallback, e.g. for a discovery endpoint returning the current mirrors.
+// The list is refreshed on every fetch, conditionally on the time it was last
+// fetched, and the last list is kept in case the discovery is unmodified or
+// fails. Each candidate keeps its own conditional state across refreshes, and
+// a candidate other than the one which served the data last is fetched from
+// unconditionally, as its state doesn't tell what was synced.
+func FromDiscovered(discovery Source, parse func([]byte) ([]string, error)) Source {
+	return FromDiscoveredWithRefresh(discovery, parse, 0)
+}
+
+// FromDiscoveredWithRefresh is the same as FromDiscovered but only refreshes
+// the list of candidates once it's older than refresh, so that the discovery
+// can be polled less often than the data.
+func FromDiscoveredWithRefresh(discovery Source, parse func([]byte) ([]string, error), refresh time.Duration) Source {
+	return FromDiscoveredWithOptions(discovery, parse, refresh, WebOptions{})
+}
+
+// FromDiscoveredWithOptions is the same as FromDiscoveredWithRefresh but
+// fetches from the candidates with the given options, e.g. with a client for
+// mirrors behind mTLS or a proxy. The discovery itself is fetched by the given
+// source.
+func FromDiscoveredWithOptions(discovery Source, parse func([]byte) ([]string, error), refresh time.Duration, opts WebOptions) Source {
+	return &discoveredSource{discovery: discovery, parse: parse, refresh: refresh, opts: opts, sources: make(map[string]Source)}
+}
+
+// Fetch implements the Source interface
+func (s *discoveredSource) Fetch(ifNewerThan time.Time) (io.ReadCloser, error) {
+	return s.FetchContext(context.Background(), ifNewerThan)
+}
+
+// FetchContext implements the ContextSource interface
+func (s *discoveredSource) FetchContext(ctx context.Context, ifNewerThan time.Time) (io.ReadCloser, error) {
+	candidates, err := s.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoCandidates
+	}
+	for _, url := range candidates {
+		s.mx.Lock()
+		source := s.sources[url]
+		if source == nil {
+			source = FromWebWithOptions(url, s.opts)
+			s.sources[url] = source
+		}
+		since := ifNewerThan
+		if url != s.active {
+			since = time.Time{}
+		}
+		s.mx.Unlock()
+		var rc io.ReadCloser
+		rc, err = source.(ContextSource).FetchContext(ctx, since)
+		if err == nil || err == ErrUnmodified {
+			s.mx.Lock()
+			s.active = url
+			s.mx.Unlock()
+			return rc, err
+		}
+	}
+	return nil, err
+}
+
+// discover returns the list of candidates, refreshing it if it's due.
+func (s *discoveredSource) discover(ctx context.Context) ([]string, error) {
+	s.mx.Lock()
+	candidates, discovered := s.candidates, s.discovered
+	s.mx.Unlock()
+	now := time.Now()
+	if candidates != nil && now.Sub(discovered) < s.refresh {
+		return candidates, nil
+	}
+	var rc io.ReadCloser
+	var err error
+	if cs, ok := s.discovery.(ContextSource); ok {
+		rc, err = cs.FetchContext(ctx, discovered)
+	} else {
+		rc, err = s.discovery.Fetch(discovered)
+	}
+	if err == nil {
+		var data []byte
+		data, err = ioutil.ReadAll(rc)
+		rc.Close()
+		if err == nil {
+			var parsed []string
+			parsed, err = s.parse(data)
+			if err == nil {
+				candidates = append([]string{}, parsed...)
+			}
+		}
+	}
+	if err != nil && err != ErrUnmodified {
+		if candidates != nil {
+			// Keep using the last list until the discovery recovers
+			return candidates, nil
+		}
+		return nil, err
+	}
+	s.mx.Lock()
+	s.candidates, s.discovered = candidates, now
+	// Forget the state of the candidates no longer listed
+	listed := make(map[string]bool, len(candidates))
+	for _, url := range candidates {
+		listed[url] = true
+	}
+	for url := range s.sources {
+		if !listed[url] {
+			delete(s.sources, url)
+		}
+	}
+	s.mx.Unlock()
+	return candidates, nil
+}
+
+// Describe implements DescribedSource
+func (s *discoveredSource) Describe() string {
+	return "discovered from " + describe(s.discovery)
+}
+
+// ResetConditions implements ResettableSource, by resetting the candidates,
+// while the list of them is kept.
+func (s *discoveredSource) ResetConditions() {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for _, source := range s.sources {
+		resetConditions(source)
+	}
+	s.active = ""
+}
@@ -0,0 +1,89 @@
+package keepcurrent
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+type jsonEnvelopeSource struct {
+	s         Source
+	dataField string
+	timeField string
+}
+
+// FromJSONEnvelope wraps a source whose data is a JSON object carrying the
+// actual data base64-encoded in the string field dataField, such as
+// {"data": "...", "updated": "..."}, to fetch the decoded data instead. If
+// timeField is given, that field tells when the data was last modified, as an
+// RFC 3339 string or Unix seconds, and the data is unmodified unless that's
+// after ifNewerThan. A malformed envelope fails the fetch.
+func FromJSONEnvelope(s Source, dataField, timeField string) Source {
+	return &jsonEnvelopeSource{s, dataField, timeField}
+}
+
+func (s *jsonEnvelopeSource) Fetch(ifNewerThan time.Time) (io.ReadCloser, error) {
+	rc, err := s.s.Fetch(ifNewerThan)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	var envelope map[string]json.RawMessage
+	if err := json.NewDecoder(rc).Decode(&envelope); err != nil {
+		return nil, fmt.Errorf("malformed JSON envelope: %v", err)
+	}
+	raw, found := envelope[s.dataField]
+	if !found {
+		return nil, fmt.Errorf("JSON envelope has no field %v", s.dataField)
+	}
+	var encoded string
+	if err := json.Unmarshal(raw, &encoded); err != nil {
+		return nil, fmt.Errorf("field %v of JSON envelope is not a string", s.dataField)
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("field %v of JSON envelope is not base64: %v", s.dataField, err)
+	}
+	md := metadataOf(rc)
+	// The type is that of the envelope rather than the data
+	md.ContentType = ""
+	if s.timeField != "" {
+		modTime, err := envelopeTime(envelope[s.timeField])
+		if err != nil {
+			return nil, fmt.Errorf("field %v of JSON envelope is not a time: %v", s.timeField, err)
+		}
+		if !ifNewerThan.IsZero() && !modTime.After(ifNewerThan) {
+			return nil, ErrUnmodified
+		}
+		md.ModTime = modTime
+	}
+	return withMetadata(ioutil.NopCloser(bytes.NewReader(data)), md), nil
+}
+
+// envelopeTime parses the time in a JSON envelope, either an RFC 3339 string
+// or Unix seconds.
+func envelopeTime(raw json.RawMessage) (time.Time, error) {
+	var seconds int64
+	if json.Unmarshal(raw, &seconds) == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	var str string
+	if err := json.Unmarshal(raw, &str); err != nil {
+		return time.Time{}, fmt.Errorf("%s is neither a string nor a number", raw)
+	}
+	return time.Parse(time.RFC3339, str)
+}
+
+// Describe implements DescribedSource
+func (s *jsonEnvelopeSource) Describe() string {
+	return fmt.Sprintf("field %v of JSON envelope %v", s.dataField, describe(s.s))
+}
+
+// ResetConditions implements ResettableSource
+func (s *jsonEnvelopeSource) ResetConditions() {
+	resetConditions(s.s)
+}
@@ -0,0 +1,84 @@
+package keepcurrent
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// FallbackOptions configures a source constructed by
+// FromFallbackWithOptions. The callbacks are called on their own goroutines
+// so as not to hold up the fetch, so they may be called out of order if they
+// take long.
+type FallbackOptions struct {
+	// If given, OnFailover is called whenever fetching from the source at
+	// index from fails with err, and the source at index to is tried next.
+	OnFailover func(from, to int, err error)
+	// If given, OnRecover is called when fetching from the primary source,
+	// i.e. the first, succeeds again after a fetch had to fall back to the
+	// source at index from.
+	OnRecover func(from int)
+}
+
+type fallbackSource struct {
+	sources []Source
+	opts    FallbackOptions
+
+	mx     sync.Mutex
+	active int
+}
+
+// FromFallback constructs a source which fetches from the first of the
+// sources, the primary, and falls back to the next one whenever one fails,
+// e.g. to fetch from mirrors. Every fetch starts with the primary again. A
+// source reporting ErrUnmodified doesn't count as failing. If all of the
+// sources fail, the error of the last one is returned.
+func FromFallback(sources ...Source) Source {
+	return FromFallbackWithOptions(FallbackOptions{}, sources...)
+}
+
+// FromFallbackWithOptions is the same as FromFallback but with the given
+// options.
+func FromFallbackWithOptions(opts FallbackOptions, sources ...Source) Source {
+	return &fallbackSource{sources: sources, opts: opts}
+}
+
+func (s *fallbackSource) Fetch(ifNewerThan time.Time) (io.ReadCloser, error) {
+	if len(s.sources) == 0 {
+		return nil, ErrNoSource
+	}
+	var err error
+	for i, source := range s.sources {
+		var rc io.ReadCloser
+		rc, err = source.Fetch(ifNewerThan)
+		if err == nil || err == ErrUnmodified {
+			s.served(i)
+			return rc, err
+		}
+		if i+1 < len(s.sources) && s.opts.OnFailover != nil {
+			go s.opts.OnFailover(i, i+1, err)
+		}
+	}
+	return nil, err
+}
+
+// served records that the source at index i has served the fetch.
+func (s *fallbackSource) served(i int) {
+	s.mx.Lock()
+	from := s.active
+	s.active = i
+	s.mx.Unlock()
+	if i == 0 && from > 0 && s.opts.OnRecover != nil {
+		go s.opts.OnRecover(from)
+	}
+}
+
+// Describe implements DescribedSource
+func (s *fallbackSource) Describe() string {
+	return "fallback of " + describeAll(s.sources)
+}
+
+// ResetConditions implements ResettableSource
+func (s *fallbackSource) ResetConditions() {
+	resetConditions(s.sources...)
+}
@@ -0,0 +1,88 @@
+package keepcurrent
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+)
+
+// stream copies the data from r, described by md, to all of the sinks
+// concurrently, each through its own pipe, and also buffers the data if
+// requested. It returns the
+// buffered data and the error of each sink, or the error reading from r, in
+// which case the sinks' errors are irrelevant.
+func stream(ctx context.Context, r io.Reader, md Metadata, sinks []Sink, buffer bool) ([]byte, []error, error) {
+	var wg sync.WaitGroup
+	sinkErrs := make([]error, len(sinks))
+	pipes := make([]*io.PipeWriter, len(sinks))
+	fo := make(fanout, 0, len(sinks)+1)
+	var writers []*sinkWriter
+	for i, s := range sinks {
+		if ws, ok := s.(WriterSink); ok {
+			// Write straight to the writer rather than through a pipe
+			sw := &sinkWriter{w: ws.Writer(), i: i}
+			writers = append(writers, sw)
+			fo = append(fo, sw)
+			continue
+		}
+		pr, pw := io.Pipe()
+		pipes[i] = pw
+		fo = append(fo, pw)
+		wg.Add(1)
+		go func(i int, s Sink) {
+			defer wg.Done()
+			sinkErrs[i] = updateSink(ctx, s, pr, md)
+			// Unblock the writer if the sink returns without reading all
+			pr.Close()
+		}(i, s)
+	}
+	var buf bytes.Buffer
+	if buffer {
+		fo = append(fo, &buf)
+	}
+	_, err := io.Copy(&fo, r)
+	for _, pw := range pipes {
+		if pw != nil {
+			pw.CloseWithError(err)
+		}
+	}
+	wg.Wait()
+	for _, sw := range writers {
+		sinkErrs[sw.i] = sw.err
+	}
+	return buf.Bytes(), sinkErrs, err
+}
+
+// sinkWriter records the error writing to the writer of a WriterSink.
+type sinkWriter struct {
+	w   io.Writer
+	i   int
+	err error
+}
+
+func (sw *sinkWriter) Write(p []byte) (int, error) {
+	n, err := sw.w.Write(p)
+	if err == nil && n < len(p) {
+		err = io.ErrShortWrite
+	}
+	sw.err = err
+	return n, err
+}
+
+// fanout writes to all of its writers. Unlike io.MultiWriter, it keeps
+// writing to the rest of the writers if any of them fails, and never fails
+// itself, so the source is read to the end even once all of them failed.
+type fanout []io.Writer
+
+func (fo *fanout) Write(p []byte) (int, error) {
+	for i, w := range *fo {
+		if w == nil {
+			continue
+		}
+		if _, err := w.Write(p); err != nil {
+			(*fo)[i] = nil
+		}
+	}
+	return len(p), nil
+}
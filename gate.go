@@ -0,0 +1,31 @@
+package keepcurrent
+
+// FetchGate is a semaphore limiting how many fetches can be in progress at the
+// same time across all of the runners sharing it.
+type FetchGate struct {
+	slots chan struct{}
+}
+
+// NewFetchGate constructs a FetchGate which allows up to k concurrent
+// fetches. A k less than 1 allows one, as no fetch could ever pass otherwise.
+func NewFetchGate(k int) *FetchGate {
+	if k < 1 {
+		k = 1
+	}
+	return &FetchGate{slots: make(chan struct{}, k)}
+}
+
+// acquire blocks until a slot is available or chStop is closed, and returns
+// false in the latter case.
+func (g *FetchGate) acquire(chStop <-chan struct{}) bool {
+	select {
+	case g.slots <- struct{}{}:
+		return true
+	case <-chStop:
+		return false
+	}
+}
+
+func (g *FetchGate) release() {
+	<-g.slots
+}
@@ -0,0 +1,172 @@
+package keepcurrent
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Group syncs several sources each to its own sinks on one schedule, managed
+// as a unit. Every pair is a Runner of its own, which can be configured as
+// usual, but the runners are synced together by the group rather than
+// started individually.
+type Group struct {
+	// Clock is used for the schedule, defaulting to the real clock.
+	Clock Clock
+
+	mx      sync.Mutex
+	runners []*Runner
+	gate    *FetchGate
+}
+
+// NewGroup constructs an empty group.
+func NewGroup() *Group {
+	return &Group{}
+}
+
+// WithGate makes the runners of the group, including those already added,
+// pass the gate before fetching, e.g. to limit how many of them fetch at
+// once.
+func (g *Group) WithGate(gate *FetchGate) *Group {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+	g.gate = gate
+	for _, runner := range g.runners {
+		runner.WithGate(gate)
+	}
+	return g
+}
+
+// Add adds a pair of a source and its sinks to the group and returns the
+// runner syncing them, e.g. to set its callbacks or to read its counters. It
+// can be called while the group is started, in which case the pair is synced
+// from the next tick on.
+func (g *Group) Add(from Source, to ...Sink) *Runner {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+	runner := New(from, to...)
+	if g.gate != nil {
+		runner.WithGate(g.gate)
+	}
+	g.runners = append(g.runners, runner)
+	return runner
+}
+
+// Runners returns the runners of the group in the order they were added.
+func (g *Group) Runners() []*Runner {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+	return append([]*Runner(nil), g.runners...)
+}
+
+// Start syncs every pair right away and then on every interval, all at the
+// same time, and a pair with a WatchedSource on its own once a burst of its
+// events is over. It returns a function to stop the group, which waits for the
+// syncs in progress to finish. Misconfigured runners, e.g. without sinks, are
+// skipped. If the interval is not positive, it logs the problem and doesn't
+// start the group, as Runner.Start.
+func (g *Group) Start(interval time.Duration) func() {
+	return g.start(interval, nil)
+}
+
+// StartWithErrors is the same as Start but also sends the errors of all of the
+// runners to the returned channel, the same way as Runner.StartWithErrors.
+// The channel is closed when the group stops, and must be drained.
+func (g *Group) StartWithErrors(interval time.Duration) (func(), <-chan error) {
+	errs := make(chan error, 10)
+	return g.start(interval, errs), errs
+}
+
+func (g *Group) start(interval time.Duration, errs chan error) func() {
+	if interval <= 0 {
+		log.Printf("keepcurrent: not starting group: %v", ErrInvalidInterval)
+		if errs != nil {
+			close(errs)
+		}
+		return func() {}
+	}
+	clock := g.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
+	tk := clock.NewTicker(interval)
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &loop{ctx: ctx, errs: errs}
+	chStopped := make(chan struct{})
+	changed := make(chan *Runner)
+	watched := make(map[*Runner]bool)
+	go func() {
+		runners := g.Runners()
+		for {
+			g.syncAll(interval, runners, l)
+			g.watch(ctx, clock, watched, changed)
+			select {
+			case <-ctx.Done():
+				tk.Stop()
+				for _, runner := range g.Runners() {
+					runner.flush(l)
+				}
+				if errs != nil {
+					close(errs)
+				}
+				close(chStopped)
+				return
+			case <-tk.C():
+				runners = g.Runners()
+			case runner := <-changed:
+				runners = []*Runner{runner}
+			}
+		}
+	}()
+	return func() { cancel(); <-chStopped }
+}
+
+// watch watches the sources of the runners not watched yet which are
+// WatchedSource, sending the runner to changed once a burst of events is
+// over.
+func (g *Group) watch(ctx context.Context, clock Clock, watched map[*Runner]bool, changed chan<- *Runner) {
+	for _, runner := range g.Runners() {
+		if watched[runner] {
+			continue
+		}
+		watched[runner] = true
+		changes := watch(ctx, clock, runner.source)
+		if changes == nil {
+			continue
+		}
+		go func(runner *Runner) {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-changes:
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case changed <- runner:
+				}
+			}
+		}(runner)
+	}
+}
+
+// syncAll syncs the pairs concurrently and waits for all of them.
+func (g *Group) syncAll(interval time.Duration, runners []*Runner, l *loop) {
+	var wg sync.WaitGroup
+	for _, runner := range runners {
+		if runner.checkConfig() != nil {
+			continue
+		}
+		runner.mx.Lock()
+		runner.interval = interval
+		runner.mx.Unlock()
+		wg.Add(1)
+		go func(runner *Runner) {
+			defer wg.Done()
+			runner.syncOnce(runner.source, l)
+		}(runner)
+	}
+	wg.Wait()
+}
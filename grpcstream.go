@@ -0,0 +1,194 @@
+package keepcurrent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// errStreamEnded is returned when the server ends the stream of a source
+// constructed by FromGRPCStream, so that it's reconnected.
+var errStreamEnded = errors.New("stream ended by the server")
+
+// StreamReceiver receives the messages of a stream, such as the client of a
+// gRPC server-streaming RPC adapted to return the serialized messages, e.g.
+// with proto.Marshal.
+type StreamReceiver interface {
+	Recv() ([]byte, error)
+}
+
+// StreamSender sends messages to a stream, such as the client of a gRPC
+// client-streaming RPC adapted to take the serialized messages.
+type StreamSender interface {
+	Send([]byte) error
+}
+
+type grpcStreamSource struct {
+	open func(ctx context.Context) (StreamReceiver, error)
+	ctx  context.Context
+
+	mx        sync.Mutex
+	connected chan struct{}
+	err       error
+	data      []byte
+	received  time.Time
+}
+
+// FromGRPCStream constructs a source which opens a stream with open and
+// keeps receiving the messages in the background, serving the latest one.
+// Every message received since ifNewerThan makes the data modified, and none
+// unmodified. The stream is opened on the first fetch, which waits for the
+// first message. If the stream fails, the next fetch returns the error, so
+// that the runner backs off as with any source error, and the one after
+// opens the stream again. The messages are received independent of the
+// fetches, so open is given a context of its own, which is canceled by
+// calling the returned function.
+func FromGRPCStream(open func(ctx context.Context) (StreamReceiver, error)) (Source, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &grpcStreamSource{open: open, ctx: ctx}, cancel
+}
+
+func (s *grpcStreamSource) Fetch(ifNewerThan time.Time) (io.ReadCloser, error) {
+	return s.FetchContext(context.Background(), ifNewerThan)
+}
+
+// FetchContext implements the ContextSource interface
+func (s *grpcStreamSource) FetchContext(ctx context.Context, ifNewerThan time.Time) (io.ReadCloser, error) {
+	connected, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-connected:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	s.mx.Lock()
+	data, received, err := s.data, s.received, s.err
+	s.err = nil
+	s.mx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if received.IsZero() || !ifNewerThan.IsZero() && !received.After(ifNewerThan) {
+		return nil, ErrUnmodified
+	}
+	// The data is replaced rather than modified when a message is received,
+	// so it can be read without holding the lock.
+	return withMetadata(ioutil.NopCloser(bytes.NewReader(data)), Metadata{ModTime: received}), nil
+}
+
+// connect opens the stream unless it's open, and returns a channel closed
+// once the first message or error is received. If the stream has failed, it
+// returns the error instead, once.
+func (s *grpcStreamSource) connect() (chan struct{}, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if err := s.err; err != nil {
+		s.err = nil
+		return nil, err
+	}
+	if s.connected != nil {
+		return s.connected, nil
+	}
+	if err := s.ctx.Err(); err != nil {
+		return nil, err
+	}
+	r, err := s.open(s.ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.connected = make(chan struct{})
+	go s.receive(r, s.connected)
+	return s.connected, nil
+}
+
+func (s *grpcStreamSource) receive(r StreamReceiver, connected chan struct{}) {
+	first := true
+	for {
+		msg, err := r.Recv()
+		s.mx.Lock()
+		if err == nil {
+			s.data, s.received = msg, time.Now()
+		} else {
+			if err == io.EOF {
+				err = errStreamEnded
+			}
+			s.err, s.connected = err, nil
+		}
+		s.mx.Unlock()
+		if first {
+			close(connected)
+			first = false
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Describe implements DescribedSource
+func (s *grpcStreamSource) Describe() string {
+	return fmt.Sprintf("gRPC stream %p", s)
+}
+
+type grpcStreamSink struct {
+	open func(ctx context.Context) (StreamSender, error)
+	ctx  context.Context
+
+	mx     sync.Mutex
+	sender StreamSender
+	// cancelSender cancels the context of the open stream
+	cancelSender context.CancelFunc
+}
+
+// ToGRPCStream constructs a sink which sends the data as a message to a
+// stream opened with open, e.g. to push the updates upstream. The stream is
+// opened on the first update and kept open for the next ones. If sending
+// fails, the stream is dropped and opened again on the next update. Call the
+// returned function to cancel the stream.
+func ToGRPCStream(open func(ctx context.Context) (StreamSender, error)) (Sink, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &grpcStreamSink{open: open, ctx: ctx}, cancel
+}
+
+func (s *grpcStreamSink) UpdateFrom(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.sender == nil {
+		if err := s.ctx.Err(); err != nil {
+			return err
+		}
+		ctx, cancel := context.WithCancel(s.ctx)
+		sender, err := s.open(ctx)
+		if err != nil {
+			cancel()
+			return err
+		}
+		s.sender, s.cancelSender = sender, cancel
+	}
+	if err := s.sender.Send(data); err != nil {
+		s.cancelSender()
+		s.sender, s.cancelSender = nil, nil
+		return err
+	}
+	return nil
+}
+
+// ReusableReader implements ReusableReaderSink
+func (s *grpcStreamSink) ReusableReader() bool {
+	return true
+}
+
+func (s *grpcStreamSink) String() string {
+	return fmt.Sprintf("gRPC stream %p", s)
+}
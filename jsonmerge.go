@@ -0,0 +1,86 @@
+package keepcurrent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+type jsonMergeSource struct {
+	sources []Source
+}
+
+// FromJSONMerge constructs a source which deep-merges the JSON objects from
+// all given sources, later ones overriding earlier ones, e.g. to layer
+// environment-specific overrides onto a shared base config. Objects are merged
+// key by key recursively, while any other value, including arrays, replaces
+// the earlier one. It fails if any source doesn't hold a JSON object, or if an
+// object would be merged with a non-object. Like FromConcat, it's unmodified
+// only if all of the sources are unmodified.
+func FromJSONMerge(sources ...Source) Source {
+	return &jsonMergeSource{sources}
+}
+
+func (s *jsonMergeSource) Fetch(ifNewerThan time.Time) (io.ReadCloser, error) {
+	rcs, err := fetchAll(s.sources, ifNewerThan)
+	if err != nil {
+		return nil, err
+	}
+	defer rcs.Close()
+	merged := map[string]interface{}{}
+	for i, rc := range rcs {
+		var obj map[string]interface{}
+		dec := json.NewDecoder(rc)
+		dec.UseNumber()
+		if err := dec.Decode(&obj); err != nil {
+			return nil, fmt.Errorf("source %d is not a JSON object: %v", i, err)
+		}
+		if err := mergeJSON(merged, obj, ""); err != nil {
+			return nil, fmt.Errorf("merging source %d: %v", i, err)
+		}
+	}
+	b, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+// Describe implements DescribedSource
+func (s *jsonMergeSource) Describe() string {
+	return "JSON merge of " + describeAll(s.sources)
+}
+
+// ResetConditions implements ResettableSource
+func (s *jsonMergeSource) ResetConditions() {
+	resetConditions(s.sources...)
+}
+
+// mergeJSON merges src into dst recursively. path locates dst in the whole
+// document, for the error messages.
+func mergeJSON(dst, src map[string]interface{}, path string) error {
+	for key, value := range src {
+		keyPath := path + "/" + key
+		existing, found := dst[key]
+		if !found {
+			dst[key] = value
+			continue
+		}
+		dstObj, dstIsObj := existing.(map[string]interface{})
+		srcObj, srcIsObj := value.(map[string]interface{})
+		switch {
+		case dstIsObj && srcIsObj:
+			if err := mergeJSON(dstObj, srcObj, keyPath); err != nil {
+				return err
+			}
+		case dstIsObj || srcIsObj:
+			return fmt.Errorf("conflicting types at %v: %T and %T", keyPath, existing, value)
+		default:
+			dst[key] = value
+		}
+	}
+	return nil
+}
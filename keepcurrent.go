@@ -4,10 +4,18 @@
 package keepcurrent
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,137 +23,1365 @@ import (
 // since the last sync.
 var ErrUnmodified = errors.New("unmodified")
 
+// ErrNoSinks is returned by StartE when the runner has no sinks.
+var ErrNoSinks = errors.New("no sinks to sync to")
+
+// ErrNoSource is returned by StartE when the runner has no source.
+var ErrNoSource = errors.New("no source to sync from")
+
+// ErrInvalidInterval is returned by StartE when the interval is not positive.
+var ErrInvalidInterval = errors.New("interval must be positive")
+
+// ErrNoRetainedData is returned by ReplayLast when there's no data to replay,
+// either as nothing was synced yet, or as the data isn't retained.
+var ErrNoRetainedData = errors.New("no retained data")
+
+// errStopped is returned internally when the loop is stopped midway.
+var errStopped = errors.New("stopped")
+
+// errCanceled is returned internally when the current sync is canceled by
+// CancelCurrent.
+var errCanceled = errors.New("canceled")
+
+// errAllSinksFailed is returned internally when writing to every sink fails.
+var errAllSinksFailed = errors.New("all sinks failed")
+
+// SourceError describes a failure fetching from the source.
+type SourceError struct {
+	// Source is the source failed to fetch from.
+	Source Source
+	Err    error
+	// Tries is how many times has been tried and failed in a row.
+	Tries int
+}
+
+func (e *SourceError) Error() string {
+	return fmt.Sprintf("error fetching from %v after %d tries: %v", describe(e.Source), e.Tries, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *SourceError) Unwrap() error {
+	return e.Err
+}
+
+// SinkError describes a failure writing to a sink.
+type SinkError struct {
+	Sink Sink
+	Err  error
+	// Required tells if the sink is marked by Required, in which case the
+	// sync as a whole has failed.
+	Required bool
+}
+
+func (e *SinkError) Error() string {
+	return fmt.Sprintf("error writing to %v: %v", e.Sink, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *SinkError) Unwrap() error {
+	return e.Err
+}
+
+// SyncPhase tells in which phase of a sync an error happened, see SyncError.
+type SyncPhase int
+
+const (
+	// PhaseFetch is fetching or reading the data from the source.
+	PhaseFetch SyncPhase = iota
+	// PhaseValidate is validating the data with Runner.Validate.
+	PhaseValidate
+	// PhaseSink is writing the data to a sink.
+	PhaseSink
+)
+
+func (p SyncPhase) String() string {
+	switch p {
+	case PhaseFetch:
+		return "fetch"
+	case PhaseValidate:
+		return "validate"
+	case PhaseSink:
+		return "sink"
+	default:
+		return fmt.Sprintf("SyncPhase(%d)", int(p))
+	}
+}
+
+// SyncError describes any failure of a sync, as passed to Runner.OnError.
+type SyncError struct {
+	Phase SyncPhase
+	// Sink is the sink failed to write to in PhaseSink, or nil otherwise.
+	Sink Sink
+	Err  error
+	// Tries is how many times fetching has been tried and failed in a row in
+	// PhaseFetch and PhaseValidate, or zero in PhaseSink.
+	Tries int
+}
+
+func (e *SyncError) Error() string {
+	if e.Sink != nil {
+		return fmt.Sprintf("%v error writing to %v: %v", e.Phase, e.Sink, e.Err)
+	}
+	return fmt.Sprintf("%v error after %d tries: %v", e.Phase, e.Tries, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *SyncError) Unwrap() error {
+	return e.Err
+}
+
+// validationError is returned internally when Validate rejects the data, to
+// tell PhaseValidate from PhaseFetch.
+type validationError struct {
+	err error
+}
+
+func (e *validationError) Error() string {
+	return e.err.Error()
+}
+
+// ContentTooOldError is reported when the data is older than
+// Runner.MaxContentAge by its modification time.
+type ContentTooOldError struct {
+	// ModTime is the modification time of the data as told by the source.
+	ModTime time.Time
+	// Age is how old the data was when checked.
+	Age    time.Duration
+	MaxAge time.Duration
+}
+
+func (e *ContentTooOldError) Error() string {
+	return fmt.Sprintf("data last modified at %v is %v old, more than %v", e.ModTime.Format(time.RFC3339), e.Age, e.MaxAge)
+}
+
+// SinkStatus describes the health of a sink.
+type SinkStatus struct {
+	// LastWrite is when the data was last written to the sink successfully,
+	// or zero if never.
+	LastWrite time.Time
+	// LastError is the error of the most recent write to the sink, or nil if
+	// it succeeded.
+	LastError error
+	// ConsecutiveFailures is how many times in a row writing to the sink has
+	// failed, across syncs.
+	ConsecutiveFailures int
+}
+
+// SinkFailure describes a failure writing to a sink, as passed to
+// Runner.OnSinkFailure.
+type SinkFailure struct {
+	Sink Sink
+	Err  error
+	// Attempt is how many times in a row writing to the sink has failed,
+	// counting this one, across syncs.
+	Attempt int
+	// WillRetry tells if the runner will fetch the data again on the next
+	// tick to write it to the sinks, even if unmodified, as the sync failed as
+	// a whole because the sink is required or all of the sinks failed.
+	// Otherwise, the sink is only written to again once the data changes.
+	WillRetry bool
+}
+
 // Source represents somewhere any data can be fetched from
 type Source interface {
 	// Fetch fetches the data from the source if modified since the designated time.
 	Fetch(ifNewerThan time.Time) (io.ReadCloser, error)
 }
 
+// SourceFunc adapts a plain function to a Source, e.g.
+// New(SourceFunc(fetch), ToFile(path)), the same way as http.HandlerFunc.
+type SourceFunc func(ifNewerThan time.Time) (io.ReadCloser, error)
+
+// Fetch calls f(ifNewerThan).
+func (f SourceFunc) Fetch(ifNewerThan time.Time) (io.ReadCloser, error) {
+	return f(ifNewerThan)
+}
+
+// DescribedSource is optionally implemented by a Source to tell where the data
+// comes from, e.g. in errors and in Snapshot. All of the built-in sources
+// implement it.
+type DescribedSource interface {
+	Source
+	Describe() string
+}
+
+// NextPollSource is optionally implemented by a Source which knows when it's
+// worth fetching from it again, see Runner.MaxInterval.
+type NextPollSource interface {
+	Source
+	// NextPoll returns the time suggested for the next fetch, or zero if
+	// there's no suggestion.
+	NextPoll() time.Time
+}
+
+// WatchedSource is optionally implemented by a Source which can tell when
+// the data changes, such as one constructed by FromWatched. The loop of a
+// runner or group syncs once a burst of events is over as well as on every
+// tick. Only a source implementing WatchedSource itself is watched, not one
+// wrapped by another.
+type WatchedSource interface {
+	Source
+	// Events returns the channel of events telling that the data may have
+	// changed, and how long to wait for no more events before syncing.
+	Events() (<-chan struct{}, time.Duration)
+}
+
+// ContextSource is optionally implemented by a Source which can abort a
+// fetch, including reading the returned data, when the context is done.
+type ContextSource interface {
+	Source
+	FetchContext(ctx context.Context, ifNewerThan time.Time) (io.ReadCloser, error)
+}
+
 // Sink represents somewhere the data can be written to
 type Sink interface {
+	// UpdateFrom updates the sink with the data read from the reader. The
+	// reader is only valid until UpdateFrom returns. The sink may return
+	// without reading all of the data, e.g. on an error, as the runner reads
+	// the rest of it from the source anyway so that the connection to the
+	// source can be reused.
 	UpdateFrom(io.Reader) error
 	String() string
 }
 
+// WriterSink is optionally implemented by a streaming Sink, see
+// ReusableReaderSink, which merely writes the data to an io.Writer, such as
+// ToWriter. When the data is streamed, it's written straight to the writer
+// as it comes in from the source, rather than through UpdateFrom. Sinks which
+// have to do something once all data is written, e.g. to rename a file into
+// place, can't implement it.
+type WriterSink interface {
+	ReusableReaderSink
+	Writer() io.Writer
+}
+
+// FlushingSink is optionally implemented by a Sink which defers writing the
+// data, such as ToBatched and WithinWindowDeferred, so that it isn't lost when
+// the runner stops. The runner calls Flush once the loop has exited, to write
+// out the data it still holds, or to discard it if it can't be written, e.g.
+// outside of the window. An error is reported the same way as for UpdateFrom.
+// Sinks writing the data right away don't need to implement it.
+type FlushingSink interface {
+	Sink
+	Flush() error
+}
+
+// ContextSink is optionally implemented by a Sink which can abort writing,
+// e.g. an upload over the network, when the context is done. The runner calls
+// UpdateFromContext instead of UpdateFrom for such sinks, with a context which
+// is done when the loop is stopped or the sync is canceled. The metadata of
+// the data is available from the context with MetadataFromContext.
+type ContextSink interface {
+	Sink
+	UpdateFromContext(ctx context.Context, r io.Reader) error
+}
+
+// ReusableReaderSink is an optional interface a Sink can implement to declare
+// how it consumes the reader passed to UpdateFrom.
+type ReusableReaderSink interface {
+	Sink
+	// ReusableReader returns true if the sink only reads the reader
+	// sequentially, never seeks or type-asserts it, and never uses it after
+	// UpdateFrom returns. Such sinks can be fed from a stream shared with other
+	// sinks as the data comes in from the source, while the rest of the sinks
+	// each get their own reader over the data buffered in memory.
+	//
+	// Note that a streaming sink may get a read error midway if reading from
+	// the source fails, in which case it should discard what it's got so far.
+	ReusableReader() bool
+}
+
 // Runner runs the logic to synchronizes data from the source to the sinks
 type Runner struct {
 	// If given, OnSourceError is called if there is any error fetching from
 	// the source. tries is how many times has been tried and failed. It should
-	// return the wait time before trying again, or zero to stop retrying.
+	// return the wait time before trying again, or zero to stop retrying. If
+	// not given, the runner doesn't retry until the next tick.
 	OnSourceError func(err error, tries int) time.Duration
 	// If given, OnSinkError is called if there is any error writing to any of
 	// the sinks. There is no retry logic as sinks are local and considered to
 	// be more reliable than the source.
 	OnSinkError func(sink Sink, err error)
+	// If given, OnSinkFailure is called for every failure writing to a sink
+	// along with OnSinkError, but with the number of the attempt and whether
+	// it will be retried, e.g. to only alert once it won't. It's called once
+	// the data is written to all of the sinks, after OnSinkError and OnError.
+	OnSinkFailure func(f SinkFailure)
+	// If given, OnTick is called after every sync, including those which
+	// found the data unmodified or failed, with how long fetching and writing
+	// the data took, e.g. to choose the interval or spot slow sinks. The
+	// durations add up over any retries, but exclude the waits in between.
+	OnTick func(stats TickStats)
+	// If given, OnError is called with any error fetching, validating or
+	// writing the data, as a single funnel for logging or alerting. It's
+	// called after OnSourceError or OnSinkError, if either is given too.
+	OnError func(err *SyncError)
 
+	// If given, OnChange is called with the previously and the newly synced
+	// data after a sync writes data different from the last. It makes the
+	// runner buffer the data in memory and retain it until the next sync. old
+	// is nil on the first sync, or if the previous data wasn't retained due to
+	// MaxRetainedSize.
+	OnChange func(old, new []byte)
+	// MaxRetainedSize caps the size of the data retained for OnChange and
+	// RetainLast, to bound memory usage. Zero means no limit.
+	MaxRetainedSize int
+	// RetainLast makes the runner retain the data last synced, as for
+	// OnChange, so that ReplayLast can write it again.
+	RetainLast bool
+
+	// If given, Validate is called to validate the data before sending it to
+	// the sinks. As it needs the whole data, setting it makes the runner
+	// buffer the data in memory even for sinks which could stream it.
 	Validate func(data []byte) error
 
+	// If given, OnProgress is called with the number of bytes read from the
+	// source so far while a sync is in progress, every megabyte or every
+	// second, whichever comes first, and once more when all data is read. It
+	// can drive a progress bar or detect a stalled download.
+	OnProgress func(bytesSoFar int64)
+
+	// Logf is called to log notable conditions, such as the runner being
+	// started while misconfigured. Defaults to log.Printf.
+	Logf func(format string, args ...interface{})
+
+	// DedupeByContent makes the runner skip writing to the sinks if the data
+	// hashes the same as the data last synced, even if the source reports it
+	// as modified, e.g. for a source wrapped with Unconditional. As the whole
+	// data is needed to tell, it makes the runner buffer the data in memory
+	// even for sinks which could stream it.
+	DedupeByContent bool
+
+	// MinInterval and MaxInterval, if MaxInterval is set, make the loop poll
+	// the source again when it suggests, e.g. when a web source's response is
+	// no longer fresh by its Cache-Control, rather than on every interval.
+	// The suggestion is clamped between the two, and the interval is used if
+	// the source doesn't suggest anything. Only a source implementing
+	// NextPollSource itself can suggest, not one wrapped by another.
+	MinInterval time.Duration
+	MaxInterval time.Duration
+
+	// DryRun makes the runner fetch and validate the data and call the
+	// callbacks as usual, but skip writing to the sinks, e.g. to try out a new
+	// source safely. Note that as the runner considers the data synced, it
+	// won't be written to the sinks once DryRun is turned off until the source
+	// changes.
+	DryRun bool
+
+	// MaxContentAge, if set, makes the runner check after every sync which
+	// fetched the data or found it unmodified that the data is no older than
+	// this by its modification time as told by the source, e.g. the
+	// Last-Modified of a web source. That tells an origin which stopped
+	// updating from the runner failing to fetch. A *ContentTooOldError is
+	// reported after every such sync while the data is too old. Data the
+	// source doesn't tell the modification time of is never too old.
+	MaxContentAge time.Duration
+	// If given, OnContentTooOld is called along with reporting a
+	// *ContentTooOldError, see MaxContentAge.
+	OnContentTooOld func(err *ContentTooOldError)
+
+	// Clock is the source of time of the runner, e.g. for the ticks of the
+	// loop and the waits between retries. Defaults to the real clock.
+	Clock Clock
+
 	source      Source
 	sinks       []Sink
 	lastUpdated time.Time
+	gate        *FetchGate
+
+	mx                  sync.RWMutex
+	consecutiveFailures int
+	syncCount           int64
+	unmodifiedCount     int64
+	staleSince          time.Time
+	contentModTime      time.Time
+	lastHash            []byte
+	lastData            []byte
+	lastMetadata        Metadata
+	sinkStatus          map[string]SinkStatus
+	lastError           error
+	interval            time.Duration
+	cancelCurrent       context.CancelFunc
+	done                chan struct{}
+	offline             bool
+
+	// deliverMx serializes writing to the sinks between syncs and replays
+	deliverMx sync.Mutex
 }
 
 // New construct a runner which synchronizes data from one source to one or more sinks
 func New(from Source, to ...Sink) *Runner {
-	return NewWithValidator(func(data []byte) error { return nil }, from, to...)
+	return NewWithValidator(nil, from, to...)
 }
 
 // Like New but with a function that validates data before sending it to the sinks
 func NewWithValidator(validate func(data []byte) error, from Source, to ...Sink) *Runner {
 	return &Runner{
-		OnSourceError: func(error, int) time.Duration { return 0 },
-		OnSinkError:   func(Sink, error) {},
-		Validate:      validate,
-		source:        from,
-		sinks:         to,
-		lastUpdated:   time.Time{},
+		Validate:    validate,
+		source:      from,
+		sinks:       to,
+		lastUpdated: time.Time{},
 	}
 }
 
+// WithGate makes the runner pass the gate before fetching from the source, to
+// limit the concurrent fetches across all of the runners sharing the gate. The
+// gate is held until the data is fully read from the source and written to
+// the sinks.
+func (runner *Runner) WithGate(gate *FetchGate) *Runner {
+	runner.gate = gate
+	return runner
+}
+
 // InitFrom synchronizes data from the given source to configured sinks.
 func (runner *Runner) InitFrom(s Source) {
 	if len(runner.sinks) == 0 {
 		return
 	}
-	runner.syncOnce(s, nil)
+	runner.syncOnce(s, &loop{ctx: context.Background()})
 }
 
 // Start starts the loop to actually synchronizes data with given interval. It
-// returns a function to stop the loop.
+// returns a function to stop the loop. If the runner is misconfigured, it logs
+// the problem via Logf and doesn't start the loop. Use StartE to get the
+// error instead, or StartWithOptions to configure the schedule further.
 func (runner *Runner) Start(interval time.Duration) func() {
-	if len(runner.sinks) == 0 {
+	return runner.StartWithOptions(WithInterval(interval))
+}
+
+// StartContext is the same as Start but also stops the loop when ctx is done.
+// The context of the sync in progress, which is passed to any ContextSource
+// and ContextSink, is derived from ctx, so canceling it aborts the sync too.
+func (runner *Runner) StartContext(ctx context.Context, interval time.Duration) func() {
+	sched := schedule{interval: interval, immediate: true}
+	if err := runner.checkStart(sched); err != nil {
+		runner.logf("keepcurrent: not starting runner: %v", err)
 		return func() {}
 	}
-	tk := time.NewTicker(interval)
-	chStop := make(chan struct{})
+	return runner.start(ctx, sched, nil, nil)
+}
+
+// StartE is the same as Start but returns ErrNoSinks or ErrNoSource if the
+// runner has no sinks or no source respectively, or ErrInvalidInterval if the
+// interval is not positive, rather than silently doing nothing.
+func (runner *Runner) StartE(interval time.Duration) (func(), error) {
+	sched := schedule{interval: interval, immediate: true}
+	if err := runner.checkStart(sched); err != nil {
+		return nil, err
+	}
+	return runner.start(context.Background(), sched, nil, nil), nil
+}
+
+// checkStart returns the error which keeps the loop from starting with the
+// schedule, if any.
+func (runner *Runner) checkStart(sched schedule) error {
+	if err := runner.checkConfig(); err != nil {
+		return err
+	}
+	if sched.interval <= 0 {
+		return ErrInvalidInterval
+	}
+	return nil
+}
+
+func (runner *Runner) checkConfig() error {
+	if len(runner.sinks) == 0 {
+		return ErrNoSinks
+	}
+	if runner.source == nil {
+		return ErrNoSource
+	}
+	return nil
+}
+
+func (runner *Runner) logf(format string, args ...interface{}) {
+	if runner.Logf != nil {
+		runner.Logf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// StartWithErrors is the same as Start but also sends any error fetching from
+// the source or writing to the sinks to the returned channel, as a
+// *SourceError or a *SinkError respectively, in addition to calling the
+// callbacks. The channel is closed when the loop stops. The loop waits for
+// each error to be received, so the channel must be drained.
+func (runner *Runner) StartWithErrors(interval time.Duration) (func(), <-chan error) {
+	errs := make(chan error, 10)
+	sched := schedule{interval: interval, immediate: true}
+	if err := runner.checkStart(sched); err != nil {
+		runner.logf("keepcurrent: not starting runner: %v", err)
+		close(errs)
+		return func() {}, errs
+	}
+	return runner.start(context.Background(), sched, errs, nil), errs
+}
+
+// StopReason tells why a loop started by StartWithLimit has stopped.
+type StopReason int
+
+const (
+	// StoppedByCaller means the function returned to stop the loop was
+	// called.
+	StoppedByCaller StopReason = iota
+	// StoppedAtMaxSyncs means the loop has synced as many times as allowed.
+	StoppedAtMaxSyncs
+	// StoppedAtMaxDuration means the loop has run for as long as allowed.
+	StoppedAtMaxDuration
+)
+
+func (r StopReason) String() string {
+	switch r {
+	case StoppedByCaller:
+		return "stopped by caller"
+	case StoppedAtMaxSyncs:
+		return "stopped at max syncs"
+	case StoppedAtMaxDuration:
+		return "stopped at max duration"
+	default:
+		return fmt.Sprintf("StopReason(%d)", int(r))
+	}
+}
+
+// StartWithLimit is the same as Start but the loop also stops by itself once
+// it has synced the data maxSyncs times, not counting the syncs which found
+// the data unmodified, or once it has run for maxDuration, whichever comes
+// first, e.g. for a batch job which just needs to keep trying for a while.
+// Zero means no limit. The returned channel receives why the loop has
+// stopped once it has, and is then closed.
+func (runner *Runner) StartWithLimit(interval time.Duration, maxSyncs int, maxDuration time.Duration) (func(), <-chan StopReason) {
+	reasons := make(chan StopReason, 1)
+	sched := schedule{interval: interval, immediate: true}
+	if err := runner.checkStart(sched); err != nil {
+		runner.logf("keepcurrent: not starting runner: %v", err)
+		close(reasons)
+		return func() {}, reasons
+	}
+	var reason int32
+	base := runner.SyncCount()
+	until := func() bool {
+		if maxSyncs > 0 && runner.SyncCount()-base >= int64(maxSyncs) {
+			atomic.CompareAndSwapInt32(&reason, int32(StoppedByCaller), int32(StoppedAtMaxSyncs))
+			return true
+		}
+		return false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := runner.start(ctx, sched, nil, until)
+	done := runner.Done()
+	go func() {
+		var timeout <-chan time.Time
+		if maxDuration > 0 {
+			timeout = runner.clock().After(maxDuration)
+		}
+		select {
+		case <-timeout:
+			atomic.CompareAndSwapInt32(&reason, int32(StoppedByCaller), int32(StoppedAtMaxDuration))
+			cancel()
+			<-done
+		case <-done:
+			cancel()
+		}
+		reasons <- StopReason(atomic.LoadInt32(&reason))
+		close(reasons)
+	}()
+	return stop, reasons
+}
+
+// start starts the loop. If until is given, the loop stops once it returns
+// true after a sync.
+func (runner *Runner) start(ctx context.Context, sched schedule, errs chan error, until func() bool) func() {
+	interval := sched.interval
 	chStopped := make(chan struct{})
+	runner.mx.Lock()
+	runner.interval = interval
+	runner.done = chStopped
+	runner.mx.Unlock()
+	tk := runner.clock().NewTicker(sched.jittered(interval))
+	ctx, cancel := context.WithCancel(ctx)
+	l := &loop{ctx: ctx, errs: errs}
+	exit := func() {
+		tk.Stop()
+		runner.flush(l)
+		if errs != nil {
+			close(errs)
+		}
+		close(chStopped)
+	}
+	changes := watch(ctx, runner.clock(), runner.source)
 	go func() {
+		if wait := sched.firstWait(); wait > 0 {
+			select {
+			case <-ctx.Done():
+				exit()
+				return
+			case <-runner.clock().After(wait):
+			}
+			tk.Reset(sched.jittered(interval))
+			// Drop any tick while waiting
+			select {
+			case <-tk.C():
+			default:
+			}
+		}
 		for {
-			runner.syncOnce(runner.source, chStop)
+			runner.syncOnce(runner.source, l)
+			if until != nil && until() {
+				cancel()
+			}
+			if runner.MaxInterval > 0 {
+				tk.Reset(sched.jittered(runner.nextInterval(interval)))
+			} else if sched.jitter > 0 {
+				tk.Reset(sched.jittered(interval))
+			}
 			select {
-			case <-chStop:
-				tk.Stop()
-				close(chStopped)
+			case <-ctx.Done():
+				exit()
 				return
-			case <-tk.C:
+			case <-tk.C():
+			case <-changes:
 			}
 		}
 	}()
-	return func() { close(chStop); <-chStopped }
+	return func() { cancel(); <-chStopped }
 }
 
-func (runner *Runner) syncOnce(from Source, chStop chan struct{}) {
-	var data []byte
+// flush flushes the sinks implementing FlushingSink once the loop has exited.
+func (runner *Runner) flush(l *loop) {
+	runner.deliverMx.Lock()
+	defer runner.deliverMx.Unlock()
+	for _, s := range runner.sinks {
+		fs, ok := unwrapRequired(s).(FlushingSink)
+		if !ok {
+			continue
+		}
+		if err := fs.Flush(); err != nil {
+			runner.sinkDone(l, s, err)
+			runner.sinkFailed(SinkFailure{Sink: s, Err: err})
+		}
+	}
+}
+
+// Done returns a channel which is closed once the loop started last has
+// exited, including its ticker being stopped and the errors channel of
+// StartWithErrors closed, e.g. when the context given to StartContext is
+// done. The function returned by Start already waits for the loop to exit.
+// If the loop was never started, the channel is closed already.
+func (runner *Runner) Done() <-chan struct{} {
+	runner.mx.RLock()
+	defer runner.mx.RUnlock()
+	if runner.done == nil {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	return runner.done
+}
+
+// nextInterval returns how long to wait for the next poll, as suggested by
+// the source if it does, clamped between MinInterval and MaxInterval.
+func (runner *Runner) nextInterval(interval time.Duration) time.Duration {
+	ns, ok := runner.source.(NextPollSource)
+	if !ok {
+		return interval
+	}
+	next := ns.NextPoll()
+	if next.IsZero() {
+		return interval
+	}
+	d := next.Sub(runner.clock().Now())
+	if d < runner.MinInterval {
+		d = runner.MinInterval
+	}
+	if d > runner.MaxInterval {
+		d = runner.MaxInterval
+	}
+	if d <= 0 {
+		// Tickers don't take a non-positive interval
+		d = interval
+	}
+	return d
+}
+
+func (runner *Runner) clock() Clock {
+	if runner.Clock == nil {
+		return realClock{}
+	}
+	return runner.Clock
+}
+
+// SyncResult tells what happened in a sync run by Sync.
+type SyncResult struct {
+	// Changed is true if the data was fetched from the source and synced,
+	// i.e. written to at least one sink, and all required ones.
+	Changed bool
+	// Unmodified is true if the source reported the data as unmodified.
+	Unmodified bool
+	// Bytes is how much data was read from the source.
+	Bytes int64
+	// Err is the error fetching from the source, as a *SourceError, after
+	// any retries by OnSourceError, or ErrNoSinks or ErrNoSource if the
+	// runner is misconfigured.
+	Err error
+	// SinkErrs are the errors writing to the sinks, keyed by their String.
+	SinkErrs map[string]error
+	// Duration is how long the sync took, including any retries.
+	Duration time.Duration
+}
+
+// Sync syncs the data from the source to the sinks once, retrying as told by
+// OnSourceError, and tells what happened, for callers driving the syncs by
+// themselves rather than with Start. The callbacks are called and the state
+// of the runner is updated as for a sync by the loop, except that the errors
+// are not sent to the channel of StartWithErrors.
+func (runner *Runner) Sync() SyncResult {
+	start := runner.clock().Now()
+	result := SyncResult{}
+	if err := runner.checkConfig(); err != nil {
+		result.Err = err
+		return result
+	}
+	runner.syncOnce(runner.source, &loop{ctx: context.Background(), result: &result})
+	result.Duration = runner.clock().Now().Sub(start)
+	return result
+}
+
+// byteCounter counts the bytes written to it.
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// loop carries what's specific to one run of the loop started by Start. The
+// loop stops when ctx is done.
+type loop struct {
+	ctx  context.Context
+	errs chan<- error
+	// result, if not nil, collects the outcome of a sync for Sync
+	result *SyncResult
+	// stats, if not nil, collects the timing of a sync for OnTick
+	stats *TickStats
+}
+
+// report sends the error to the errors channel if there's one.
+func (l *loop) report(err error) {
+	if l.errs == nil {
+		return
+	}
+	select {
+	case l.errs <- err:
+	case <-l.ctx.Done():
+	}
+}
+
+func (runner *Runner) syncOnce(from Source, l *loop) {
+	if runner.OnTick != nil {
+		// The loop may be shared by the runners of a group, so collect the
+		// outcome of this sync in a copy
+		tl := *l
+		tl.stats = &TickStats{}
+		if tl.result == nil {
+			tl.result = &SyncResult{}
+		}
+		l = &tl
+		defer func() {
+			l.stats.Bytes, l.stats.Unmodified = l.result.Bytes, l.result.Unmodified
+			runner.OnTick(*l.stats)
+		}()
+	}
 	for tries := 1; ; tries++ {
-		start := time.Now()
-		rc, err := from.Fetch(runner.lastUpdated)
-		if err == ErrUnmodified {
+		start := runner.clock().Now()
+		if l.result != nil {
+			l.result.Err, l.result.Bytes = nil, 0
+		}
+		err := runner.fetchAndDeliver(from, l)
+		if err == errStopped || err == errCanceled {
 			return
 		}
-		if err == nil {
-			// Read ahead to surface any error reading from the source
-			data, err = ioutil.ReadAll(rc)
-			rc.Close()
+		if err == errRequiredSinkFailed || err == errAllSinksFailed {
+			// The source is fine, it's the sinks which are reported
+			runner.mx.Lock()
+			runner.consecutiveFailures = 0
+			runner.mx.Unlock()
+			return
 		}
-		if err == nil {
-			err = runner.Validate(data)
+		if err == ErrOffline {
+			// Unlike ErrUnmodified, this doesn't tell if the data is current
+			if l.result != nil {
+				l.result.Unmodified = true
+			}
+			return
+		}
+		if err == ErrUnmodified {
+			runner.mx.Lock()
+			runner.consecutiveFailures = 0
+			runner.unmodifiedCount++
+			// The source confirmed that the data is current
+			runner.staleSince = time.Time{}
+			runner.mx.Unlock()
+			if l.result != nil {
+				l.result.Unmodified = true
+			}
+			runner.checkContentAge(l)
+			return
 		}
 		if err == nil {
+			runner.mx.Lock()
 			runner.lastUpdated = start
-			break
+			runner.consecutiveFailures = 0
+			runner.syncCount++
+			runner.mx.Unlock()
+			if l.result != nil {
+				l.result.Changed = true
+			}
+			runner.checkContentAge(l)
+			return
+		}
+		phase := PhaseFetch
+		if ve, ok := err.(*validationError); ok {
+			phase, err = PhaseValidate, ve.err
+		}
+		srcErr := &SourceError{Source: from, Err: err, Tries: tries}
+		if l.result != nil {
+			l.result.Err = srcErr
 		}
-		d := runner.OnSourceError(err, tries)
+		runner.sourceFailed(srcErr)
+		var d time.Duration
+		if runner.OnSourceError != nil {
+			d = runner.OnSourceError(err, tries)
+		}
+		if runner.OnError != nil {
+			runner.OnError(&SyncError{Phase: phase, Err: err, Tries: tries})
+		}
+		l.report(srcErr)
 		if d == 0 {
 			return
 		}
 		select {
-		case <-chStop:
+		case <-l.ctx.Done():
 			return
-		case <-time.After(d):
+		case <-runner.clock().After(d):
+		}
+	}
+}
+
+// fetchAndDeliver fetches from the source and delivers the data to the sinks
+// once it passes the gate, if any.
+func (runner *Runner) fetchAndDeliver(from Source, l *loop) error {
+	if runner.gate != nil {
+		if !runner.gate.acquire(l.ctx.Done()) {
+			return errStopped
+		}
+		defer runner.gate.release()
+	}
+	ctx, cancel := context.WithCancel(l.ctx)
+	defer cancel()
+	runner.mx.Lock()
+	runner.cancelCurrent = cancel
+	runner.mx.Unlock()
+	defer func() {
+		runner.mx.Lock()
+		runner.cancelCurrent = nil
+		runner.mx.Unlock()
+	}()
+	err := runner.fetchAndDeliverContext(ctx, from, l)
+	if err != nil && l.ctx.Err() != nil {
+		return errStopped
+	}
+	if err != nil && ctx.Err() != nil {
+		return errCanceled
+	}
+	return err
+}
+
+func (runner *Runner) fetchAndDeliverContext(ctx context.Context, from Source, l *loop) error {
+	if ofs, ok := from.(OfflineSource); ok && runner.isOffline() {
+		start := runner.tickStart(l)
+		rc, err := ofs.FetchOffline(runner.lastUpdated)
+		runner.tickFetched(l, start)
+		if err != nil {
+			return err
+		}
+		return runner.deliverFetched(ctx, from, rc, l)
+	}
+	if ps, ok := from.(PatchingSource); ok && runner.canPatch() {
+		switch err := runner.patch(ctx, ps, l); err {
+		case ErrNoPatch:
+		case errPatchFailed:
+			// The sinks may be patched only partly, so rewrite all of them
+			return runner.fetchAndDeliverSince(ctx, from, time.Time{}, l)
+		default:
+			return err
 		}
 	}
+	return runner.fetchAndDeliverSince(ctx, from, runner.lastUpdated, l)
+}
+
+// fetchAndDeliverSince fetches the data from the source if modified since
+// ifNewerThan and delivers it to the sinks.
+func (runner *Runner) fetchAndDeliverSince(ctx context.Context, from Source, ifNewerThan time.Time, l *loop) error {
+	var rc io.ReadCloser
+	var err error
+	start := runner.tickStart(l)
+	if fs, ok := unwrapWatched(from).(*fileSource); ok {
+		rc, err = fs.fetchUnlessWritten(ifNewerThan, runner.wroteFile)
+	} else if cs, ok := from.(ContextSource); ok {
+		rc, err = cs.FetchContext(ctx, ifNewerThan)
+	} else {
+		rc, err = from.Fetch(ifNewerThan)
+	}
+	runner.tickFetched(l, start)
+	if err != nil {
+		return err
+	}
+	return runner.deliverFetched(ctx, from, rc, l)
+}
+
+// wroteFile tells if the file at the path was last written by one of the
+// runner's own file sinks, so that reading from and writing to the same file
+// doesn't sync again on every interval, while writes by anyone else do.
+func (runner *Runner) wroteFile(path string, modTime time.Time) bool {
 	for _, s := range runner.sinks {
-		if err := s.UpdateFrom(bytes.NewReader(data)); err != nil {
-			runner.OnSinkError(s, err)
+		if fs, ok := unwrapRequired(s).(*fileSink); ok && fs.wrote(path, modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// deliverFetched delivers the data fetched from the source to the sinks. If
+// that fails, the source is reset if it's a ResettableSource, so that the
+// data is not found unmodified when fetched again.
+func (runner *Runner) deliverFetched(ctx context.Context, from Source, rc io.ReadCloser, l *loop) error {
+	runner.deliverMx.Lock()
+	defer runner.deliverMx.Unlock()
+	defer runner.tickDelivered(l, runner.tickStart(l))
+	err := runner.deliver(ctx, &contextReader{rc, ctx}, l)
+	if rs, ok := from.(ResettableSource); ok && err != nil {
+		rs.ResetConditions()
+	}
+	return err
+}
+
+// CancelCurrent aborts the sync in progress, if any, without stopping the
+// loop, e.g. when the data being downloaded is known to be obsolete. The
+// sync is not retried and the loop carries on with the next tick. A source
+// implementing ContextSource has the fetch itself aborted, otherwise the
+// fetch runs to completion but reading the data fails. As with any failure
+// reading from the source, streaming sinks may get a read error midway.
+func (runner *Runner) CancelCurrent() {
+	runner.mx.RLock()
+	cancel := runner.cancelCurrent
+	runner.mx.RUnlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// contextReader fails reading once the context is done.
+type contextReader struct {
+	io.ReadCloser
+	ctx context.Context
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.ReadCloser.Read(p)
+}
+
+// Metadata implements MetadataReader
+func (r *contextReader) Metadata() Metadata {
+	return metadataOf(r.ReadCloser)
+}
+
+// sinkDone records the outcome of writing to the sink and reports the error,
+// if any. It returns true if a required sink has failed.
+func (runner *Runner) sinkDone(l *loop, s Sink, err error) bool {
+	runner.mx.Lock()
+	if runner.sinkStatus == nil {
+		runner.sinkStatus = make(map[string]SinkStatus)
+	}
+	status := runner.sinkStatus[s.String()]
+	status.LastError = err
+	if err == nil {
+		status.LastWrite = runner.clock().Now()
+		status.ConsecutiveFailures = 0
+	} else {
+		status.ConsecutiveFailures++
+	}
+	runner.sinkStatus[s.String()] = status
+	sinkErr := &SinkError{Sink: s, Err: err, Required: isRequired(s)}
+	if err != nil {
+		runner.lastError = sinkErr
+	}
+	runner.mx.Unlock()
+	if err != nil && l.result != nil {
+		if l.result.SinkErrs == nil {
+			l.result.SinkErrs = make(map[string]error)
+		}
+		l.result.SinkErrs[s.String()] = err
+	}
+	if err == nil {
+		return false
+	}
+	if runner.OnSinkError != nil {
+		runner.OnSinkError(s, err)
+	}
+	if runner.OnError != nil {
+		runner.OnError(&SyncError{Phase: PhaseSink, Sink: s, Err: err})
+	}
+	l.report(sinkErr)
+	return isRequired(s)
+}
+
+// sinkFailed calls OnSinkFailure with the failure and the attempt recorded by
+// sinkDone.
+func (runner *Runner) sinkFailed(f SinkFailure) {
+	if runner.OnSinkFailure == nil {
+		return
+	}
+	runner.mx.RLock()
+	f.Attempt = runner.sinkStatus[f.Sink.String()].ConsecutiveFailures
+	runner.mx.RUnlock()
+	runner.OnSinkFailure(f)
+}
+
+// deliver reads the data from the source and writes it to the sinks. It
+// returns the error reading or validating the data, while the errors writing
+// to the sinks are reported separately, except that errRequiredSinkFailed is
+// returned if any required sink has failed, and errAllSinksFailed if all of
+// them have.
+func (runner *Runner) deliver(ctx context.Context, rc io.ReadCloser, l *loop) error {
+	// The data is read in full below whatever the sinks do with it, but drain
+	// what's left in case reading fails midway, e.g. in a wrapping source.
+	defer drainAndClose(rc)
+	sinks := runner.sinks
+	if runner.DryRun {
+		sinks = nil
+	}
+	var streaming, buffered []Sink
+	for _, s := range sinks {
+		if rs, ok := s.(ReusableReaderSink); ok && rs.ReusableReader() && runner.Validate == nil && !runner.DedupeByContent {
+			streaming = append(streaming, s)
+		} else {
+			buffered = append(buffered, s)
 		}
 	}
+	md := metadataOf(rc)
+	var src io.Reader = rc
+	if md.ContentType == "" && md.ContentEncoding == "" {
+		br := bufio.NewReaderSize(rc, sniffLen)
+		sniffed, err := br.Peek(sniffLen)
+		if err != nil && err != io.EOF {
+			// The reader doesn't necessarily fail again on the next read
+			return err
+		}
+		md.ContentType = http.DetectContentType(sniffed)
+		src = br
+	}
+	hasher := sha256.New()
+	r := io.TeeReader(src, hasher)
+	if l.result != nil {
+		r = io.TeeReader(r, (*byteCounter)(&l.result.Bytes))
+	}
+	if runner.OnProgress != nil {
+		r = newProgressReader(r, runner.clock(), runner.OnProgress)
+	}
+	var data []byte
+	var err error
+	requiredFailed := false
+	failed := 0
+	var failures []SinkFailure
+	if len(streaming) > 0 {
+		var sinkErrs []error
+		data, sinkErrs, err = stream(ctx, r, md, streaming, len(buffered) > 0 || runner.OnChange != nil || runner.RetainLast)
+		if err != nil {
+			return err
+		}
+		for i, s := range streaming {
+			if sinkErrs[i] != nil {
+				failures = append(failures, SinkFailure{Sink: s, Err: sinkErrs[i]})
+				if !isDeferral(s, sinkErrs[i]) {
+					failed++
+				}
+			}
+			if runner.sinkDone(l, s, sinkErrs[i]) && !isDeferral(s, sinkErrs[i]) {
+				requiredFailed = true
+			}
+		}
+	} else {
+		// Read ahead to surface any error reading from the source
+		data, err = ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if runner.Validate != nil {
+			if err := runner.Validate(data); err != nil {
+				return &validationError{err}
+			}
+		}
+		if runner.DedupeByContent && bytes.Equal(hasher.Sum(nil), runner.LastHash()) {
+			// Nothing to write, but the data is as current as it can be
+			runner.setSynced(md)
+			return nil
+		}
+	}
+	for _, s := range buffered {
+		err := updateSink(ctx, s, bytes.NewReader(data), md)
+		if err != nil {
+			failures = append(failures, SinkFailure{Sink: s, Err: err})
+			if !isDeferral(s, err) {
+				failed++
+			}
+		}
+		if runner.sinkDone(l, s, err) && !isDeferral(s, err) {
+			requiredFailed = true
+		}
+	}
+	willRetry := requiredFailed || failed > 0 && failed == len(sinks)
+	for _, f := range failures {
+		f.WillRetry = willRetry
+		runner.sinkFailed(f)
+	}
+	if requiredFailed {
+		return errRequiredSinkFailed
+	}
+	if failed > 0 && failed == len(sinks) {
+		// Nothing was synced, so fetch the data again on the next tick
+		return errAllSinksFailed
+	}
+	runner.mx.Lock()
+	runner.lastHash = hasher.Sum(nil)
+	runner.mx.Unlock()
+	runner.setSynced(md)
+	if runner.OnChange != nil || runner.RetainLast {
+		old := runner.retain(data, md)
+		if runner.OnChange != nil && (old == nil || !bytes.Equal(old, data)) {
+			runner.OnChange(old, data)
+		}
+	}
+	return nil
+}
+
+// setSynced records the state of the data synced by its metadata.
+func (runner *Runner) setSynced(md Metadata) {
+	runner.mx.Lock()
+	if !md.ModTime.IsZero() {
+		runner.contentModTime = md.ModTime
+	}
+	if !md.Stale {
+		runner.staleSince = time.Time{}
+	} else if runner.staleSince.IsZero() {
+		runner.staleSince = runner.clock().Now()
+	}
+	runner.mx.Unlock()
+}
+
+// checkContentAge reports if the data is older than MaxContentAge.
+func (runner *Runner) checkContentAge(l *loop) {
+	if runner.MaxContentAge <= 0 {
+		return
+	}
+	modTime := runner.ContentModTime()
+	if modTime.IsZero() {
+		return
+	}
+	age := runner.clock().Now().Sub(modTime)
+	if age <= runner.MaxContentAge {
+		return
+	}
+	err := &ContentTooOldError{ModTime: modTime, Age: age, MaxAge: runner.MaxContentAge}
+	if runner.OnContentTooOld != nil {
+		runner.OnContentTooOld(err)
+	}
+	l.report(err)
+}
+
+// ContentModTime returns the modification time of the data last synced as
+// told by the source, or zero if it never told. It's safe to call
+// concurrently with the loop.
+func (runner *Runner) ContentModTime() time.Time {
+	runner.mx.RLock()
+	defer runner.mx.RUnlock()
+	return runner.contentModTime
 }
 
-// ExpBackoff returns an OnSourceError handler which does exponential backoff
-// starting with base, doubles for every retry, and stops retrying after 'stop'
-// attempts.
-func ExpBackoff(base time.Duration, stop int) func(err error, tries int) time.Duration {
-	return ExpBackoffThenFail(base, stop, func(err error) {})
+// StaleSince returns when the runner started syncing stale data, i.e. data
+// served in place of that at the source as the source is unavailable, such as
+// the fallback of WithCache, or zero if the data last synced is not stale.
+// It's reset once the data comes from the source again, or the source reports
+// it's unmodified. Unlike an outage without a fallback, running on stale data
+// doesn't count as failing, so this is the way to alert on it. It's safe to
+// call concurrently with the loop.
+func (runner *Runner) StaleSince() time.Time {
+	runner.mx.RLock()
+	defer runner.mx.RUnlock()
+	return runner.staleSince
 }
 
-// ExpBackoffThenFail does the same as ExpBackoff but also calls the onFail
-// callback when it stops retrying.
-func ExpBackoffThenFail(base time.Duration, stop int, onFail func(err error)) func(err error, tries int) time.Duration {
-	return func(err error, tries int) time.Duration {
-		if tries >= stop {
-			onFail(err)
-			return 0
+// retain retains the data unless it's larger than MaxRetainedSize, and
+// returns the data retained before.
+func (runner *Runner) retain(data []byte, md Metadata) []byte {
+	runner.mx.Lock()
+	defer runner.mx.Unlock()
+	old := runner.lastData
+	runner.lastData, runner.lastMetadata = nil, Metadata{}
+	if runner.MaxRetainedSize == 0 || len(data) <= runner.MaxRetainedSize {
+		runner.lastData, runner.lastMetadata = data, md
+	}
+	return old
+}
+
+// ReplayLast writes the data last synced again to the given sinks, or to all
+// of the sinks of the runner if none is given, without fetching from the
+// source, e.g. to populate a sink which has recovered from a failure. The
+// data is only retained with RetainLast or OnChange, otherwise
+// ErrNoRetainedData is returned. The outcome of each sink is recorded and
+// reported to OnSinkError as for a sync, and the first error is returned as
+// a *SinkError. It waits for any sync writing to the sinks to finish, so it
+// never overwrites newer data, and so it must not be called from the
+// callbacks of the runner.
+func (runner *Runner) ReplayLast(sinks ...Sink) error {
+	runner.deliverMx.Lock()
+	defer runner.deliverMx.Unlock()
+	runner.mx.RLock()
+	data, md := runner.lastData, runner.lastMetadata
+	runner.mx.RUnlock()
+	if data == nil {
+		return ErrNoRetainedData
+	}
+	if len(sinks) == 0 {
+		sinks = runner.sinks
+	}
+	l := &loop{ctx: context.Background()}
+	var firstErr error
+	for _, s := range sinks {
+		err := updateSink(l.ctx, s, bytes.NewReader(data), md)
+		runner.sinkDone(l, s, err)
+		if err != nil {
+			runner.sinkFailed(SinkFailure{Sink: s, Err: err})
 		}
-		return base * (1 << (tries - 1))
+		if err != nil && firstErr == nil {
+			firstErr = &SinkError{Sink: s, Err: err, Required: isRequired(s)}
+		}
+	}
+	return firstErr
+}
+
+// ConsecutiveFailures returns how many times in a row fetching from the source
+// has failed. It's reset to zero once the source is fetched successfully or
+// reports it's unmodified. It's safe to call concurrently with the loop.
+func (runner *Runner) ConsecutiveFailures() int {
+	runner.mx.RLock()
+	defer runner.mx.RUnlock()
+	return runner.consecutiveFailures
+}
+
+// SyncCount returns how many times the data has been fetched from the source
+// and delivered to the sinks. Together with UnmodifiedCount, it tells how
+// often polling finds a change, e.g. to tune the interval. It's safe to call
+// concurrently with the loop.
+func (runner *Runner) SyncCount() int64 {
+	runner.mx.RLock()
+	defer runner.mx.RUnlock()
+	return runner.syncCount
+}
+
+// UnmodifiedCount returns how many times the source has reported the data as
+// unmodified, i.e. how many polls were no-ops. It's safe to call concurrently
+// with the loop.
+func (runner *Runner) UnmodifiedCount() int64 {
+	runner.mx.RLock()
+	defer runner.mx.RUnlock()
+	return runner.unmodifiedCount
+}
+
+func (runner *Runner) sourceFailed(err *SourceError) {
+	runner.mx.Lock()
+	runner.consecutiveFailures++
+	runner.lastError = err
+	runner.mx.Unlock()
+}
+
+// LastHash returns the SHA-256 hash of the data most recently synced to the
+// sinks, or nil if nothing has been synced yet.
+func (runner *Runner) LastHash() []byte {
+	runner.mx.RLock()
+	defer runner.mx.RUnlock()
+	return runner.lastHash
+}
+
+// SinkStatus returns the status of each sink written to so far, keyed by the
+// String of the sink. Sinks which describe themselves the same share one
+// entry. It's safe to call concurrently with the loop.
+func (runner *Runner) SinkStatus() map[string]SinkStatus {
+	runner.mx.RLock()
+	defer runner.mx.RUnlock()
+	result := make(map[string]SinkStatus, len(runner.sinkStatus))
+	for name, status := range runner.sinkStatus {
+		result[name] = status
+	}
+	return result
+}
+
+// Snapshot is a point-in-time view of a runner, e.g. for an admin endpoint.
+type Snapshot struct {
+	// Source describes the source, by its Describe or String method if it
+	// has one, or else its type.
+	Source string
+	// Sinks are the String of each sink.
+	Sinks []string
+	// Interval is the interval the loop was started with, or zero if it was
+	// never started.
+	Interval time.Duration
+	// LastSynced is when the data was last fetched and written to the sinks,
+	// or zero if never.
+	LastSynced time.Time
+	// LastError is the most recent error fetching from the source or writing
+	// to a sink, as a *SourceError or a *SinkError, or nil if none. It may
+	// have been resolved since.
+	LastError error
+	// ConsecutiveFailures is the same as Runner.ConsecutiveFailures.
+	ConsecutiveFailures int
+	// StaleSince is the same as Runner.StaleSince.
+	StaleSince time.Time
+}
+
+// Snapshot returns a view of the configuration and the state of the runner.
+// It's safe to call concurrently with the loop.
+func (runner *Runner) Snapshot() Snapshot {
+	sinks := make([]string, 0, len(runner.sinks))
+	for _, s := range runner.sinks {
+		sinks = append(sinks, s.String())
+	}
+	runner.mx.RLock()
+	defer runner.mx.RUnlock()
+	return Snapshot{
+		Source:              describe(runner.source),
+		Sinks:               sinks,
+		Interval:            runner.interval,
+		LastSynced:          runner.lastUpdated,
+		LastError:           runner.lastError,
+		ConsecutiveFailures: runner.consecutiveFailures,
+		StaleSince:          runner.staleSince,
+	}
+}
+
+// describe names the source for humans.
+func describe(s Source) string {
+	switch d := s.(type) {
+	case nil:
+		return "source"
+	case DescribedSource:
+		return d.Describe()
+	case fmt.Stringer:
+		return d.String()
+	default:
+		return fmt.Sprintf("%T", s)
 	}
 }
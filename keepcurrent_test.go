@@ -2,10 +2,17 @@ package keepcurrent
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
 	"sync/atomic"
@@ -39,6 +46,70 @@ func TestReadWriteSameFile(t *testing.T) {
 	assert.Equal(t, b, content)
 }
 
+func TestReadWriteSameFileSyncsOnce(t *testing.T) {
+	name, _ := writeTempFile(t, []byte("abcde"))
+	defer os.Remove(name)
+	recorder := &recordingSink{}
+	runner := New(FromFile(name), ToFile(name), recorder)
+	// File timestamps are coarser than the clock, so make sure the write
+	// looks newer than the fetch regardless.
+	runner.Clock = laggingClock{time.Second}
+	stop := runner.Start(5 * time.Millisecond)
+	time.Sleep(150 * time.Millisecond)
+	stop()
+	assert.Len(t, recorder.received, 1, "writing to the file should not trigger another sync")
+
+	assert.NoError(t, ioutil.WriteFile(name, []byte("fghij"), 0644))
+	stop = runner.Start(5 * time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	stop()
+	if assert.Len(t, recorder.received, 2, "changing the file should trigger a sync") {
+		assert.Equal(t, "fghij", string(recorder.received[1]))
+	}
+}
+
+func TestReadWriteSameWatchedFileSyncsOnce(t *testing.T) {
+	name, _ := writeTempFile(t, []byte("abcde"))
+	defer os.Remove(name)
+	recorder := &recordingSink{}
+	runner := New(FromWatched(FromFile(name), nil, 0), ToFile(name), recorder)
+	runner.Clock = laggingClock{time.Second}
+	assert.True(t, runner.Sync().Changed)
+	assert.True(t, runner.Sync().Unmodified, "writing to the watched file should not trigger another sync")
+	assert.Len(t, recorder.received, 1)
+}
+
+func TestReadFileWrittenByOtherRunner(t *testing.T) {
+	upstream, _ := writeTempFile(t, []byte("v1"))
+	defer os.Remove(upstream)
+	downstream, _ := writeTempFile(t, nil)
+	defer os.Remove(downstream)
+
+	writer := New(&staticSource{data: "v2", lastModified: time.Now()}, ToFile(upstream))
+	reader := New(FromFile(upstream), ToFile(downstream))
+	assert.True(t, reader.Sync().Changed)
+	assert.True(t, writer.Sync().Changed)
+	assert.True(t, reader.Sync().Changed, "another runner writing to the file should trigger a sync")
+	b, _ := ioutil.ReadFile(downstream)
+	assert.Equal(t, "v2", string(b))
+}
+
+type laggingClock struct {
+	lag time.Duration
+}
+
+func (c laggingClock) Now() time.Time {
+	return time.Now().Add(-c.lag)
+}
+
+func (c laggingClock) NewTicker(d time.Duration) Ticker {
+	return realClock{}.NewTicker(d)
+}
+
+func (c laggingClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
 func TestReadWriteWithPreprocessor(t *testing.T) {
 	rot13 := func(r rune) rune {
 		if r >= 'a' && r <= 'z' {
@@ -203,3 +274,879 @@ func TestBackoffOnFail(t *testing.T) {
 	assert.EqualValues(t, 1, atomic.LoadInt32(&updates))
 	assert.EqualValues(t, 1, atomic.LoadInt32(&finalFailures))
 }
+
+func TestConsecutiveFailures(t *testing.T) {
+	ch := make(chan []byte, 10)
+	s := byteSource{lastModified: time.Now(), remainingFailures: 4}
+	runner := New(&s, ToChannel(ch))
+	runner.OnSourceError = ExpBackoff(time.Millisecond, 3)
+	runner.InitFrom(&s)
+	assert.Equal(t, 3, runner.ConsecutiveFailures())
+	runner.InitFrom(&s)
+	assert.Equal(t, 0, runner.ConsecutiveFailures())
+	assert.Len(t, ch, 1)
+}
+
+type recordingSink struct {
+	received [][]byte
+}
+
+func (s *recordingSink) UpdateFrom(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.received = append(s.received, b)
+	return nil
+}
+
+func (s *recordingSink) String() string {
+	return "recording sink"
+}
+
+func TestStreamingAndBufferedSinks(t *testing.T) {
+	ch := make(chan []byte, 10)
+	buffered := &recordingSink{}
+	s := byteSource{lastModified: time.Now(), remainingFailures: 2}
+	runner := New(&s, ToChannel(ch), buffered)
+	runner.OnSourceError = ExpBackoff(time.Millisecond, 3)
+	runner.OnSinkError = func(s Sink, err error) {
+		assert.Fail(t, "source errors should not be reported as sink errors")
+	}
+	runner.InitFrom(&s)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&s.calls))
+	if assert.Len(t, ch, 1) {
+		assert.Equal(t, "abcde", string(<-ch))
+	}
+	assert.Equal(t, [][]byte{[]byte("abcde")}, buffered.received)
+	hash := sha256.Sum256([]byte("abcde"))
+	assert.Equal(t, hash[:], runner.LastHash())
+}
+
+type failingSink struct{}
+
+func (s failingSink) UpdateFrom(r io.Reader) error {
+	return errors.New("failing sink")
+}
+
+func (s failingSink) String() string {
+	return "failing sink"
+}
+
+func TestStartWithErrors(t *testing.T) {
+	s := byteSource{lastModified: time.Now(), remainingFailures: 2}
+	runner := New(&s, failingSink{})
+	runner.OnSourceError = ExpBackoff(time.Millisecond, 3)
+	stop, errs := runner.StartWithErrors(time.Hour)
+	var sourceErr *SourceError
+	var sinkErr *SinkError
+	if assert.True(t, errors.As(<-errs, &sourceErr)) {
+		assert.Equal(t, 1, sourceErr.Tries)
+		assert.Equal(t, io.ErrUnexpectedEOF, sourceErr.Err)
+	}
+	if assert.True(t, errors.As(<-errs, &sinkErr)) {
+		assert.Equal(t, failingSink{}, sinkErr.Sink)
+	}
+	stop()
+	_, open := <-errs
+	assert.False(t, open, "errors channel should be closed after stopping")
+}
+
+type concurrencySource struct {
+	current, max int32
+}
+
+func (s *concurrencySource) Fetch(ifNewerThan time.Time) (io.ReadCloser, error) {
+	n := atomic.AddInt32(&s.current, 1)
+	defer atomic.AddInt32(&s.current, -1)
+	for {
+		max := atomic.LoadInt32(&s.max)
+		if n <= max || atomic.CompareAndSwapInt32(&s.max, max, n) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	return ioutil.NopCloser(strings.NewReader("abcde")), nil
+}
+
+func TestFetchGate(t *testing.T) {
+	s := &concurrencySource{}
+	gate := NewFetchGate(2)
+	var stops []func()
+	for i := 0; i < 10; i++ {
+		runner := New(s, ToChannel(make(chan []byte, 100))).WithGate(gate)
+		stops = append(stops, runner.Start(5*time.Millisecond))
+	}
+	time.Sleep(100 * time.Millisecond)
+	for _, stop := range stops {
+		stop()
+	}
+	assert.EqualValues(t, 2, atomic.LoadInt32(&s.max))
+
+	runner := New(&staticSource{data: "abcde"}, ToChannel(make(chan []byte, 1))).WithGate(NewFetchGate(0))
+	assert.True(t, runner.Sync().Changed, "a gate of size zero should allow one fetch")
+}
+
+func TestOnChange(t *testing.T) {
+	s := &staticSource{data: "v1"}
+	runner := New(s, ToChannel(make(chan []byte, 10)))
+	type change struct{ old, new string }
+	var changes []change
+	runner.OnChange = func(old, new []byte) {
+		changes = append(changes, change{string(old), string(new)})
+	}
+	runner.InitFrom(s)
+	runner.lastUpdated = time.Time{}
+	runner.InitFrom(s)
+	s.data = "v2"
+	runner.lastUpdated = time.Time{}
+	runner.InitFrom(s)
+	assert.Equal(t, []change{{"", "v1"}, {"v1", "v2"}}, changes)
+
+	runner.MaxRetainedSize = 1
+	s.data = "v3"
+	runner.lastUpdated = time.Time{}
+	runner.InitFrom(s)
+	s.data = "v4"
+	runner.lastUpdated = time.Time{}
+	runner.InitFrom(s)
+	assert.Equal(t, change{"", "v4"}, changes[len(changes)-1], "data over MaxRetainedSize should not be retained")
+}
+
+func TestOnProgress(t *testing.T) {
+	data := strings.Repeat("x", 5*progressBytes/2)
+	s := &staticSource{data: data}
+	runner := New(s, ToChannel(make(chan []byte, 1)))
+	var progress []int64
+	runner.OnProgress = func(bytesSoFar int64) {
+		progress = append(progress, bytesSoFar)
+	}
+	runner.InitFrom(s)
+	if assert.True(t, len(progress) >= 3, "should report every megabyte") {
+		for i := 1; i < len(progress); i++ {
+			assert.True(t, progress[i]-progress[i-1] <= 2*progressBytes)
+		}
+		assert.EqualValues(t, len(data), progress[len(progress)-1], "should report the total at the end")
+	}
+}
+
+func TestSinkStatus(t *testing.T) {
+	s := &staticSource{data: "abcde"}
+	good := ToChannel(make(chan []byte, 10))
+	runner := New(s, good, failingSink{})
+	assert.Empty(t, runner.SinkStatus())
+	runner.InitFrom(s)
+	status := runner.SinkStatus()
+	assert.Len(t, status, 2)
+	assert.NoError(t, status[good.String()].LastError)
+	assert.False(t, status[good.String()].LastWrite.IsZero())
+	assert.EqualError(t, status["failing sink"].LastError, "failing sink")
+	assert.True(t, status["failing sink"].LastWrite.IsZero())
+
+	assert.NotEqual(t, good.String(), ToChannel(make(chan []byte)).String())
+	wd, _ := os.Getwd()
+	assert.Equal(t, "file sink to "+wd+string(os.PathSeparator)+"config.json", ToFile("config.json").String())
+}
+
+func TestStartE(t *testing.T) {
+	_, err := New(&staticSource{data: "abcde"}).StartE(time.Hour)
+	assert.Equal(t, ErrNoSinks, err)
+	_, err = New(nil, failingSink{}).StartE(time.Hour)
+	assert.Equal(t, ErrNoSource, err)
+
+	runner := New(nil, failingSink{})
+	var logged string
+	runner.Logf = func(format string, args ...interface{}) {
+		logged = fmt.Sprintf(format, args...)
+	}
+	runner.Start(time.Hour)()
+	assert.Equal(t, "keepcurrent: not starting runner: no source to sync from", logged)
+
+	runner = New(&staticSource{data: "abcde"}, failingSink{})
+	runner.Logf = func(format string, args ...interface{}) {
+		logged = fmt.Sprintf(format, args...)
+	}
+	_, err = runner.StartE(0)
+	assert.Equal(t, ErrInvalidInterval, err)
+	for _, start := range []func(){
+		func() { runner.Start(0)() },
+		func() { runner.StartContext(context.Background(), 0)() },
+		func() { stop, errs := runner.StartWithErrors(0); stop(); <-errs },
+		func() { stop, reasons := runner.StartWithLimit(-time.Second, 1, 0); stop(); <-reasons },
+	} {
+		logged = ""
+		start()
+		assert.Equal(t, "keepcurrent: not starting runner: interval must be positive", logged)
+	}
+
+	ch := make(chan []byte, 1)
+	stop, err := New(&staticSource{data: "abcde"}, ToChannel(ch)).StartE(time.Hour)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "abcde", string(<-ch))
+		stop()
+	}
+}
+
+func TestCancelCurrent(t *testing.T) {
+	var requests int32
+	chStarted := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&requests, 1) > 1 {
+			io.WriteString(w, "fresh")
+			return
+		}
+		io.WriteString(w, "obsolete")
+		w.(http.Flusher).Flush()
+		close(chStarted)
+		<-req.Context().Done()
+	}))
+	defer srv.Close()
+
+	ch := make(chan []byte, 10)
+	runner := New(FromWeb(srv.URL), ToChannel(ch))
+	var sourceErrors int32
+	runner.OnSourceError = func(err error, tries int) time.Duration {
+		atomic.AddInt32(&sourceErrors, 1)
+		return time.Millisecond
+	}
+	stop := runner.Start(50 * time.Millisecond)
+	defer stop()
+	<-chStarted
+	runner.CancelCurrent()
+	select {
+	case b := <-ch:
+		assert.Equal(t, "fresh", string(b), "canceled data should not be delivered")
+	case <-time.After(time.Second):
+		assert.Fail(t, "should sync again on the next tick")
+	}
+	assert.EqualValues(t, 0, atomic.LoadInt32(&sourceErrors), "canceling should not be a source error")
+	assert.EqualValues(t, 2, atomic.LoadInt32(&requests))
+}
+
+func TestRequiredSink(t *testing.T) {
+	s := &staticSource{data: "abcde", lastModified: time.Now()}
+	bestEffort := &recordingSink{}
+	runner := New(s, failingSink{}, bestEffort)
+	runner.InitFrom(s)
+	assert.False(t, runner.lastUpdated.IsZero(), "failing best-effort sink should not hold back the sync")
+	assert.Len(t, bestEffort.received, 1)
+
+	bestEffort = &recordingSink{}
+	runner = New(s, Required(failingSink{}), bestEffort)
+	stop, errs := runner.StartWithErrors(time.Hour)
+	var sinkErr *SinkError
+	if assert.True(t, errors.As(<-errs, &sinkErr)) {
+		assert.True(t, sinkErr.Required)
+		assert.Equal(t, "failing sink", sinkErr.Sink.String())
+	}
+	stop()
+	assert.True(t, runner.lastUpdated.IsZero(), "failing required sink should fail the sync")
+	assert.Len(t, bestEffort.received, 1)
+	assert.Nil(t, runner.LastHash())
+}
+
+type blockingContextSink struct {
+	chStarted chan struct{}
+	err       error
+}
+
+func (s *blockingContextSink) UpdateFrom(r io.Reader) error {
+	return s.UpdateFromContext(context.Background(), r)
+}
+
+func (s *blockingContextSink) UpdateFromContext(ctx context.Context, r io.Reader) error {
+	close(s.chStarted)
+	<-ctx.Done()
+	s.err = ctx.Err()
+	return s.err
+}
+
+func (s *blockingContextSink) String() string {
+	return "blocking context sink"
+}
+
+type metadataContextSink struct {
+	recordingSink
+	md []Metadata
+}
+
+func (s *metadataContextSink) UpdateFromContext(ctx context.Context, r io.Reader) error {
+	s.md = append(s.md, MetadataFromContext(ctx))
+	return s.UpdateFrom(r)
+}
+
+func (s *metadataContextSink) UpdateWithMetadata(r io.Reader, md Metadata) error {
+	s.md = append(s.md, md)
+	return s.UpdateFrom(r)
+}
+
+func TestContextSinkGetsMetadata(t *testing.T) {
+	source := &staticSource{data: "data", lastModified: time.Now()}
+	sink := &metadataContextSink{}
+	New(source, sink).InitFrom(source)
+	if assert.Len(t, sink.md, 1) {
+		assert.Equal(t, "text/plain; charset=utf-8", sink.md[0].ContentType, "should pass the metadata along with the context")
+	}
+	assert.Equal(t, Metadata{}, MetadataFromContext(context.Background()))
+}
+
+func TestStartContext(t *testing.T) {
+	s := &staticSource{data: "abcde"}
+	sink := &blockingContextSink{chStarted: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := New(s, sink).StartContext(ctx, time.Hour)
+	<-sink.chStarted
+	cancel()
+	chStopped := make(chan struct{})
+	go func() {
+		stop()
+		close(chStopped)
+	}()
+	select {
+	case <-chStopped:
+		assert.Equal(t, context.Canceled, sink.err, "sink should see the cancellation")
+	case <-time.After(time.Second):
+		assert.Fail(t, "canceling the context should abort the write and stop the loop")
+	}
+}
+
+func TestDone(t *testing.T) {
+	runner := New(&staticSource{data: "data"}, &recordingSink{})
+	select {
+	case <-runner.Done():
+	default:
+		assert.Fail(t, "Done should be closed if never started")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := runner.StartContext(ctx, time.Hour)
+	defer stop()
+	select {
+	case <-runner.Done():
+		assert.Fail(t, "Done should not be closed while running")
+	default:
+	}
+	cancel()
+	select {
+	case <-runner.Done():
+	case <-time.After(time.Second):
+		assert.Fail(t, "Done should be closed once the context is done")
+	}
+}
+
+func TestNilCallbacks(t *testing.T) {
+	s := &byteSource{lastModified: time.Now(), remainingFailures: 2}
+	runner := New(s, failingSink{})
+	assert.Nil(t, runner.OnSourceError)
+	assert.Nil(t, runner.OnSinkError)
+	runner.InitFrom(s)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&s.calls), "should not retry without OnSourceError")
+	runner.InitFrom(s)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&s.calls))
+
+	runner = &Runner{source: s, sinks: []Sink{failingSink{}}}
+	var sinkErrors int
+	runner.OnSinkError = func(Sink, error) { sinkErrors++ }
+	runner.lastUpdated = time.Time{}
+	runner.InitFrom(s)
+	assert.Equal(t, 1, sinkErrors)
+}
+
+func TestDryRun(t *testing.T) {
+	s := &staticSource{data: "v1"}
+	sink := &recordingSink{}
+	runner := New(s, sink)
+	runner.DryRun = true
+	var changes []string
+	runner.OnChange = func(old, new []byte) {
+		changes = append(changes, string(new))
+	}
+	runner.InitFrom(s)
+	assert.Empty(t, sink.received, "should not write to sinks")
+	assert.Equal(t, []string{"v1"}, changes)
+	assert.NotNil(t, runner.LastHash())
+
+	runner.Validate = func(data []byte) error { return errors.New("invalid") }
+	var sourceErr error
+	runner.OnSourceError = func(err error, tries int) time.Duration {
+		sourceErr = err
+		return 0
+	}
+	runner.lastUpdated = time.Time{}
+	runner.InitFrom(s)
+	assert.EqualError(t, sourceErr, "invalid", "should still validate")
+}
+
+func TestSnapshot(t *testing.T) {
+	s := &byteSource{lastModified: time.Now(), remainingFailures: 2}
+	runner := New(s, failingSink{})
+	snapshot := runner.Snapshot()
+	assert.Equal(t, "*keepcurrent.byteSource", snapshot.Source)
+	assert.Equal(t, []string{"failing sink"}, snapshot.Sinks)
+	assert.Zero(t, snapshot.Interval)
+	assert.True(t, snapshot.LastSynced.IsZero())
+	assert.NoError(t, snapshot.LastError)
+
+	stop, errs := runner.StartWithErrors(time.Hour)
+	<-errs
+	snapshot = runner.Snapshot()
+	assert.Equal(t, time.Hour, snapshot.Interval)
+	assert.Equal(t, 1, snapshot.ConsecutiveFailures)
+	var sourceErr *SourceError
+	assert.True(t, errors.As(snapshot.LastError, &sourceErr))
+	stop()
+	for range errs {
+	}
+
+	runner.InitFrom(s)
+	snapshot = runner.Snapshot()
+	assert.True(t, snapshot.LastSynced.IsZero(), "should not be synced if all sinks failed")
+	assert.Equal(t, 0, snapshot.ConsecutiveFailures)
+	var sinkErr *SinkError
+	assert.True(t, errors.As(snapshot.LastError, &sinkErr))
+}
+
+func TestUnconditionalWithDedupe(t *testing.T) {
+	s := &staticSource{data: "v1", lastModified: time.Now().Add(-time.Hour)}
+	sink := &recordingSink{}
+	runner := New(Unconditional(s), sink)
+	runner.DedupeByContent = true
+	for i := 0; i < 3; i++ {
+		runner.InitFrom(runner.source)
+	}
+	assert.Len(t, sink.received, 1, "same data should be written once")
+	s.data = "v2"
+	runner.InitFrom(runner.source)
+	if assert.Len(t, sink.received, 2) {
+		assert.Equal(t, "v2", string(sink.received[1]))
+	}
+
+	runner.DedupeByContent = false
+	runner.InitFrom(runner.source)
+	assert.Len(t, sink.received, 3, "unconditional source should always be synced without dedupe")
+}
+
+func TestSyncCounts(t *testing.T) {
+	s := &staticSource{data: "data", lastModified: time.Now().Add(-time.Hour)}
+	runner := New(s, &recordingSink{})
+	runner.InitFrom(s)
+	runner.InitFrom(s)
+	runner.InitFrom(s)
+	assert.EqualValues(t, 1, runner.SyncCount())
+	assert.EqualValues(t, 2, runner.UnmodifiedCount())
+}
+
+func TestGroup(t *testing.T) {
+	g := NewGroup().WithGate(NewFetchGate(1))
+	s1 := &staticSource{data: "one", lastModified: time.Now().Add(-time.Hour)}
+	s2 := &staticSource{data: "two", lastModified: time.Now().Add(-time.Hour)}
+	sink1, sink2 := &recordingSink{}, &recordingSink{}
+	r1 := g.Add(s1, sink1)
+	r2 := g.Add(s2, sink2)
+	g.Add(s1, failingSink{})
+	assert.Len(t, g.Runners(), 3)
+
+	stop, errs := g.StartWithErrors(time.Hour)
+	err := <-errs
+	var sinkErr *SinkError
+	assert.True(t, errors.As(err, &sinkErr), "errors of every runner should be aggregated")
+	assert.Eventually(t, func() bool {
+		return r1.SyncCount() == 1 && r2.SyncCount() == 1
+	}, time.Second, 10*time.Millisecond)
+	stop()
+	for range errs {
+	}
+	if assert.Len(t, sink1.received, 1) {
+		assert.Equal(t, "one", string(sink1.received[0]))
+	}
+	if assert.Len(t, sink2.received, 1) {
+		assert.Equal(t, "two", string(sink2.received[0]))
+	}
+	assert.EqualValues(t, 1, r1.SyncCount())
+	assert.Equal(t, time.Hour, r1.Snapshot().Interval)
+
+	stop, errs = g.StartWithErrors(0)
+	stop()
+	_, open := <-errs
+	assert.False(t, open, "should not start with a non-positive interval")
+}
+
+type nextPollSource struct {
+	staticSource
+	next time.Time
+}
+
+func (s *nextPollSource) NextPoll() time.Time {
+	return s.next
+}
+
+func TestNextInterval(t *testing.T) {
+	s := &nextPollSource{}
+	runner := New(s, &recordingSink{})
+	runner.MinInterval, runner.MaxInterval = time.Minute, time.Hour
+	assert.Equal(t, 5*time.Minute, runner.nextInterval(5*time.Minute), "should fall back to the interval without a suggestion")
+	s.next = time.Now().Add(30 * time.Minute)
+	assert.InDelta(t, float64(30*time.Minute), float64(runner.nextInterval(5*time.Minute)), float64(time.Second))
+	s.next = time.Now().Add(time.Second)
+	assert.Equal(t, time.Minute, runner.nextInterval(5*time.Minute), "should be clamped to MinInterval")
+	s.next = time.Now().Add(24 * time.Hour)
+	assert.Equal(t, time.Hour, runner.nextInterval(5*time.Minute), "should be clamped to MaxInterval")
+}
+
+type countingFailingSink struct {
+	failingSink
+	calls int32
+}
+
+func (s *countingFailingSink) UpdateFrom(r io.Reader) error {
+	atomic.AddInt32(&s.calls, 1)
+	return s.failingSink.UpdateFrom(r)
+}
+
+func TestAllSinksFailed(t *testing.T) {
+	s := &staticSource{data: "data", lastModified: time.Now().Add(-time.Hour)}
+	sink := &countingFailingSink{}
+	runner := New(s, sink)
+	stop, errs := runner.StartWithErrors(10 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		var sinkErr *SinkError
+		assert.True(t, errors.As(<-errs, &sinkErr))
+	}
+	stop()
+	for range errs {
+	}
+	assert.True(t, atomic.LoadInt32(&sink.calls) >= 3, "should keep retrying the failing sink on every tick")
+	assert.EqualValues(t, 0, runner.UnmodifiedCount())
+	assert.True(t, runner.Snapshot().LastSynced.IsZero())
+
+	ok := &recordingSink{}
+	runner = New(s, &countingFailingSink{}, ok)
+	runner.InitFrom(s)
+	runner.InitFrom(s)
+	assert.Len(t, ok.received, 1, "should be synced if any sink succeeded")
+}
+
+type flakySink struct {
+	recordingSink
+	err error
+}
+
+func (s *flakySink) UpdateFrom(r io.Reader) error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.recordingSink.UpdateFrom(r)
+}
+
+func (s *flakySink) String() string {
+	return "flaky sink"
+}
+
+func TestReplayLast(t *testing.T) {
+	s := &staticSource{data: "data", lastModified: time.Now().Add(-time.Hour)}
+	good, flaky := &recordingSink{}, &flakySink{err: errors.New("unavailable")}
+	runner := New(s, good, flaky)
+	assert.Equal(t, ErrNoRetainedData, runner.ReplayLast())
+	runner.InitFrom(s)
+	assert.Equal(t, ErrNoRetainedData, runner.ReplayLast(), "data should not be retained by default")
+
+	runner.RetainLast = true
+	s.lastModified = time.Now().Add(time.Hour)
+	runner.InitFrom(s)
+	assert.Len(t, good.received, 2)
+	assert.Empty(t, flaky.received)
+
+	var sinkErr *SinkError
+	assert.True(t, errors.As(runner.ReplayLast(flaky), &sinkErr))
+	flaky.err = nil
+	assert.NoError(t, runner.ReplayLast(flaky))
+	if assert.Len(t, flaky.received, 1, "recovered sink should get the data") {
+		assert.Equal(t, "data", string(flaky.received[0]))
+	}
+	assert.Len(t, good.received, 2, "other sinks should be left alone")
+	assert.Nil(t, runner.SinkStatus()[flaky.String()].LastError)
+
+	assert.NoError(t, runner.ReplayLast())
+	assert.Len(t, good.received, 3)
+	assert.Len(t, flaky.received, 2)
+}
+
+func TestStartWithLimit(t *testing.T) {
+	changing := &staticSource{data: "data", lastModified: time.Now().Add(time.Hour)}
+	runner := New(changing, &recordingSink{})
+	_, reasons := runner.StartWithLimit(5*time.Millisecond, 3, 0)
+	assert.Equal(t, StoppedAtMaxSyncs, <-reasons)
+	assert.EqualValues(t, 3, runner.SyncCount())
+	_, open := <-reasons
+	assert.False(t, open, "reasons should be closed")
+
+	unchanged := &staticSource{data: "data", lastModified: time.Now().Add(-time.Hour)}
+	runner = New(unchanged, &recordingSink{})
+	_, reasons = runner.StartWithLimit(5*time.Millisecond, 3, 50*time.Millisecond)
+	assert.Equal(t, StoppedAtMaxDuration, <-reasons)
+	assert.EqualValues(t, 1, runner.SyncCount())
+
+	runner = New(unchanged, &recordingSink{})
+	stop, reasons := runner.StartWithLimit(time.Hour, 0, 0)
+	stop()
+	assert.Equal(t, StoppedByCaller, <-reasons)
+	assert.Equal(t, "stopped by caller", StoppedByCaller.String())
+}
+
+func TestSync(t *testing.T) {
+	s := &staticSource{data: "data", lastModified: time.Now().Add(-time.Hour)}
+	good := &recordingSink{}
+	runner := New(s, good, failingSink{})
+	result := runner.Sync()
+	assert.True(t, result.Changed)
+	assert.False(t, result.Unmodified)
+	assert.EqualValues(t, 4, result.Bytes)
+	assert.NoError(t, result.Err)
+	if assert.Len(t, result.SinkErrs, 1) {
+		assert.EqualError(t, result.SinkErrs["failing sink"], "failing sink")
+	}
+	assert.Len(t, good.received, 1)
+
+	result = runner.Sync()
+	assert.False(t, result.Changed)
+	assert.True(t, result.Unmodified)
+	assert.Zero(t, result.Bytes)
+	assert.Empty(t, result.SinkErrs)
+
+	failing := &byteSource{lastModified: time.Now(), remainingFailures: 3}
+	runner = New(failing, good)
+	runner.OnSourceError = ExpBackoff(time.Millisecond, 2)
+	result = runner.Sync()
+	assert.False(t, result.Changed)
+	var srcErr *SourceError
+	if assert.True(t, errors.As(result.Err, &srcErr)) {
+		assert.Equal(t, 2, srcErr.Tries)
+	}
+	assert.True(t, result.Duration > 0)
+
+	assert.Equal(t, ErrNoSinks, New(s).Sync().Err)
+}
+
+func TestSourceFunc(t *testing.T) {
+	modified := time.Now()
+	s := SourceFunc(func(ifNewerThan time.Time) (io.ReadCloser, error) {
+		if !ifNewerThan.Before(modified) {
+			return nil, ErrUnmodified
+		}
+		return ioutil.NopCloser(strings.NewReader("data")), nil
+	})
+	sink := &recordingSink{}
+	runner := New(s, sink)
+	runner.InitFrom(s)
+	runner.InitFrom(s)
+	if assert.Len(t, sink.received, 1) {
+		assert.Equal(t, "data", string(sink.received[0]))
+	}
+	assert.Equal(t, "keepcurrent.SourceFunc", describe(s))
+}
+
+func TestMaxContentAge(t *testing.T) {
+	src, _ := writeTempFile(t, []byte("data"))
+	defer os.Remove(src)
+	modTime := time.Now().Add(-2 * time.Hour).Truncate(time.Second)
+	assert.NoError(t, os.Chtimes(src, modTime, modTime))
+
+	s := FromFile(src)
+	runner := New(s, &recordingSink{})
+	runner.MaxContentAge = time.Hour
+	var tooOld []*ContentTooOldError
+	runner.OnContentTooOld = func(err *ContentTooOldError) {
+		tooOld = append(tooOld, err)
+	}
+	runner.InitFrom(s)
+	assert.True(t, modTime.Equal(runner.ContentModTime()))
+	if assert.Len(t, tooOld, 1) {
+		assert.True(t, modTime.Equal(tooOld[0].ModTime))
+		assert.True(t, tooOld[0].Age > time.Hour)
+		assert.Equal(t, time.Hour, tooOld[0].MaxAge)
+	}
+	runner.InitFrom(s)
+	assert.EqualValues(t, 1, runner.UnmodifiedCount())
+	assert.Len(t, tooOld, 2, "should keep reporting while the source is unmodified")
+
+	fresh := time.Now()
+	assert.NoError(t, os.Chtimes(src, fresh, fresh))
+	runner.InitFrom(s)
+	assert.Len(t, tooOld, 2, "should not report fresh data")
+
+	runner = New(&staticSource{data: "data"}, &recordingSink{})
+	runner.MaxContentAge = time.Nanosecond
+	runner.OnContentTooOld = func(err *ContentTooOldError) {
+		assert.Fail(t, "data without a modification time should never be too old")
+	}
+	runner.InitFrom(runner.source)
+}
+
+func TestOnError(t *testing.T) {
+	var calls []string
+	var errs []*SyncError
+	record := func(runner *Runner) {
+		runner.OnSourceError = func(err error, tries int) time.Duration {
+			calls = append(calls, "source")
+			return 0
+		}
+		runner.OnSinkError = func(sink Sink, err error) {
+			calls = append(calls, "sink")
+		}
+		runner.OnError = func(err *SyncError) {
+			calls = append(calls, "error")
+			errs = append(errs, err)
+		}
+	}
+
+	s := &staticSource{data: "data"}
+	runner := New(s, failingSink{}, &recordingSink{})
+	record(runner)
+	runner.InitFrom(s)
+	assert.Equal(t, []string{"sink", "error"}, calls, "should call the granular callback first")
+	if assert.Len(t, errs, 1) {
+		assert.Equal(t, PhaseSink, errs[0].Phase)
+		assert.Equal(t, failingSink{}, errs[0].Sink)
+		assert.EqualError(t, errs[0].Err, "failing sink")
+		assert.EqualError(t, errs[0], "sink error writing to failing sink: failing sink")
+	}
+
+	calls, errs = nil, nil
+	errInvalid := errors.New("invalid")
+	runner = NewWithValidator(func(data []byte) error { return errInvalid }, s, &recordingSink{})
+	record(runner)
+	runner.InitFrom(s)
+	assert.Equal(t, []string{"source", "error"}, calls)
+	if assert.Len(t, errs, 1) {
+		assert.Equal(t, PhaseValidate, errs[0].Phase)
+		assert.Nil(t, errs[0].Sink)
+		assert.Equal(t, errInvalid, errs[0].Err)
+		assert.Equal(t, 1, errs[0].Tries)
+	}
+
+	calls, errs = nil, nil
+	failing := &byteSource{lastModified: time.Now(), remainingFailures: 2}
+	runner = New(failing, &recordingSink{})
+	record(runner)
+	runner.InitFrom(failing)
+	if assert.Len(t, errs, 1) {
+		assert.Equal(t, PhaseFetch, errs[0].Phase)
+		assert.Equal(t, io.ErrUnexpectedEOF, errs[0].Err)
+		assert.True(t, errors.Is(errs[0], io.ErrUnexpectedEOF))
+		assert.Equal(t, "fetch", errs[0].Phase.String())
+	}
+}
+
+func TestOnSinkFailure(t *testing.T) {
+	s := &staticSource{data: "data", lastModified: time.Now().Add(-time.Hour)}
+	var failures []SinkFailure
+	var sinkErrors int
+	runner := New(s, failingSink{}, &recordingSink{})
+	runner.OnSinkError = func(sink Sink, err error) { sinkErrors++ }
+	runner.OnSinkFailure = func(f SinkFailure) { failures = append(failures, f) }
+	runner.InitFrom(s)
+	if assert.Len(t, failures, 1) {
+		assert.Equal(t, failingSink{}, failures[0].Sink)
+		assert.EqualError(t, failures[0].Err, "failing sink")
+		assert.Equal(t, 1, failures[0].Attempt)
+		assert.False(t, failures[0].WillRetry, "the sync succeeded for the other sink")
+	}
+	assert.Equal(t, 1, sinkErrors, "OnSinkError should still be called")
+
+	failures = nil
+	runner = New(s, Required(failingSink{}), &recordingSink{})
+	runner.OnSinkFailure = func(f SinkFailure) { failures = append(failures, f) }
+	runner.InitFrom(s)
+	runner.InitFrom(s)
+	if assert.Len(t, failures, 2) {
+		assert.Equal(t, 1, failures[0].Attempt)
+		assert.Equal(t, 2, failures[1].Attempt)
+		assert.True(t, failures[1].WillRetry, "a failed required sink should be retried")
+	}
+	assert.Equal(t, 2, runner.SinkStatus()[failingSink{}.String()].ConsecutiveFailures)
+}
+
+func TestDrainsSourceOnSinkError(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	var newConns int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(data)
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&newConns, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	for _, streaming := range []bool{true, false} {
+		srv.Client().CloseIdleConnections()
+		atomic.StoreInt32(&newConns, 0)
+		runner := New(FromWebWithClient(srv.URL, srv.Client()), &bailingSink{streaming})
+		for i := 0; i < 5; i++ {
+			assert.Len(t, runner.Sync().SinkErrs, 1)
+		}
+		assert.EqualValues(t, 1, atomic.LoadInt32(&newConns), "connection should be reused, streaming: %v", streaming)
+	}
+}
+
+// bailingSink fails after reading one byte.
+type bailingSink struct {
+	streaming bool
+}
+
+func (s *bailingSink) UpdateFrom(r io.Reader) error {
+	r.Read(make([]byte, 1))
+	return errors.New("bailing sink")
+}
+
+func (s *bailingSink) ReusableReader() bool {
+	return s.streaming
+}
+
+func (s *bailingSink) String() string {
+	return "bailing sink"
+}
+
+func TestOnTick(t *testing.T) {
+	var ticks []TickStats
+	s := &slowSource{delay: 10 * time.Millisecond}
+	runner := New(s, &slowSink{delay: 100 * time.Millisecond})
+	runner.OnTick = func(stats TickStats) { ticks = append(ticks, stats) }
+	runner.InitFrom(s)
+	if assert.Len(t, ticks, 1) {
+		assert.True(t, ticks[0].FetchDuration >= 10*time.Millisecond)
+		assert.True(t, ticks[0].FetchDuration < ticks[0].SinkDuration, "should not include writing")
+		assert.True(t, ticks[0].SinkDuration >= 100*time.Millisecond)
+		assert.EqualValues(t, 5, ticks[0].Bytes)
+		assert.False(t, ticks[0].Unmodified)
+	}
+
+	static := &staticSource{data: "data", lastModified: time.Now().Add(-time.Hour)}
+	runner = New(static, &recordingSink{})
+	runner.OnTick = func(stats TickStats) { ticks = append(ticks, stats) }
+	runner.InitFrom(static)
+	runner.InitFrom(static)
+	if assert.Len(t, ticks, 3) {
+		assert.True(t, ticks[2].Unmodified, "should fire on unmodified ticks too")
+		assert.Zero(t, ticks[2].Bytes)
+		assert.Zero(t, ticks[2].SinkDuration)
+	}
+}
+
+// slowSink takes a while to write the data.
+type slowSink struct {
+	delay time.Duration
+}
+
+func (s *slowSink) UpdateFrom(r io.Reader) error {
+	time.Sleep(s.delay)
+	_, err := io.Copy(ioutil.Discard, r)
+	return err
+}
+
+func (s *slowSink) String() string {
+	return "slow sink"
+}
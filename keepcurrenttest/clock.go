@@ -0,0 +1,134 @@
+package keepcurrenttest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/getlantern/keepcurrent"
+)
+
+// FakeClock is a keepcurrent.Clock whose time only moves when told to, to
+// test time-dependent behavior deterministically without real sleeps.
+type FakeClock struct {
+	mx      sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	waiters []*fakeTimer
+}
+
+// NewFakeClock constructs a FakeClock starting at the given time.
+func NewFakeClock(now time.Time) *FakeClock {
+	c := &FakeClock{now: now}
+	c.cond = sync.NewCond(&c.mx)
+	return c
+}
+
+// fakeTimer backs both the tickers and the channels returned by After. A zero
+// period means it fires only once.
+type fakeTimer struct {
+	c      *FakeClock
+	ch     chan time.Time
+	next   time.Time
+	period time.Duration
+}
+
+// Now implements keepcurrent.Clock
+func (c *FakeClock) Now() time.Time {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.now
+}
+
+// NewTicker implements keepcurrent.Clock
+func (c *FakeClock) NewTicker(d time.Duration) keepcurrent.Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	return c.add(d, d)
+}
+
+// After implements keepcurrent.Clock
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	return c.add(d, 0).ch
+}
+
+func (c *FakeClock) add(d, period time.Duration) *fakeTimer {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	t := &fakeTimer{c: c, ch: make(chan time.Time, 1), next: c.now.Add(d), period: period}
+	c.waiters = append(c.waiters, t)
+	c.cond.Broadcast()
+	return t
+}
+
+// Advance moves the time forward by d, firing the tickers and timers due in
+// the meantime in order. Like a real ticker, a ticker whose last tick hasn't
+// been received drops the ticks in between.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	end := c.now.Add(d)
+	for {
+		var earliest *fakeTimer
+		for _, t := range c.waiters {
+			if !t.next.After(end) && (earliest == nil || t.next.Before(earliest.next)) {
+				earliest = t
+			}
+		}
+		if earliest == nil {
+			break
+		}
+		c.now = earliest.next
+		select {
+		case earliest.ch <- c.now:
+		default:
+		}
+		if earliest.period > 0 {
+			earliest.next = earliest.next.Add(earliest.period)
+		} else {
+			c.remove(earliest)
+		}
+	}
+	c.now = end
+}
+
+// BlockUntil waits until at least n tickers and timers are pending, e.g. for
+// the runner to start waiting before a retry, so that Advance fires it.
+func (c *FakeClock) BlockUntil(n int) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	for len(c.waiters) < n {
+		c.cond.Wait()
+	}
+}
+
+func (c *FakeClock) remove(t *fakeTimer) {
+	for i, w := range c.waiters {
+		if w == t {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTimer) Stop() {
+	t.c.mx.Lock()
+	t.c.remove(t)
+	t.c.mx.Unlock()
+}
+
+func (t *fakeTimer) Reset(d time.Duration) {
+	if d <= 0 {
+		panic("non-positive interval for Reset")
+	}
+	t.c.mx.Lock()
+	defer t.c.mx.Unlock()
+	t.c.remove(t)
+	t.next, t.period = t.c.now.Add(d), d
+	t.c.waiters = append(t.c.waiters, t)
+	t.c.cond.Broadcast()
+}
@@ -0,0 +1,156 @@
+// Package keepcurrenttest provides a source and a sink to help testing code
+// built with keepcurrent.
+package keepcurrenttest
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/getlantern/keepcurrent"
+)
+
+// RecordingSink is a sink which records all data it's updated with. The zero
+// value is ready to use.
+type RecordingSink struct {
+	// If not nil, Err is returned by UpdateFrom after reading the data, which
+	// is not recorded then.
+	Err error
+
+	mx       sync.Mutex
+	received [][]byte
+}
+
+// UpdateFrom implements keepcurrent.Sink
+func (s *RecordingSink) UpdateFrom(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.Err != nil {
+		return s.Err
+	}
+	s.received = append(s.received, b)
+	return nil
+}
+
+// Received returns all data received so far, in order.
+func (s *RecordingSink) Received() [][]byte {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return append([][]byte(nil), s.received...)
+}
+
+// Last returns the data received most recently, or nil if nothing has been
+// received yet.
+func (s *RecordingSink) Last() []byte {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if len(s.received) == 0 {
+		return nil
+	}
+	return s.received[len(s.received)-1]
+}
+
+func (s *RecordingSink) String() string {
+	return "recording sink"
+}
+
+// Response is what a ScriptedSource returns on one fetch.
+type Response struct {
+	// Data is returned if Err is nil.
+	Data []byte
+	// Err is returned by Fetch if not nil.
+	Err error
+	// ReadErr, if not nil, is returned when reading past Data, to simulate a
+	// failure midway.
+	ReadErr error
+}
+
+// Data returns a Response with the given data.
+func Data(data string) Response {
+	return Response{Data: []byte(data)}
+}
+
+// Error returns a Response failing to fetch with the given error.
+func Error(err error) Response {
+	return Response{Err: err}
+}
+
+// Unmodified returns a Response telling that the source is unmodified.
+func Unmodified() Response {
+	return Response{Err: keepcurrent.ErrUnmodified}
+}
+
+// ScriptedSource is a source which returns the queued responses in order on
+// successive fetches, regardless of ifNewerThan, and reports unmodified once
+// the queue is exhausted.
+type ScriptedSource struct {
+	mx           sync.Mutex
+	responses    []Response
+	ifNewerThans []time.Time
+}
+
+// NewScriptedSource constructs a ScriptedSource with the given responses
+// queued.
+func NewScriptedSource(responses ...Response) *ScriptedSource {
+	return &ScriptedSource{responses: responses}
+}
+
+// Push queues more responses.
+func (s *ScriptedSource) Push(responses ...Response) {
+	s.mx.Lock()
+	s.responses = append(s.responses, responses...)
+	s.mx.Unlock()
+}
+
+// Fetch implements keepcurrent.Source
+func (s *ScriptedSource) Fetch(ifNewerThan time.Time) (io.ReadCloser, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.ifNewerThans = append(s.ifNewerThans, ifNewerThan)
+	if len(s.responses) == 0 {
+		return nil, keepcurrent.ErrUnmodified
+	}
+	resp := s.responses[0]
+	s.responses = s.responses[1:]
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	var r io.Reader = bytes.NewReader(resp.Data)
+	if resp.ReadErr != nil {
+		r = io.MultiReader(r, &errReader{resp.ReadErr})
+	}
+	return ioutil.NopCloser(r), nil
+}
+
+// Describe implements keepcurrent.DescribedSource
+func (s *ScriptedSource) Describe() string {
+	return "scripted source"
+}
+
+// Calls returns how many times Fetch has been called.
+func (s *ScriptedSource) Calls() int {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return len(s.ifNewerThans)
+}
+
+// IfNewerThans returns the ifNewerThan argument of every call to Fetch so far.
+func (s *ScriptedSource) IfNewerThans() []time.Time {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return append([]time.Time(nil), s.ifNewerThans...)
+}
+
+type errReader struct {
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
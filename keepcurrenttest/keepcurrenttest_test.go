@@ -0,0 +1,146 @@
+package keepcurrenttest
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/getlantern/keepcurrent"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScriptedSourceToRecordingSink(t *testing.T) {
+	source := NewScriptedSource(
+		Data("v1"),
+		Unmodified(),
+		Error(errors.New("unavailable")),
+		Response{Data: []byte("partial"), ReadErr: io.ErrUnexpectedEOF},
+		Data("v2"),
+	)
+	sink := &RecordingSink{}
+	runner := keepcurrent.New(source, sink)
+	var sourceErrors int
+	runner.OnSourceError = func(err error, tries int) time.Duration {
+		sourceErrors++
+		return time.Millisecond
+	}
+	for i := 0; i < 3; i++ {
+		runner.InitFrom(source)
+	}
+	assert.Equal(t, [][]byte{[]byte("v1"), []byte("v2")}, sink.Received())
+	assert.Equal(t, []byte("v2"), sink.Last())
+	assert.Equal(t, 2, sourceErrors)
+	assert.Equal(t, 5, source.Calls())
+	ifNewerThans := source.IfNewerThans()
+	assert.True(t, ifNewerThans[0].IsZero())
+	assert.False(t, ifNewerThans[1].IsZero())
+}
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	source := NewScriptedSource(
+		Error(errors.New("unavailable")),
+		Error(errors.New("unavailable")),
+		Data("v1"),
+	)
+	ch := make(chan []byte)
+	runner := keepcurrent.New(source, keepcurrent.ToChannel(ch))
+	runner.Clock = clock
+	runner.OnSourceError = keepcurrent.ExpBackoff(time.Second, 5)
+	stop := runner.Start(time.Hour)
+	defer stop()
+
+	// the ticker and the wait before retrying
+	clock.BlockUntil(2)
+	assert.Equal(t, 1, source.Calls())
+	clock.Advance(time.Second)
+	clock.BlockUntil(2)
+	assert.Equal(t, 2, source.Calls())
+	clock.Advance(2 * time.Second)
+	assert.Equal(t, "v1", string(<-ch))
+
+	clock.Advance(time.Hour)
+	assert.Eventually(t, func() bool { return source.Calls() == 4 }, time.Second, time.Millisecond)
+	ifNewerThans := source.IfNewerThans()
+	assert.Equal(t, start.Add(3*time.Second), ifNewerThans[3], "should be the time of the last successful fetch")
+	assert.Equal(t, start.Add(time.Hour+3*time.Second), clock.Now())
+}
+
+func TestFromWatched(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	source := NewScriptedSource(Data("v1"), Data("v2"), Data("v3"))
+	events := make(chan struct{})
+	runner := keepcurrent.New(keepcurrent.FromWatched(source, events, time.Second), &RecordingSink{})
+	runner.Clock = clock
+	stop := runner.Start(time.Hour)
+	defer stop()
+	assert.Eventually(t, func() bool { return source.Calls() == 1 }, time.Second, time.Millisecond)
+
+	for i := 0; i < 100; i++ {
+		events <- struct{}{}
+	}
+	// the ticker and the quiet period after each event
+	clock.BlockUntil(101)
+	clock.Advance(500 * time.Millisecond)
+	events <- struct{}{}
+	clock.BlockUntil(102)
+	clock.Advance(600 * time.Millisecond)
+	assert.Equal(t, 1, source.Calls(), "should wait for the burst to settle")
+	clock.Advance(500 * time.Millisecond)
+	assert.Eventually(t, func() bool { return source.Calls() == 2 }, time.Second, time.Millisecond, "should sync once for the burst")
+
+	events <- struct{}{}
+	close(events)
+	assert.Eventually(t, func() bool { return source.Calls() == 3 }, time.Second, time.Millisecond, "should sync the burst in progress once the events are closed")
+}
+
+func TestGroupFromWatched(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	watched := NewScriptedSource(Data("v1"), Data("v2"))
+	polled := NewScriptedSource(Data("v1"), Data("v2"))
+	events := make(chan struct{})
+	g := keepcurrent.NewGroup()
+	g.Clock = clock
+	g.Add(keepcurrent.FromWatched(watched, events, time.Second), &RecordingSink{})
+	g.Add(polled, &RecordingSink{})
+	stop := g.Start(time.Hour)
+	defer stop()
+	assert.Eventually(t, func() bool { return watched.Calls() == 1 && polled.Calls() == 1 }, time.Second, time.Millisecond)
+
+	events <- struct{}{}
+	// the ticker and the quiet period
+	clock.BlockUntil(2)
+	clock.Advance(time.Second)
+	assert.Eventually(t, func() bool { return watched.Calls() == 2 }, time.Second, time.Millisecond)
+	assert.Equal(t, 1, polled.Calls(), "should only sync the pair watched")
+}
+
+func TestStartWithOptions(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	source := NewScriptedSource(Data("v1"), Data("v2"), Data("v3"))
+	runner := keepcurrent.New(source, &RecordingSink{})
+	runner.Clock = clock
+	stop := runner.StartWithOptions(
+		keepcurrent.WithInterval(time.Hour),
+		keepcurrent.WithInitialDelay(time.Minute),
+		keepcurrent.WithImmediate(false),
+		keepcurrent.WithJitter(time.Minute),
+	)
+	defer stop()
+
+	// the ticker and the initial wait
+	clock.BlockUntil(2)
+	clock.Advance(time.Hour)
+	assert.Equal(t, 0, source.Calls(), "should wait for the initial delay on top of the interval")
+	clock.Advance(time.Minute)
+	assert.Eventually(t, func() bool { return source.Calls() == 1 }, time.Second, time.Millisecond)
+
+	// The wait is reset with new jitter after the sync
+	assert.Eventually(t, func() bool {
+		clock.Advance(time.Minute)
+		return source.Calls() == 2
+	}, time.Second, time.Millisecond)
+	assert.False(t, clock.Now().Before(time.Date(2024, 1, 1, 2, 1, 0, 0, time.UTC)), "should wait at least the interval")
+}
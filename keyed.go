@@ -0,0 +1,153 @@
+package keepcurrent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// KeyedOptions configures a sink constructed by ToKeyedWithOptions.
+type KeyedOptions struct {
+	// RejectUnexpected makes the write fail if the data has keys without a
+	// sink, rather than ignoring them, e.g. to notice a file added upstream.
+	RejectUnexpected bool
+}
+
+// KeyedError describes a failure of a sink constructed by ToKeyed.
+type KeyedError struct {
+	// Missing are the keys of the sinks which are missing from the data.
+	Missing []string
+	// Unexpected are the keys of the data without a sink, with
+	// KeyedOptions.RejectUnexpected.
+	Unexpected []string
+	// SinkErrs are the errors writing to the sinks, by their keys.
+	SinkErrs map[string]error
+}
+
+func (e *KeyedError) Error() string {
+	var problems []string
+	if len(e.Missing) > 0 {
+		problems = append(problems, "missing keys "+strings.Join(e.Missing, ", "))
+	}
+	if len(e.Unexpected) > 0 {
+		problems = append(problems, "unexpected keys "+strings.Join(e.Unexpected, ", "))
+	}
+	keys := make([]string, 0, len(e.SinkErrs))
+	for key := range e.SinkErrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		problems = append(problems, fmt.Sprintf("error writing key %v: %v", key, e.SinkErrs[key]))
+	}
+	return strings.Join(problems, "; ")
+}
+
+type keyedSink struct {
+	parse func(io.Reader) (map[string]io.Reader, error)
+	sinks map[string]Sink
+	keys  []string
+	opts  KeyedOptions
+}
+
+// ToKeyed constructs a sink which splits the data into named parts with
+// parse, e.g. SplitJSONObject for a JSON object mapping file names to their
+// contents, and writes each part to the sink of its key, so that one fetch
+// updates many sinks. The sinks are written in the order of their keys.
+// Keys of the data without a sink are ignored.
+//
+// If any key of the sinks is missing from the data, the write fails with a
+// *KeyedError before writing to any of them, so they're never updated from
+// incomplete data. Errors writing to the sinks are also returned in a
+// *KeyedError, after all of them are written.
+func ToKeyed(parse func(io.Reader) (map[string]io.Reader, error), sinks map[string]Sink) Sink {
+	return ToKeyedWithOptions(parse, sinks, KeyedOptions{})
+}
+
+// ToKeyedWithOptions is the same as ToKeyed but with the given options.
+func ToKeyedWithOptions(parse func(io.Reader) (map[string]io.Reader, error), sinks map[string]Sink, opts KeyedOptions) Sink {
+	keys := make([]string, 0, len(sinks))
+	for key := range sinks {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return &keyedSink{parse, sinks, keys, opts}
+}
+
+func (s *keyedSink) UpdateFrom(r io.Reader) error {
+	return s.UpdateWithMetadata(r, Metadata{})
+}
+
+// UpdateWithMetadata implements MetadataSink
+func (s *keyedSink) UpdateWithMetadata(r io.Reader, md Metadata) error {
+	parts, err := s.parse(r)
+	if err != nil {
+		return err
+	}
+	keyedErr := &KeyedError{}
+	for _, key := range s.keys {
+		if _, found := parts[key]; !found {
+			keyedErr.Missing = append(keyedErr.Missing, key)
+		}
+	}
+	if s.opts.RejectUnexpected {
+		for key := range parts {
+			if _, found := s.sinks[key]; !found {
+				keyedErr.Unexpected = append(keyedErr.Unexpected, key)
+			}
+		}
+		sort.Strings(keyedErr.Unexpected)
+	}
+	if len(keyedErr.Missing) > 0 || len(keyedErr.Unexpected) > 0 {
+		return keyedErr
+	}
+	for _, key := range s.keys {
+		if err := updateSink(context.Background(), s.sinks[key], parts[key], md); err != nil {
+			if keyedErr.SinkErrs == nil {
+				keyedErr.SinkErrs = make(map[string]error)
+			}
+			keyedErr.SinkErrs[key] = err
+		}
+	}
+	if len(keyedErr.SinkErrs) > 0 {
+		return keyedErr
+	}
+	return nil
+}
+
+// ReusableReader implements ReusableReaderSink
+func (s *keyedSink) ReusableReader() bool {
+	return true
+}
+
+func (s *keyedSink) String() string {
+	descs := make([]string, 0, len(s.keys))
+	for _, key := range s.keys {
+		descs = append(descs, fmt.Sprintf("%v to %v", key, s.sinks[key]))
+	}
+	return "keyed sink of " + strings.Join(descs, ", ")
+}
+
+// SplitJSONObject splits a JSON object into its values by their keys, for
+// ToKeyed. String values are unquoted, e.g. to hold the contents of a file,
+// while any other value is kept as JSON.
+func SplitJSONObject(r io.Reader) (map[string]io.Reader, error) {
+	var obj map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&obj); err != nil {
+		return nil, fmt.Errorf("data is not a JSON object: %v", err)
+	}
+	parts := make(map[string]io.Reader, len(obj))
+	for key, raw := range obj {
+		var str string
+		if json.Unmarshal(raw, &str) == nil {
+			parts[key] = strings.NewReader(str)
+		} else {
+			parts[key] = bytes.NewReader(raw)
+		}
+	}
+	return parts, nil
+}
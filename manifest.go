@@ -0,0 +1,183 @@
+package keepcurrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// ErrChecksumMismatch is wrapped in an *ArtifactError when the artifact found
+// through a manifest doesn't match the checksum in it.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ManifestError describes a failure fetching or resolving the manifest of a
+// source constructed by FromManifest.
+type ManifestError struct {
+	Err error
+}
+
+func (e *ManifestError) Error() string {
+	return fmt.Sprintf("manifest: %v", e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *ManifestError) Unwrap() error {
+	return e.Err
+}
+
+// ArtifactError describes a failure fetching or verifying the artifact the
+// manifest of a source constructed by FromManifest points at.
+type ArtifactError struct {
+	// URL is where the artifact was fetched from.
+	URL string
+	Err error
+}
+
+func (e *ArtifactError) Error() string {
+	return fmt.Sprintf("artifact %v: %v", e.URL, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *ArtifactError) Unwrap() error {
+	return e.Err
+}
+
+type manifestSource struct {
+	manifest Source
+	resolve  func([]byte) (url string, sha []byte, err error)
+	opts     WebOptions
+
+	mx     sync.Mutex
+	url    string
+	sha    []byte
+	synced bool
+	// pendingURL and pendingSHA are what the manifest last resolved to, to
+	// retry the artifact if it's not synced while the manifest is unmodified
+	pendingURL string
+	pendingSHA []byte
+}
+
+// FromManifest constructs a source which fetches a manifest, e.g. a
+// latest.json published along with the releases, resolves the URL of the
+// artifact it points at and its SHA-256 checksum with resolve, and then fetches
+// the artifact from the web. The artifact is verified against the checksum as
+// it's read, failing the read at the end if it doesn't match, or not at all
+// if the checksum is empty. It's unmodified if the manifest is, or if it
+// resolves to the same URL and checksum as the artifact last read in full.
+//
+// Errors with the manifest, including those returned by resolve, are wrapped
+// in a *ManifestError, and errors with the artifact in an *ArtifactError.
+func FromManifest(manifest Source, resolve func([]byte) (url string, sha []byte, err error)) Source {
+	return FromManifestWithOptions(manifest, resolve, WebOptions{})
+}
+
+// FromManifestWithOptions is the same as FromManifest but fetches the
+// artifact with the given options, e.g. with a client for a mirror behind
+// mTLS or a proxy. The manifest itself is fetched by the given source.
+func FromManifestWithOptions(manifest Source, resolve func([]byte) (url string, sha []byte, err error), opts WebOptions) Source {
+	return &manifestSource{manifest: manifest, resolve: resolve, opts: opts}
+}
+
+// Fetch implements the Source interface
+func (s *manifestSource) Fetch(ifNewerThan time.Time) (io.ReadCloser, error) {
+	return s.FetchContext(context.Background(), ifNewerThan)
+}
+
+// FetchContext implements the ContextSource interface
+func (s *manifestSource) FetchContext(ctx context.Context, ifNewerThan time.Time) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	var err error
+	if cs, ok := s.manifest.(ContextSource); ok {
+		rc, err = cs.FetchContext(ctx, ifNewerThan)
+	} else {
+		rc, err = s.manifest.Fetch(ifNewerThan)
+	}
+	if err == ErrUnmodified {
+		s.mx.Lock()
+		url, sha, synced := s.pendingURL, s.pendingSHA, s.synced
+		s.mx.Unlock()
+		if synced || url == "" {
+			return nil, err
+		}
+		// The artifact failed after the manifest was read, so try it again
+		return s.fetchArtifact(ctx, url, sha)
+	}
+	if err != nil {
+		return nil, &ManifestError{err}
+	}
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return nil, &ManifestError{err}
+	}
+	url, sha, err := s.resolve(data)
+	if err != nil {
+		return nil, &ManifestError{err}
+	}
+	s.mx.Lock()
+	same := s.synced && s.url == url && bytes.Equal(s.sha, sha)
+	if !same {
+		s.pendingURL, s.pendingSHA, s.synced = url, sha, false
+	}
+	s.mx.Unlock()
+	if same && !ifNewerThan.IsZero() {
+		return nil, ErrUnmodified
+	}
+	return s.fetchArtifact(ctx, url, sha)
+}
+
+// fetchArtifact fetches the artifact, to be verified against the checksum as
+// it's read.
+func (s *manifestSource) fetchArtifact(ctx context.Context, url string, sha []byte) (io.ReadCloser, error) {
+	rc, err := newWebSource(url, nil, s.opts).FetchContext(ctx, time.Time{})
+	if err != nil {
+		return nil, &ArtifactError{URL: url, Err: err}
+	}
+	return withMetadata(&artifactReader{ReadCloser: rc, s: s, url: url, sha: sha, hasher: sha256.New()}, metadataOf(rc)), nil
+}
+
+// Describe implements DescribedSource
+func (s *manifestSource) Describe() string {
+	return "artifact of manifest " + describe(s.manifest)
+}
+
+// ResetConditions implements ResettableSource
+func (s *manifestSource) ResetConditions() {
+	resetConditions(s.manifest)
+	s.mx.Lock()
+	s.synced = false
+	s.mx.Unlock()
+}
+
+// artifactReader verifies the artifact against the checksum once it's read
+// in full, and only then remembers it as synced.
+type artifactReader struct {
+	io.ReadCloser
+	s      *manifestSource
+	url    string
+	sha    []byte
+	hasher hash.Hash
+}
+
+func (r *artifactReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hasher.Write(p[:n])
+	if err == io.EOF {
+		if len(r.sha) > 0 && !bytes.Equal(r.hasher.Sum(nil), r.sha) {
+			return n, &ArtifactError{URL: r.url, Err: ErrChecksumMismatch}
+		}
+		r.s.mx.Lock()
+		r.s.url, r.s.sha, r.s.synced = r.url, r.sha, true
+		r.s.mx.Unlock()
+	} else if err != nil {
+		err = &ArtifactError{URL: r.url, Err: err}
+	}
+	return n, err
+}
@@ -0,0 +1,128 @@
+package keepcurrent
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Metadata describes the data fetched from a source, as far as the source
+// knows.
+type Metadata struct {
+	// ModTime is when the data was last modified at the source.
+	ModTime time.Time
+	// Stale is true if the data is a copy served in place of the data at the
+	// source as the source is unavailable, e.g. by WithCache.
+	Stale bool
+	// ContentEncoding is the encoding the data is still in, as in the HTTP
+	// Content-Encoding header, e.g. "gzip", or empty if the data is not
+	// encoded.
+	ContentEncoding string
+	// ContentType is the media type of the data, as in the HTTP Content-Type
+	// header, e.g. "application/json". The web sources take it from the
+	// header. For other sources, the runner sniffs it from the data with
+	// http.DetectContentType unless the data is encoded. Use WithContentType
+	// to set it instead.
+	ContentType string
+}
+
+// sniffLen is how much of the data http.DetectContentType considers.
+const sniffLen = 512
+
+// MetadataReader is optionally implemented by the io.ReadCloser returned from
+// Source.Fetch to describe the data.
+type MetadataReader interface {
+	io.ReadCloser
+	Metadata() Metadata
+}
+
+// MetadataSink is optionally implemented by a Sink which makes use of the
+// metadata of the data. The runner calls UpdateWithMetadata instead of
+// UpdateFrom for such sinks.
+type MetadataSink interface {
+	Sink
+	UpdateWithMetadata(r io.Reader, md Metadata) error
+}
+
+type metadataReader struct {
+	io.ReadCloser
+	md Metadata
+}
+
+func (r *metadataReader) Metadata() Metadata {
+	return r.md
+}
+
+// withMetadata attaches the metadata to the reader.
+func withMetadata(rc io.ReadCloser, md Metadata) io.ReadCloser {
+	return &metadataReader{rc, md}
+}
+
+// metadataOf returns the metadata attached to the reader, if any.
+func metadataOf(rc io.ReadCloser) Metadata {
+	if mr, ok := rc.(MetadataReader); ok {
+		return mr.Metadata()
+	}
+	return Metadata{}
+}
+
+type contentTypeSource struct {
+	s           Source
+	contentType string
+}
+
+// WithContentType sets the Metadata.ContentType of the data fetched from a
+// source, overriding what the source tells or the runner would sniff, e.g.
+// for a file served by ToServe.
+func WithContentType(contentType string) SourceMiddleware {
+	return func(s Source) Source {
+		return &contentTypeSource{s, contentType}
+	}
+}
+
+func (s *contentTypeSource) Fetch(ifNewerThan time.Time) (io.ReadCloser, error) {
+	rc, err := s.s.Fetch(ifNewerThan)
+	if err != nil {
+		return nil, err
+	}
+	md := metadataOf(rc)
+	md.ContentType = s.contentType
+	return withMetadata(rc, md), nil
+}
+
+// Describe implements DescribedSource
+func (s *contentTypeSource) Describe() string {
+	return describe(s.s)
+}
+
+// ResetConditions implements ResettableSource
+func (s *contentTypeSource) ResetConditions() {
+	resetConditions(s.s)
+}
+
+// metadataKey is the key of the metadata in the context passed to
+// ContextSink.UpdateFromContext.
+type metadataKey struct{}
+
+// MetadataFromContext returns the metadata of the data passed to
+// ContextSink.UpdateFromContext along with the context, so that a sink which
+// implements both ContextSink and MetadataSink gets the metadata too, as the
+// runner only calls UpdateFromContext for such sinks.
+func MetadataFromContext(ctx context.Context) Metadata {
+	md, _ := ctx.Value(metadataKey{}).(Metadata)
+	return md
+}
+
+// updateSink updates the sink with the data, passing the context along with
+// the metadata if the sink accepts a context, or else the metadata if the
+// sink accepts metadata.
+func updateSink(ctx context.Context, s Sink, r io.Reader, md Metadata) error {
+	s = unwrapRequired(s)
+	if cs, ok := s.(ContextSink); ok {
+		return cs.UpdateFromContext(context.WithValue(ctx, metadataKey{}, md), r)
+	}
+	if ms, ok := s.(MetadataSink); ok {
+		return ms.UpdateWithMetadata(r, md)
+	}
+	return s.UpdateFrom(r)
+}
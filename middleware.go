@@ -0,0 +1,36 @@
+package keepcurrent
+
+// SourceMiddleware wraps a source to add behavior to it, e.g. WithTimeout or
+// WithCache.
+type SourceMiddleware func(Source) Source
+
+// Chain wraps the source with the middleware in order, so that the first one
+// wraps the source itself and the last one is the outermost, e.g.
+//
+//	Chain(FromWeb(url), WithTimeout(5*time.Second), WithCache(cachePath))
+//
+// serves the cache when fetching from the web times out.
+func Chain(s Source, mw ...SourceMiddleware) Source {
+	for _, m := range mw {
+		s = m(s)
+	}
+	return s
+}
+
+// SinkMiddleware wraps a sink to add behavior to it, e.g. Required or
+// RateLimitSink.
+type SinkMiddleware func(Sink) Sink
+
+// ChainSink wraps the sink with the middleware in order, so that the first
+// one wraps the sink itself and the last one is the outermost, e.g.
+//
+//	ChainSink(ToFile(path), Verified, RateLimitSink(time.Minute), Required)
+//
+// writes to the file at most once a minute, failing the sync if the data
+// read back doesn't match.
+func ChainSink(s Sink, mw ...SinkMiddleware) Sink {
+	for _, m := range mw {
+		s = m(s)
+	}
+	return s
+}
@@ -0,0 +1,101 @@
+// Package minio syncs data from objects in S3-compatible object stores, such
+// as MinIO or Ceph RGW, via the MinIO client. It's a separate module so that
+// the main module doesn't depend on the MinIO client.
+package minio
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/getlantern/keepcurrent"
+	"github.com/minio/minio-go/v7"
+)
+
+type objectSource struct {
+	client *minio.Client
+	bucket string
+	object string
+
+	mx   sync.Mutex
+	etag string
+}
+
+// FromMinIO constructs a source which reads the object from the bucket. The
+// object is first looked up with StatObject and only downloaded if its ETag
+// differs from the last fetch, or if it's modified since ifNewerThan when the
+// ETag isn't known yet.
+func FromMinIO(client *minio.Client, bucket, object string) keepcurrent.Source {
+	return &objectSource{client: client, bucket: bucket, object: object}
+}
+
+func (s *objectSource) Fetch(ifNewerThan time.Time) (io.ReadCloser, error) {
+	ctx := context.Background()
+	info, err := s.client.StatObject(ctx, s.bucket, s.object, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if !ifNewerThan.IsZero() {
+		etag := s.getETag()
+		if etag != "" && etag == info.ETag || etag == "" && !info.LastModified.After(ifNewerThan) {
+			return nil, keepcurrent.ErrUnmodified
+		}
+	}
+	opts := minio.GetObjectOptions{}
+	// Make sure to get the version just looked up, rather than one uploaded in
+	// between.
+	if err := opts.SetMatchETag(info.ETag); err != nil {
+		return nil, err
+	}
+	obj, err := s.client.GetObject(ctx, s.bucket, s.object, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &objectReader{Object: obj, s: s, etag: info.ETag, md: keepcurrent.Metadata{ModTime: info.LastModified}}, nil
+}
+
+func (s *objectSource) getETag() string {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.etag
+}
+
+func (s *objectSource) setETag(etag string) {
+	s.mx.Lock()
+	s.etag = etag
+	s.mx.Unlock()
+}
+
+// Describe implements keepcurrent.DescribedSource
+func (s *objectSource) Describe() string {
+	return fmt.Sprintf("minio object %v/%v", s.bucket, s.object)
+}
+
+// ResetConditions implements keepcurrent.ResettableSource
+func (s *objectSource) ResetConditions() {
+	s.setETag("")
+}
+
+// objectReader remembers the ETag of the object once it's read in full, so
+// that a failed download is retried rather than considered unmodified.
+type objectReader struct {
+	*minio.Object
+	s    *objectSource
+	etag string
+	md   keepcurrent.Metadata
+}
+
+func (r *objectReader) Read(p []byte) (int, error) {
+	n, err := r.Object.Read(p)
+	if err == io.EOF {
+		r.s.setETag(r.etag)
+	}
+	return n, err
+}
+
+// Metadata implements keepcurrent.MetadataReader
+func (r *objectReader) Metadata() keepcurrent.Metadata {
+	return r.md
+}
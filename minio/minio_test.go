@@ -0,0 +1,93 @@
+package minio
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/keepcurrent"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeStore serves a single object the way an S3-compatible store does.
+type fakeStore struct {
+	mx       sync.Mutex
+	data     string
+	version  int
+	modified time.Time
+	gets     int
+}
+
+func (fs *fakeStore) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	fs.mx.Lock()
+	defer fs.mx.Unlock()
+	if req.URL.Path != "/bucket/config.json" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	etag := fmt.Sprintf(`"v%d"`, fs.version)
+	if match := req.Header.Get("If-Match"); match != "" && match != etag {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", fs.modified.UTC().Format(http.TimeFormat))
+	w.Header().Set("Content-Length", fmt.Sprint(len(fs.data)))
+	if req.Method == http.MethodGet {
+		fs.gets++
+		io.WriteString(w, fs.data)
+	}
+}
+
+func (fs *fakeStore) update(data string) {
+	fs.mx.Lock()
+	fs.data = data
+	fs.version++
+	fs.modified = fs.modified.Add(time.Minute)
+	fs.mx.Unlock()
+}
+
+func TestFromMinIO(t *testing.T) {
+	fs := &fakeStore{modified: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	fs.update("v1")
+	srv := httptest.NewServer(fs)
+	defer srv.Close()
+	client, err := minio.New(strings.TrimPrefix(srv.URL, "http://"), &minio.Options{
+		Creds:        credentials.NewStaticV4("access", "secret", ""),
+		Region:       "us-east-1",
+		BucketLookup: minio.BucketLookupPath,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	s := FromMinIO(client, "bucket", "config.json")
+	fetch := func(ifNewerThan time.Time) (string, error) {
+		rc, err := s.Fetch(ifNewerThan)
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+		b, err := ioutil.ReadAll(rc)
+		return string(b), err
+	}
+	data, err := fetch(time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, "v1", data)
+	_, err = fetch(time.Now())
+	assert.Equal(t, keepcurrent.ErrUnmodified, err, "same ETag should be unmodified")
+	assert.Equal(t, 1, fs.gets, "unmodified object should not be downloaded")
+
+	fs.update("v2")
+	data, err = fetch(time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, "v2", data, "changed ETag should be fetched regardless of the time")
+}
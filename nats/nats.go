@@ -0,0 +1,50 @@
+// Package nats publishes the data synced by keepcurrent over NATS, e.g. to
+// broadcast the updates to many subscribers. It's a separate module so that
+// the main module doesn't depend on the NATS client.
+package nats
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/getlantern/keepcurrent"
+	"github.com/nats-io/nats.go"
+)
+
+type natsSink struct {
+	nc      *nats.Conn
+	subject string
+}
+
+// ToNATS constructs a sink which publishes the data as a message to the
+// subject, and flushes the connection so that an error publishing fails the
+// update rather than being lost in the background. Data larger than the max
+// payload of the server fails with an error wrapping nats.ErrMaxPayload,
+// since NATS can't split a message.
+func ToNATS(nc *nats.Conn, subject string) keepcurrent.Sink {
+	return &natsSink{nc, subject}
+}
+
+func (s *natsSink) UpdateFrom(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if max := s.nc.MaxPayload(); max > 0 && int64(len(data)) > max {
+		return fmt.Errorf("%w: %d bytes of data for %v, %d allowed", nats.ErrMaxPayload, len(data), s.subject, max)
+	}
+	if err := s.nc.Publish(s.subject, data); err != nil {
+		return err
+	}
+	return s.nc.Flush()
+}
+
+// ReusableReader implements keepcurrent.ReusableReaderSink
+func (s *natsSink) ReusableReader() bool {
+	return true
+}
+
+func (s *natsSink) String() string {
+	return "NATS subject " + s.subject
+}
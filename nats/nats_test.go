@@ -0,0 +1,110 @@
+package nats
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/getlantern/keepcurrent"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeServer speaks just enough of the NATS protocol to accept a client and
+// record what it publishes.
+type fakeServer struct {
+	l          net.Listener
+	maxPayload int
+
+	mx        sync.Mutex
+	published []string
+}
+
+func newFakeServer(t *testing.T, maxPayload int) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{l: l, maxPayload: maxPayload}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"fake\",\"version\":\"2.10.0\",\"proto\":1,\"max_payload\":%d}\r\n", s.maxPayload)
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "PING":
+			io.WriteString(conn, "PONG\r\n")
+		case "PUB":
+			n, _ := strconv.Atoi(fields[len(fields)-1])
+			payload := make([]byte, n+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			s.mx.Lock()
+			s.published = append(s.published, fields[1]+" "+string(payload[:n]))
+			s.mx.Unlock()
+		}
+	}
+}
+
+func (s *fakeServer) Published() []string {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return append([]string(nil), s.published...)
+}
+
+func TestToNATS(t *testing.T) {
+	server := newFakeServer(t, 16)
+	defer server.l.Close()
+	nc, err := nats.Connect("nats://" + server.l.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer nc.Close()
+
+	sink := ToNATS(nc, "config.updates")
+	assert.Equal(t, "NATS subject config.updates", sink.String())
+	assert.NoError(t, sink.UpdateFrom(strings.NewReader("v1")))
+	assert.Equal(t, []string{"config.updates v1"}, server.Published())
+
+	err = sink.UpdateFrom(strings.NewReader("more than sixteen bytes"))
+	assert.ErrorIs(t, err, nats.ErrMaxPayload)
+	assert.Len(t, server.Published(), 1, "should not publish truncated data")
+
+	var sinkErrs []error
+	source := keepcurrent.FromReader(strings.NewReader("v2"))
+	runner := keepcurrent.New(source, sink)
+	runner.OnSinkError = func(s keepcurrent.Sink, err error) { sinkErrs = append(sinkErrs, err) }
+	runner.InitFrom(source)
+	assert.Empty(t, sinkErrs)
+	assert.Equal(t, []string{"config.updates v1", "config.updates v2"}, server.Published())
+
+	nc.Close()
+	runner.InitFrom(keepcurrent.FromReader(strings.NewReader("v3")))
+	assert.Len(t, sinkErrs, 1, "should report publishing to a closed connection")
+}
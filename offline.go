@@ -0,0 +1,53 @@
+package keepcurrent
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrOffline is returned by OfflineSource.FetchOffline when the source has
+// nothing to serve without the network. The runner skips the sync, as with
+// ErrUnmodified, but without taking the data as confirmed current.
+var ErrOffline = errors.New("offline")
+
+// OfflineSource is optionally implemented by a Source which can be fetched
+// while the runner is offline, see Runner.Offline, without connecting to the
+// network. The web sources return ErrOffline, and WithCache serves the cached
+// data instead.
+type OfflineSource interface {
+	Source
+	FetchOffline(ifNewerThan time.Time) (io.ReadCloser, error)
+}
+
+// Offline toggles the offline mode of the runner, e.g. upon losing
+// connectivity, without stopping it. While offline, the sources implementing
+// OfflineSource are fetched with FetchOffline rather than connecting to the
+// network, so the syncs from the web sources are skipped, unless they're
+// wrapped with WithCache and the runner doesn't have the cached data yet.
+// Other sources, e.g. files, are fetched as usual.
+func (runner *Runner) Offline(offline bool) {
+	runner.mx.Lock()
+	runner.offline = offline
+	runner.mx.Unlock()
+}
+
+func (runner *Runner) isOffline() bool {
+	runner.mx.RLock()
+	defer runner.mx.RUnlock()
+	return runner.offline
+}
+
+// FetchOffline implements OfflineSource
+func (s *webSource) FetchOffline(ifNewerThan time.Time) (io.ReadCloser, error) {
+	return nil, ErrOffline
+}
+
+// FetchOffline implements OfflineSource
+func (s *cacheSource) FetchOffline(ifNewerThan time.Time) (io.ReadCloser, error) {
+	ofs, ok := s.s.(OfflineSource)
+	if !ok {
+		return s.Fetch(ifNewerThan)
+	}
+	return s.fetch(ifNewerThan, ofs.FetchOffline)
+}
@@ -0,0 +1,147 @@
+package keepcurrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// ErrNoPatch is returned by PatchingSource.FetchPatch when it has no patch
+// from the given base, e.g. as the base is too old, so that the data is
+// fetched in full instead.
+var ErrNoPatch = errors.New("no patch available")
+
+// errPatchFailed is returned internally when applying a patch to a sink
+// fails, so that the data is fetched in full instead.
+var errPatchFailed = errors.New("patch failed")
+
+// PatchingSource is optionally implemented by a Source which can provide a
+// patch from the data last synced to the current data, e.g. a bsdiff or a
+// JSON Patch, rather than the data in full, for large data which changes only
+// slightly. The format of the patch is up to the source and its PatchSinks.
+// The runner fetches a patch rather than the data in full whenever all of its
+// sinks implement PatchSink, and it doesn't need the data in full for
+// Validate, OnChange or RetainLast.
+type PatchingSource interface {
+	Source
+	// FetchPatch fetches the patch to the data with the SHA-256 hash base
+	// from the data modified since ifNewerThan, as Fetch, and also returns
+	// the SHA-256 hash of the patched data, to patch from next time. It
+	// returns ErrNoPatch if it has none, to fetch the data in full.
+	FetchPatch(ifNewerThan time.Time, base []byte) (patch io.ReadCloser, target []byte, err error)
+}
+
+// PatchSink is optionally implemented by a Sink which can apply a patch from
+// a PatchingSource to the data it last got. If applying the patch fails for
+// any of the sinks, the data is fetched in full and written to all of them.
+type PatchSink interface {
+	Sink
+	// ApplyPatch applies the patch and writes the patched data, but fails
+	// without writing it if its SHA-256 hash is not target, e.g. as the patch
+	// doesn't fit the data the sink has.
+	ApplyPatch(patch io.Reader, target []byte, md Metadata) error
+}
+
+type patchableSink struct {
+	ReadBackSink
+	apply func(base, patch []byte) ([]byte, error)
+}
+
+// ToPatchable wraps a sink which can read back its data, such as the file
+// sinks, to apply the patches from a PatchingSource to that data with apply
+// and write the result back in full. This saves transferring the data rather
+// than writing it.
+func ToPatchable(s ReadBackSink, apply func(base, patch []byte) ([]byte, error)) Sink {
+	return &patchableSink{s, apply}
+}
+
+// UpdateWithMetadata implements MetadataSink
+func (s *patchableSink) UpdateWithMetadata(r io.Reader, md Metadata) error {
+	return updateSink(context.Background(), s.ReadBackSink, r, md)
+}
+
+// ApplyPatch implements PatchSink
+func (s *patchableSink) ApplyPatch(patch io.Reader, target []byte, md Metadata) error {
+	rc, err := s.ReadBack(md)
+	if err != nil {
+		return err
+	}
+	base, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+	p, err := ioutil.ReadAll(patch)
+	if err != nil {
+		return err
+	}
+	data, err := s.apply(base, p)
+	if err != nil {
+		return fmt.Errorf("unable to apply patch: %v", err)
+	}
+	if hash := sha256.Sum256(data); !bytes.Equal(hash[:], target) {
+		return fmt.Errorf("patched data has hash %x rather than %x", hash, target)
+	}
+	return updateSink(context.Background(), s.ReadBackSink, bytes.NewReader(data), md)
+}
+
+// ReusableReader implements ReusableReaderSink
+func (s *patchableSink) ReusableReader() bool {
+	rs, ok := s.ReadBackSink.(ReusableReaderSink)
+	return ok && rs.ReusableReader()
+}
+
+// canPatch tells if the sinks can be updated by a patch.
+func (runner *Runner) canPatch() bool {
+	if runner.DryRun || runner.Validate != nil || runner.OnChange != nil || runner.RetainLast || len(runner.LastHash()) == 0 {
+		return false
+	}
+	for _, s := range runner.sinks {
+		if _, ok := unwrapRequired(s).(PatchSink); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// patch fetches a patch from the source and applies it to all of the sinks.
+func (runner *Runner) patch(ctx context.Context, from PatchingSource, l *loop) error {
+	start := runner.tickStart(l)
+	rc, target, err := from.FetchPatch(runner.lastUpdated, runner.LastHash())
+	runner.tickFetched(l, start)
+	if err != nil {
+		return err
+	}
+	defer drainAndClose(rc)
+	md := metadataOf(rc)
+	var r io.Reader = &contextReader{rc, ctx}
+	if l.result != nil {
+		r = io.TeeReader(r, (*byteCounter)(&l.result.Bytes))
+	}
+	patch, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	runner.deliverMx.Lock()
+	defer runner.deliverMx.Unlock()
+	defer runner.tickDelivered(l, runner.tickStart(l))
+	for _, s := range runner.sinks {
+		if err := unwrapRequired(s).(PatchSink).ApplyPatch(bytes.NewReader(patch), target, md); err != nil {
+			runner.logf("keepcurrent: unable to patch %v, fetching the data in full: %v", s, err)
+			return errPatchFailed
+		}
+	}
+	for _, s := range runner.sinks {
+		runner.sinkDone(l, s, nil)
+	}
+	runner.mx.Lock()
+	runner.lastHash = target
+	runner.mx.Unlock()
+	runner.setSynced(md)
+	return nil
+}
@@ -0,0 +1,80 @@
+package keepcurrent
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// pipe holds the latest data written to its sink for its source.
+type pipe struct {
+	mx      sync.RWMutex
+	data    []byte
+	md      Metadata
+	written time.Time
+}
+
+type pipeSink struct {
+	*pipe
+}
+
+type pipeSource struct {
+	*pipe
+}
+
+// Pipe constructs a linked pair of a sink and a source, so that the data
+// written to the sink by one runner is fetched from the source by another in
+// the same process, e.g. to chain stages of fetching, transforming and
+// redistributing the data. Only the latest data is kept, so memory use is
+// bounded by its size no matter how far the reading runner lags. The source
+// is modified once written to since ifNewerThan, and unmodified until the
+// first write.
+func Pipe() (Sink, Source) {
+	p := &pipe{}
+	return &pipeSink{p}, &pipeSource{p}
+}
+
+func (s *pipeSink) UpdateFrom(r io.Reader) error {
+	return s.UpdateWithMetadata(r, Metadata{})
+}
+
+// UpdateWithMetadata implements MetadataSink
+func (s *pipeSink) UpdateWithMetadata(r io.Reader, md Metadata) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.mx.Lock()
+	s.data, s.md, s.written = data, md, time.Now()
+	s.mx.Unlock()
+	return nil
+}
+
+// ReusableReader implements ReusableReaderSink
+func (s *pipeSink) ReusableReader() bool {
+	return true
+}
+
+func (s *pipeSink) String() string {
+	return fmt.Sprintf("in-memory pipe %p", s.pipe)
+}
+
+func (s *pipeSource) Fetch(ifNewerThan time.Time) (io.ReadCloser, error) {
+	s.mx.RLock()
+	data, md, written := s.data, s.md, s.written
+	s.mx.RUnlock()
+	if written.IsZero() || !ifNewerThan.IsZero() && !written.After(ifNewerThan) {
+		return nil, ErrUnmodified
+	}
+	// The data is replaced rather than modified by the sink, so it can be
+	// read without holding the lock.
+	return withMetadata(ioutil.NopCloser(bytes.NewReader(data)), md), nil
+}
+
+// Describe implements DescribedSource
+func (s *pipeSource) Describe() string {
+	return fmt.Sprintf("in-memory pipe %p", s.pipe)
+}
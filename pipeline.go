@@ -0,0 +1,144 @@
+package keepcurrent
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrTransformInputTooLarge is returned by sinks wrapped with WithTransform
+// when the data is larger than the cap on it.
+var ErrTransformInputTooLarge = errors.New("data too large to transform")
+
+type pipelineSink struct {
+	to         Sink
+	transforms []func(io.Reader) (io.Reader, error)
+}
+
+// SinkPipeline constructs a sink which passes the data through the transforms
+// in order before writing it to the terminal sink, e.g. to compress then
+// encrypt the data before writing it to a file. Each transform gets the reader
+// returned by the previous one.
+//
+// A transform which returns a reader that computes the output as it's read,
+// like GzipTransform, streams the data. A transform which needs the whole
+// input, e.g. to encrypt with an AEAD, has to read it all before returning
+// and so buffers the data in memory. If a returned reader is also an
+// io.Closer, it's closed once the terminal sink returns, so that any
+// goroutine feeding it can quit.
+func SinkPipeline(to Sink, transforms ...func(io.Reader) (io.Reader, error)) Sink {
+	return &pipelineSink{to, transforms}
+}
+
+func (s *pipelineSink) UpdateFrom(r io.Reader) error {
+	return s.UpdateWithMetadata(r, Metadata{})
+}
+
+// UpdateWithMetadata implements MetadataSink
+func (s *pipelineSink) UpdateWithMetadata(r io.Reader, md Metadata) error {
+	for _, transform := range s.transforms {
+		var err error
+		r, err = transform(r)
+		if c, ok := r.(io.Closer); ok {
+			defer c.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return updateSink(context.Background(), s.to, r, md)
+}
+
+func (s *pipelineSink) String() string {
+	return fmt.Sprintf("pipeline to %v", s.to)
+}
+
+type transformedSink struct {
+	inner     Sink
+	transform func(io.Reader) (io.Reader, error)
+	maxInput  int64
+}
+
+// WithTransform makes a sink get the data passed through the transform, the
+// same way as SinkPipeline, so that the sinks of one runner can each get the
+// data in their own format, e.g. one gzipped with GzipTransform and one plain.
+// The metadata is passed on as is.
+//
+// The runner streams the data to such a sink through a pipe of its own, as
+// the transform gets a reader it must only read sequentially and not use once
+// it has written to the sink, so the runner doesn't keep a copy of the data
+// for it. A transform which needs the whole input, however, buffers it in
+// memory by itself. maxInput caps how much of the data the transform may
+// read, failing the write with ErrTransformInputTooLarge beyond that, so as to
+// bound the memory it takes. Zero means no cap.
+func WithTransform(maxInput int64, transform func(io.Reader) (io.Reader, error)) SinkMiddleware {
+	return func(s Sink) Sink {
+		return &transformedSink{s, transform, maxInput}
+	}
+}
+
+func (s *transformedSink) UpdateFrom(r io.Reader) error {
+	return s.UpdateWithMetadata(r, Metadata{})
+}
+
+// UpdateWithMetadata implements MetadataSink
+func (s *transformedSink) UpdateWithMetadata(r io.Reader, md Metadata) error {
+	if s.maxInput > 0 {
+		r = &cappedReader{r, s.maxInput}
+	}
+	r, err := s.transform(r)
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+	if err != nil {
+		return err
+	}
+	return updateSink(context.Background(), s.inner, r, md)
+}
+
+// ReusableReader implements ReusableReaderSink
+func (s *transformedSink) ReusableReader() bool {
+	return true
+}
+
+func (s *transformedSink) String() string {
+	return fmt.Sprintf("transformed %v", s.inner)
+}
+
+// cappedReader fails with ErrTransformInputTooLarge once more than remaining
+// bytes are read.
+type cappedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > c.remaining+1 {
+		p = p[:c.remaining+1]
+	}
+	n, err := c.r.Read(p)
+	if int64(n) > c.remaining {
+		n = int(c.remaining)
+		c.remaining = 0
+		return n, ErrTransformInputTooLarge
+	}
+	c.remaining -= int64(n)
+	return n, err
+}
+
+// GzipTransform is a transform for SinkPipeline which compresses the data with
+// gzip as it's read.
+func GzipTransform(r io.Reader) (io.Reader, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		gzw := gzip.NewWriter(pw)
+		_, err := io.Copy(gzw, r)
+		if err == nil {
+			err = gzw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
@@ -0,0 +1,41 @@
+package keepcurrent
+
+import (
+	"io"
+	"time"
+)
+
+const (
+	// progressBytes and progressInterval are how often OnProgress is called,
+	// whichever comes first.
+	progressBytes    = 1 << 20
+	progressInterval = time.Second
+)
+
+// progressReader counts the bytes read through it and reports the count to
+// onProgress every progressBytes or progressInterval, and once more at EOF.
+type progressReader struct {
+	r            io.Reader
+	clock        Clock
+	onProgress   func(bytesSoFar int64)
+	n            int64
+	lastN        int64
+	lastReported time.Time
+}
+
+func newProgressReader(r io.Reader, clock Clock, onProgress func(bytesSoFar int64)) *progressReader {
+	return &progressReader{r: r, clock: clock, onProgress: onProgress, lastReported: clock.Now()}
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	pr.n += int64(n)
+	if pr.n == pr.lastN {
+		return n, err
+	}
+	if now := pr.clock.Now(); err == io.EOF || pr.n-pr.lastN >= progressBytes || now.Sub(pr.lastReported) >= progressInterval {
+		pr.lastN, pr.lastReported = pr.n, now
+		pr.onProgress(pr.n)
+	}
+	return n, err
+}
@@ -0,0 +1,129 @@
+package keepcurrent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+type rateLimitedSink struct {
+	inner       Sink
+	minInterval time.Duration
+
+	mx        sync.Mutex
+	lastWrite time.Time
+	pending   []byte
+	md        Metadata
+	timer     *time.Timer
+	writeErr  error
+}
+
+// RateLimitSink makes a sink be written at most once per minInterval, e.g.
+// when every write triggers an expensive reload downstream, so that the
+// source can be polled more often than the sink is written. An update coming
+// within minInterval of the last write is held back, and the latest of such
+// updates is written once minInterval has elapsed, so the intermediate
+// versions are skipped. An error writing the held back data is returned by the
+// next call to UpdateFrom. The held back data is written right away when the
+// runner stops, see FlushingSink.
+//
+// It doesn't compare the data with what was last written, which is the job of
+// the runner's change detection upstream, so it only ever delays writes and
+// never suppresses the latest data.
+func RateLimitSink(minInterval time.Duration) SinkMiddleware {
+	return func(inner Sink) Sink {
+		return &rateLimitedSink{inner: inner, minInterval: minInterval}
+	}
+}
+
+func (s *rateLimitedSink) UpdateFrom(r io.Reader) error {
+	return s.UpdateWithMetadata(r, Metadata{})
+}
+
+// UpdateWithMetadata implements MetadataSink
+func (s *rateLimitedSink) UpdateWithMetadata(r io.Reader, md Metadata) error {
+	return s.update(context.Background(), r, md)
+}
+
+// UpdateFromContext implements ContextSink, passing the context on to the
+// sink if the data is written right away. Held back data is written later,
+// after the sync is over, so without it.
+func (s *rateLimitedSink) UpdateFromContext(ctx context.Context, r io.Reader) error {
+	return s.update(ctx, r, MetadataFromContext(ctx))
+}
+
+func (s *rateLimitedSink) update(ctx context.Context, r io.Reader, md Metadata) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	err, s.writeErr = s.writeErr, nil
+	wait := s.minInterval - time.Since(s.lastWrite)
+	if s.lastWrite.IsZero() || wait <= 0 {
+		if s.timer != nil {
+			s.timer.Stop()
+			s.timer = nil
+		}
+		s.pending = nil
+		if err := s.writeLocked(ctx, data, md); err != nil {
+			return err
+		}
+	} else {
+		s.pending, s.md = data, md
+		if s.timer == nil {
+			s.timer = time.AfterFunc(wait, s.onCooldown)
+		}
+	}
+	return err
+}
+
+func (s *rateLimitedSink) onCooldown() {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.timer = nil
+	if s.pending == nil {
+		return
+	}
+	data := s.pending
+	s.pending = nil
+	s.writeErr = s.writeLocked(context.Background(), data, s.md)
+}
+
+func (s *rateLimitedSink) writeLocked(ctx context.Context, data []byte, md Metadata) error {
+	s.lastWrite = time.Now()
+	return updateSink(ctx, s.inner, bytes.NewReader(data), md)
+}
+
+// Flush implements FlushingSink, writing the held back data right away, so
+// that the latest data isn't lost when the runner stops.
+func (s *rateLimitedSink) Flush() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	err := s.writeErr
+	s.writeErr = nil
+	if s.pending == nil {
+		return err
+	}
+	data := s.pending
+	s.pending = nil
+	return s.writeLocked(context.Background(), data, s.md)
+}
+
+// ReusableReader implements ReusableReaderSink
+func (s *rateLimitedSink) ReusableReader() bool {
+	return true
+}
+
+func (s *rateLimitedSink) String() string {
+	return fmt.Sprintf("rate limited %v", s.inner)
+}
@@ -0,0 +1,42 @@
+package keepcurrent
+
+import (
+	"errors"
+)
+
+// errRequiredSinkFailed is returned internally when writing to a sink marked
+// by Required fails.
+var errRequiredSinkFailed = errors.New("required sink failed")
+
+type requiredSink struct {
+	Sink
+}
+
+// Required marks a sink as critical for the sync, e.g. the primary config
+// file as opposed to a cache. If writing to a required sink fails, the sync as
+// a whole is considered failed: the reported SinkError has Required set, and
+// the runner doesn't advance the time it last synced, so the next tick fetches
+// the data again and writes it to all of the sinks. A failure of any other sink
+// is reported but doesn't hold back the sync, unless all of the sinks fail.
+func Required(s Sink) Sink {
+	return &requiredSink{s}
+}
+
+// ReusableReader implements ReusableReaderSink
+func (s *requiredSink) ReusableReader() bool {
+	rs, ok := s.Sink.(ReusableReaderSink)
+	return ok && rs.ReusableReader()
+}
+
+// unwrapRequired returns the sink marked by Required, or s as is.
+func unwrapRequired(s Sink) Sink {
+	if rs, ok := s.(*requiredSink); ok {
+		return rs.Sink
+	}
+	return s
+}
+
+func isRequired(s Sink) bool {
+	_, ok := s.(*requiredSink)
+	return ok
+}
@@ -0,0 +1,81 @@
+package keepcurrent
+
+import (
+	"context"
+	"time"
+)
+
+// StartOption configures the schedule of the loop started by
+// StartWithOptions.
+type StartOption func(*schedule)
+
+// schedule is when the loop syncs.
+type schedule struct {
+	interval     time.Duration
+	jitter       time.Duration
+	initialDelay time.Duration
+	immediate    bool
+}
+
+// WithInterval sets the interval between syncs. It's required.
+func WithInterval(interval time.Duration) StartOption {
+	return func(s *schedule) {
+		s.interval = interval
+	}
+}
+
+// WithJitter lengthens every wait between syncs by a random duration of up
+// to jitter, so that processes started together don't poll in lockstep.
+func WithJitter(jitter time.Duration) StartOption {
+	return func(s *schedule) {
+		s.jitter = jitter
+	}
+}
+
+// WithInitialDelay delays the first sync by delay, e.g. to let the rest of
+// the process start up first.
+func WithInitialDelay(delay time.Duration) StartOption {
+	return func(s *schedule) {
+		s.initialDelay = delay
+	}
+}
+
+// WithImmediate tells whether to sync right away, the default, or only once
+// the first interval has passed, e.g. when the data was just loaded with
+// InitFrom. Any initial delay comes on top of the interval.
+func WithImmediate(immediate bool) StartOption {
+	return func(s *schedule) {
+		s.immediate = immediate
+	}
+}
+
+// StartWithOptions is the same as Start but with the schedule configured by
+// the options, WithInterval being required.
+func (runner *Runner) StartWithOptions(opts ...StartOption) func() {
+	sched := schedule{immediate: true}
+	for _, opt := range opts {
+		opt(&sched)
+	}
+	if err := runner.checkStart(sched); err != nil {
+		runner.logf("keepcurrent: not starting runner: %v", err)
+		return func() {}
+	}
+	return runner.start(context.Background(), sched, nil, nil)
+}
+
+// firstWait returns how long to wait before the first sync.
+func (s schedule) firstWait() time.Duration {
+	wait := s.initialDelay
+	if !s.immediate {
+		wait += s.interval
+	}
+	return wait
+}
+
+// jittered lengthens d by the jitter, if any.
+func (s schedule) jittered(d time.Duration) time.Duration {
+	if s.jitter <= 0 {
+		return d
+	}
+	return d + time.Duration(jitterRand.Float64()*float64(s.jitter))
+}
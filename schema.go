@@ -0,0 +1,70 @@
+package keepcurrent
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+type jsonSchemaSource struct {
+	s      Source
+	schema *gojsonschema.Schema
+	err    error
+}
+
+// WithJSONSchema makes a source validate the fetched data against the given
+// JSON Schema. The data is buffered in memory to be validated, and any
+// mismatch is returned as an error describing the violations, so that
+// OnSourceError is called and the sinks are left untouched. An invalid schema
+// makes every fetch fail.
+func WithJSONSchema(schema []byte) SourceMiddleware {
+	compiled, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(schema))
+	if err != nil {
+		err = fmt.Errorf("invalid JSON schema: %v", err)
+	}
+	return func(s Source) Source {
+		return &jsonSchemaSource{s, compiled, err}
+	}
+}
+
+func (s *jsonSchemaSource) Fetch(ifNewerThan time.Time) (io.ReadCloser, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	rc, err := s.s.Fetch(ifNewerThan)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	result, err := s.schema.Validate(gojsonschema.NewBytesLoader(data))
+	if err != nil {
+		return nil, fmt.Errorf("unable to validate against JSON schema: %v", err)
+	}
+	if !result.Valid() {
+		violations := make([]string, 0, len(result.Errors()))
+		for _, e := range result.Errors() {
+			violations = append(violations, e.String())
+		}
+		return nil, fmt.Errorf("data doesn't match JSON schema: %v", strings.Join(violations, "; "))
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Describe implements DescribedSource
+func (s *jsonSchemaSource) Describe() string {
+	return describe(s.s) + " validated by JSON schema"
+}
+
+// ResetConditions implements ResettableSource
+func (s *jsonSchemaSource) ResetConditions() {
+	resetConditions(s.s)
+}
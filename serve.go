@@ -0,0 +1,89 @@
+package keepcurrent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type serveSink struct {
+	addr string
+
+	mx          sync.RWMutex
+	data        []byte
+	etag        string
+	modTime     time.Time
+	contentType string
+}
+
+// ToServe constructs a sink which serves the latest data over HTTP at addr,
+// e.g. for downstream processes to sync from via FromWeb, turning the runner
+// into a caching redistributor. The data is served at any path with an ETag
+// and a Last-Modified, which is the modification time at the source if known
+// or else the time of the update, so that conditional requests get a 304 when
+// the data is unchanged. Until the first update, requests get a 503.
+//
+// The listener is opened before ToServe returns, so an error listening is
+// returned right away. Call the returned function to stop serving.
+func ToServe(addr string) (Sink, func(), error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	s := &serveSink{addr: l.Addr().String()}
+	server := &http.Server{Handler: s}
+	go server.Serve(l)
+	return s, func() { server.Close() }, nil
+}
+
+func (s *serveSink) UpdateFrom(r io.Reader) error {
+	return s.UpdateWithMetadata(r, Metadata{})
+}
+
+// UpdateWithMetadata implements MetadataSink
+func (s *serveSink) UpdateWithMetadata(r io.Reader, md Metadata) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(data)
+	modTime := md.ModTime
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+	s.mx.Lock()
+	s.data, s.etag, s.modTime, s.contentType = data, `"`+hex.EncodeToString(hash[:16])+`"`, modTime, md.ContentType
+	s.mx.Unlock()
+	return nil
+}
+
+func (s *serveSink) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mx.RLock()
+	data, etag, modTime, contentType := s.data, s.etag, s.modTime, s.contentType
+	s.mx.RUnlock()
+	if data == nil {
+		http.Error(w, "no data yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	// ServeContent handles the conditional and range requests
+	http.ServeContent(w, req, "", modTime, bytes.NewReader(data))
+}
+
+// ReusableReader implements ReusableReaderSink
+func (s *serveSink) ReusableReader() bool {
+	return true
+}
+
+func (s *serveSink) String() string {
+	return "HTTP server at " + s.addr
+}
@@ -1,29 +1,97 @@
 package keepcurrent
 
 import (
+	"context"
+	"crypto"
+	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
 type fileSink struct {
 	path         string
 	preprocessor func(io.Reader) (io.Reader, error)
+	keepModTime  bool
+	keepEncoding bool
+	checksum     crypto.Hash
+
+	mx sync.Mutex
+	// written is the modification time of the files last written, keyed by
+	// the absolute path, so that the runner can tell its own write to a file
+	// it also reads from a real change.
+	written map[string]time.Time
 }
 
 // ToFile constructs a sink from the given file path. Writing to the file while
 // reading from it (via FromFile) won't corrupt the file.
 func ToFile(path string) Sink {
-	return &fileSink{path, nil}
+	return &fileSink{path: path}
 }
 
 // ToFileWithPreprocessor constructs a sink from the given file path while modifying the data before writing to disk.
 func ToFileWithPreprocessor(path string, preprocessor func(io.Reader) (io.Reader, error)) Sink {
-	return &fileSink{path, preprocessor}
+	return &fileSink{path: path, preprocessor: preprocessor}
+}
+
+// ToFileKeepModTime is the same as ToFile but sets the modification time of
+// the file to that of the data at the source, if the source tells.
+func ToFileKeepModTime(path string) Sink {
+	return &fileSink{path: path, keepModTime: true}
+}
+
+// ToFileWithChecksum is the same as ToFile but also writes the checksum of the
+// data by the hash algorithm to a sidecar file, named after the path with the
+// algorithm as the extension, e.g. "config.json.sha256", in the format of
+// sha256sum and the like so that it can be checked with "sha256sum -c". The
+// sidecar is replaced atomically after the data, so it may briefly lag
+// behind the data but never runs ahead of it. The package of the algorithm
+// has to be linked in, e.g. by importing crypto/sha512 for crypto.SHA512,
+// except for crypto.SHA256 which is always available.
+func ToFileWithChecksum(path string, algo crypto.Hash) Sink {
+	return &fileSink{path: path, checksum: algo}
+}
+
+// encodingExtensions are the file extensions ToFileKeepEncoding uses for the
+// content encodings it knows.
+var encodingExtensions = map[string]string{
+	"gzip":     ".gz",
+	"x-gzip":   ".gz",
+	"br":       ".br",
+	"zstd":     ".zst",
+	"compress": ".Z",
+}
+
+// ToFileKeepEncoding is the same as ToFile but writes the data still in the
+// encoding it came in from the source, per Metadata.ContentEncoding, e.g. for
+// a caching proxy to serve the file with the right Content-Encoding. The file
+// is named after the path plus the usual extension for the encoding, e.g.
+// ".gz" for gzip. For an encoding without a known extension, the file is
+// written to the path itself and the encoding to a sidecar file named after
+// the path with an ".encoding" suffix, which is removed again once the data
+// comes unencoded. Once written, the files for the data in any other encoding
+// are removed, so that they're not served stale.
+func ToFileKeepEncoding(path string) Sink {
+	return &fileSink{path: path, keepEncoding: true}
 }
 
 func (s *fileSink) UpdateFrom(r io.Reader) error {
-	tmpFile, err := ioutil.TempFile("", "")
+	return s.UpdateWithMetadata(r, Metadata{})
+}
+
+// UpdateWithMetadata implements MetadataSink
+func (s *fileSink) UpdateWithMetadata(r io.Reader, md Metadata) error {
+	path, sidecar := s.target(md)
+	// The data is written to a temporary file next to the target and renamed
+	// over it only once written in full, so that a failed write, e.g. with the
+	// disk full, leaves the previous file intact, and so that the rename is
+	// atomic as it's within the same file system.
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+"-")
 	if err != nil {
 		return err
 	}
@@ -46,7 +114,16 @@ func (s *fileSink) UpdateFrom(r io.Reader) error {
 			return err
 		}
 	}
-	_, err = io.Copy(tmpFile, r)
+	var w io.Writer = tmpFile
+	var hasher hash.Hash
+	if s.checksum != 0 {
+		if !s.checksum.Available() {
+			return fmt.Errorf("hash algorithm %v is not available", s.checksum)
+		}
+		hasher = s.checksum.New()
+		w = io.MultiWriter(tmpFile, hasher)
+	}
+	_, err = io.Copy(w, r)
 	if err != nil {
 		return err
 	}
@@ -56,11 +133,167 @@ func (s *fileSink) UpdateFrom(r io.Reader) error {
 		return err
 	}
 
-	return os.Rename(tmpFile.Name(), s.path)
+	if s.keepModTime && !md.ModTime.IsZero() {
+		err = os.Chtimes(tmpFile.Name(), md.ModTime, md.ModTime)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.Rename(tmpFile.Name(), path)
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(path); err == nil {
+		s.mx.Lock()
+		if s.written == nil {
+			s.written = make(map[string]time.Time)
+		}
+		s.written[absPath(path)] = fi.ModTime()
+		s.mx.Unlock()
+	}
+	if s.keepEncoding {
+		if err := s.removeOtherEncodings(path); err != nil {
+			return err
+		}
+		return s.writeEncodingSidecar(sidecar)
+	}
+	if hasher != nil {
+		sum := fmt.Sprintf("%x  %s\n", hasher.Sum(nil), filepath.Base(path))
+		return writeFileAtomically(path+"."+checksumExtension(s.checksum), []byte(sum))
+	}
+	return nil
+}
+
+// target returns the path to write the data with the metadata to, and the
+// encoding to record in the sidecar, if any.
+func (s *fileSink) target(md Metadata) (path, sidecar string) {
+	path = s.path
+	if s.keepEncoding && md.ContentEncoding != "" {
+		if ext, found := encodingExtensions[md.ContentEncoding]; found {
+			path += ext
+		} else {
+			sidecar = md.ContentEncoding
+		}
+	}
+	return path, sidecar
+}
+
+// wrote tells if the file at the path was last written by the sink, as it
+// still has the modification time it had after the write.
+func (s *fileSink) wrote(path string, modTime time.Time) bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	t, found := s.written[absPath(path)]
+	return found && t.Equal(modTime)
+}
+
+// ReadBack implements ReadBackSink. The data of a sink with a preprocessor
+// can't be read back as it's not what was given to UpdateFrom.
+func (s *fileSink) ReadBack(md Metadata) (io.ReadCloser, error) {
+	if s.preprocessor != nil {
+		return nil, fmt.Errorf("can't read back the preprocessed data of %v", s)
+	}
+	path, _ := s.target(md)
+	return os.Open(path)
+}
+
+// checksumExtension returns the extension of the checksum sidecar for the
+// hash algorithm, e.g. "sha256" for crypto.SHA256.
+func checksumExtension(algo crypto.Hash) string {
+	return strings.NewReplacer("-", "", "/", "_").Replace(strings.ToLower(algo.String()))
+}
+
+// writeFileAtomically writes the data to a temporary file next to the path
+// and renames it over the path.
+func writeFileAtomically(path string, data []byte) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(data)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), path)
+}
+
+// writeEncodingSidecar records the encoding of the file at the path, or
+// removes the record if the encoding is empty.
+func (s *fileSink) writeEncodingSidecar(encoding string) error {
+	sidecarPath := s.path + ".encoding"
+	if encoding == "" {
+		if err := os.Remove(sidecarPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return writeFileAtomically(sidecarPath, []byte(encoding))
+}
+
+// removeOtherEncodings removes the files written for the data in encodings
+// other than that of the file just written at the path, so that they're not
+// served stale.
+func (s *fileSink) removeOtherEncodings(path string) error {
+	others := []string{s.path}
+	for _, ext := range encodingExtensions {
+		others = append(others, s.path+ext)
+	}
+	for _, other := range others {
+		if other == path {
+			continue
+		}
+		if err := os.Remove(other); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReusableReader implements ReusableReaderSink
+func (s *fileSink) ReusableReader() bool {
+	return true
 }
 
 func (s *fileSink) String() string {
-	return "file sink to " + s.path
+	return "file sink to " + absPath(s.path)
+}
+
+type appendFileSink struct {
+	path string
+}
+
+// ToFileAppend constructs a sink which appends the data to the given file,
+// creating it if necessary, instead of replacing the file content. It's only
+// appended to when the runner sees the source as modified, so with a source
+// that can't tell, the same data may be appended repeatedly.
+func ToFileAppend(path string) Sink {
+	return &appendFileSink{path}
+}
+
+func (s *appendFileSink) UpdateFrom(r io.Reader) error {
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// ReusableReader implements ReusableReaderSink
+func (s *appendFileSink) ReusableReader() bool {
+	return true
+}
+
+func (s *appendFileSink) String() string {
+	return "append file sink to " + absPath(s.path)
 }
 
 type byteChannel struct {
@@ -81,6 +314,175 @@ func (s *byteChannel) UpdateFrom(r io.Reader) error {
 	return nil
 }
 
+// ReusableReader implements ReusableReaderSink
+func (s *byteChannel) ReusableReader() bool {
+	return true
+}
+
 func (s *byteChannel) String() string {
-	return "byte channel"
+	return fmt.Sprintf("byte channel %p", s.ch)
+}
+
+type contextByteChannel struct {
+	byteChannel
+	ctx context.Context
+}
+
+// ToChannelContext is the same as ToChannel but gives up sending the data
+// with the context's error once ctx is done, or the runner's loop is stopped,
+// rather than blocking forever if nobody receives from the channel.
+func ToChannelContext(ctx context.Context, ch chan []byte) Sink {
+	return &contextByteChannel{byteChannel{ch}, ctx}
+}
+
+func (s *contextByteChannel) UpdateFrom(r io.Reader) error {
+	return s.UpdateFromContext(context.Background(), r)
+}
+
+// UpdateFromContext implements ContextSink
+func (s *contextByteChannel) UpdateFromContext(ctx context.Context, r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	select {
+	case s.ch <- b:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type readerChannel struct {
+	ch chan io.ReadCloser
+}
+
+// ToReaderChannel constructs a sink which sends a reader over the data to the
+// given channel, for the receiver to read the data as it streams in rather
+// than have it buffered in memory in full, as ToChannel does. The receiver
+// must close the reader once done with it, as the write to the sink only
+// completes then, failing with any error reading from the source. Reading
+// the reader once the runner's loop is stopped fails with io.ErrClosedPipe.
+// As the data is streamed, a slow receiver slows down the other streaming
+// sinks too.
+func ToReaderChannel(ch chan io.ReadCloser) Sink {
+	return &readerChannel{ch}
+}
+
+func (s *readerChannel) UpdateFrom(r io.Reader) error {
+	return s.UpdateFromContext(context.Background(), r)
+}
+
+// UpdateFromContext implements ContextSink
+func (s *readerChannel) UpdateFromContext(ctx context.Context, r io.Reader) error {
+	cr := &channelReader{r: r, closed: make(chan struct{})}
+	select {
+	case s.ch <- cr:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-cr.closed:
+	case <-ctx.Done():
+		cr.Close()
+		return ctx.Err()
+	}
+	cr.mx.Lock()
+	defer cr.mx.Unlock()
+	return cr.err
+}
+
+// ReusableReader implements ReusableReaderSink
+func (s *readerChannel) ReusableReader() bool {
+	return true
+}
+
+func (s *readerChannel) String() string {
+	return fmt.Sprintf("reader channel %p", s.ch)
+}
+
+// channelReader is the reader sent by ToReaderChannel, which stops reading
+// from the underlying reader once closed, as it's only valid until then.
+type channelReader struct {
+	r      io.Reader
+	closed chan struct{}
+
+	mx        sync.Mutex
+	err       error
+	done      bool
+	closeOnce sync.Once
+}
+
+func (cr *channelReader) Read(p []byte) (int, error) {
+	cr.mx.Lock()
+	done := cr.done
+	cr.mx.Unlock()
+	if done {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := cr.r.Read(p)
+	if err != nil && err != io.EOF {
+		cr.mx.Lock()
+		cr.err = err
+		cr.mx.Unlock()
+	}
+	return n, err
+}
+
+func (cr *channelReader) Close() error {
+	cr.closeOnce.Do(func() {
+		cr.mx.Lock()
+		cr.done = true
+		cr.mx.Unlock()
+		close(cr.closed)
+	})
+	return nil
+}
+
+// absPath returns the absolute form of the path for sinks to describe
+// themselves unambiguously, or the path as is if that fails.
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+type writerSink struct {
+	w    io.Writer
+	name string
+}
+
+// ToWriter constructs a sink which writes the data to w as is, e.g. to a
+// network connection. As w is shared by all updates, it's up to the consumer
+// to tell them apart. A read error midway leaves a partial update written.
+func ToWriter(w io.Writer) Sink {
+	return &writerSink{w, fmt.Sprintf("writer %T", w)}
+}
+
+// ToStdout is the same as ToWriter(os.Stdout), e.g. for a tool which prints
+// the data as it changes, or together with FromStdin, filters it.
+func ToStdout() Sink {
+	return &writerSink{os.Stdout, "stdout"}
+}
+
+func (s *writerSink) UpdateFrom(r io.Reader) error {
+	_, err := io.Copy(s.w, r)
+	return err
+}
+
+// Writer implements WriterSink
+func (s *writerSink) Writer() io.Writer {
+	return s.w
+}
+
+// ReusableReader implements ReusableReaderSink
+func (s *writerSink) ReusableReader() bool {
+	return true
+}
+
+func (s *writerSink) String() string {
+	return s.name
 }
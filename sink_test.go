@@ -0,0 +1,816 @@
+package keepcurrent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToSymlinkSwap(t *testing.T) {
+	parent, err := ioutil.TempDir("", "keep_current_test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(parent)
+	link := filepath.Join(parent, "current")
+	extract := func(r io.Reader, dir string) error {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(dir, "config"), b, 0644)
+	}
+	s := ToSymlinkSwap(link, extract)
+
+	assert.NoError(t, s.UpdateFrom(strings.NewReader("first")))
+	first, err := os.Readlink(link)
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile(filepath.Join(link, "config"))
+	assert.NoError(t, err)
+	assert.Equal(t, "first", string(b))
+
+	assert.NoError(t, s.UpdateFrom(strings.NewReader("second")))
+	second, err := os.Readlink(link)
+	assert.NoError(t, err)
+	assert.NotEqual(t, first, second)
+	b, err = ioutil.ReadFile(filepath.Join(link, "config"))
+	assert.NoError(t, err)
+	assert.Equal(t, "second", string(b))
+	_, err = os.Stat(filepath.Join(parent, first))
+	assert.True(t, os.IsNotExist(err), "previous directory should have been removed")
+
+	failing := ToSymlinkSwap(link, func(r io.Reader, dir string) error { return io.ErrUnexpectedEOF })
+	assert.Equal(t, io.ErrUnexpectedEOF, failing.UpdateFrom(strings.NewReader("third")))
+	current, _ := os.Readlink(link)
+	assert.Equal(t, second, current, "failed extraction should leave the link alone")
+	entries, _ := ioutil.ReadDir(parent)
+	assert.Len(t, entries, 2, "only the link and its target should remain")
+}
+
+func TestToFileAppend(t *testing.T) {
+	name, _ := writeTempFile(t, []byte("first\n"))
+	defer os.Remove(name)
+	s := ToFileAppend(name)
+	assert.NoError(t, s.UpdateFrom(strings.NewReader("second\n")))
+	assert.NoError(t, s.UpdateFrom(strings.NewReader("third\n")))
+	b, err := ioutil.ReadFile(name)
+	assert.NoError(t, err)
+	assert.Equal(t, "first\nsecond\nthird\n", string(b))
+}
+
+func TestToBatched(t *testing.T) {
+	inner := &recordingSink{}
+	s := ToBatched(3, 0)(inner)
+	for _, data := range []string{"1", "2", "3", "4"} {
+		assert.NoError(t, s.UpdateFrom(strings.NewReader(data)))
+	}
+	assert.Equal(t, [][]byte{[]byte("3")}, inner.received, "should forward the latest of every 3 updates")
+
+	ch := make(chan []byte, 10)
+	s = ToBatched(3, 20*time.Millisecond)(ToChannel(ch))
+	assert.NoError(t, s.UpdateFrom(strings.NewReader("1")))
+	assert.NoError(t, s.UpdateFrom(strings.NewReader("2")))
+	assert.Len(t, ch, 0)
+	select {
+	case b := <-ch:
+		assert.Equal(t, "2", string(b))
+	case <-time.After(time.Second):
+		assert.Fail(t, "should forward after max wait")
+	}
+	assert.Equal(t, "batched "+ToChannel(ch).String(), s.String())
+
+	dir, err := ioutil.TempDir("", "keep_current_test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "data")
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	s = ToBatched(1, 0)(ToFileKeepModTime(path))
+	assert.NoError(t, s.(MetadataSink).UpdateWithMetadata(strings.NewReader("data"), Metadata{ModTime: modTime}))
+	if fi, err := os.Stat(path); assert.NoError(t, err) {
+		assert.True(t, modTime.Equal(fi.ModTime()), "should forward the metadata")
+	}
+}
+
+func TestToFileKeepModTime(t *testing.T) {
+	src, _ := writeTempFile(t, []byte("data"))
+	defer os.Remove(src)
+	modTime := time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+	assert.NoError(t, os.Chtimes(src, modTime, modTime))
+	dst := src + ".copy"
+	defer os.Remove(dst)
+
+	runner := New(FromFile(src), ToFileKeepModTime(dst))
+	runner.InitFrom(runner.source)
+	fi, err := os.Stat(dst)
+	if assert.NoError(t, err) {
+		assert.True(t, modTime.Equal(fi.ModTime()), "expected mod time %v, got %v", modTime, fi.ModTime())
+	}
+}
+
+func TestToFilePartialWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keep_current_test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "data")
+	sink := ToFile(path)
+	assert.NoError(t, sink.UpdateFrom(strings.NewReader("good")))
+
+	failing := io.MultiReader(strings.NewReader("partial"), &erroringReader{errors.New("disk full")})
+	assert.Error(t, sink.UpdateFrom(failing))
+	b, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "good", string(b), "failed write should leave the previous file intact")
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 1, "temporary file should be removed")
+}
+
+type erroringReader struct {
+	err error
+}
+
+func (r *erroringReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func TestToFileWithChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keep_current_test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	assert.NoError(t, ToFileWithChecksum(path, crypto.SHA256).UpdateFrom(strings.NewReader("data")))
+	b, _ := ioutil.ReadFile(path)
+	assert.Equal(t, "data", string(b))
+	sum, _ := ioutil.ReadFile(path + ".sha256")
+	assert.Equal(t, "3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7  config.json\n", string(sum))
+
+	assert.Equal(t, "sha512_256", checksumExtension(crypto.SHA512_256))
+	assert.Error(t, ToFileWithChecksum(path, crypto.Hash(999)).UpdateFrom(strings.NewReader("data")), "unavailable algorithm should fail")
+	b, _ = ioutil.ReadFile(path)
+	assert.Equal(t, "data", string(b))
+}
+
+func TestToFileKeepEncoding(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keep_current_test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	var compressed bytes.Buffer
+	gzw := gzip.NewWriter(&compressed)
+	gzw.Write([]byte("data"))
+	gzw.Close()
+	encoding := "gzip"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if encoding == "" {
+			io.WriteString(w, "data")
+			return
+		}
+		w.Header().Set("Content-Encoding", encoding)
+		w.Write(compressed.Bytes())
+	}))
+	defer srv.Close()
+	path := filepath.Join(dir, "data")
+	sink := ToFileKeepEncoding(path)
+	s := FromWebWithOptions(srv.URL, WebOptions{Header: http.Header{"Accept-Encoding": {"gzip"}}})
+	runner := New(s, sink)
+
+	runner.InitFrom(s)
+	b, err := ioutil.ReadFile(path + ".gz")
+	assert.NoError(t, err)
+	assert.Equal(t, compressed.Bytes(), b, "gzipped data should be written as is")
+
+	encoding = "x-custom"
+	runner.InitFrom(s)
+	b, _ = ioutil.ReadFile(path)
+	assert.Equal(t, compressed.Bytes(), b)
+	_, err = os.Stat(path + ".gz")
+	assert.True(t, os.IsNotExist(err), "file in the previous encoding should be removed")
+	b, _ = ioutil.ReadFile(path + ".encoding")
+	assert.Equal(t, "x-custom", string(b), "unknown encoding should be recorded in a sidecar")
+
+	encoding = ""
+	runner.InitFrom(s)
+	b, _ = ioutil.ReadFile(path)
+	assert.Equal(t, "data", string(b))
+	_, err = os.Stat(path + ".encoding")
+	assert.True(t, os.IsNotExist(err), "sidecar should be removed for unencoded data")
+
+	encoding = "gzip"
+	runner.InitFrom(s)
+	_, err = os.Stat(path + ".gz")
+	assert.NoError(t, err)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "unencoded file should be removed")
+}
+
+func TestToServe(t *testing.T) {
+	sink, stop, err := ToServe("127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer stop()
+	downstream := FromWeb("http://" + sink.(*serveSink).addr + "/config.json")
+	_, err = downstream.Fetch(time.Time{})
+	assert.Error(t, err, "should fail before the first update")
+
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	assert.NoError(t, updateSink(context.Background(), sink, strings.NewReader("v1"), Metadata{ModTime: modTime}))
+	rc, err := downstream.Fetch(time.Time{})
+	if assert.NoError(t, err) {
+		b, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		assert.Equal(t, "v1", string(b))
+		assert.True(t, modTime.Equal(metadataOf(rc).ModTime))
+	}
+	_, err = downstream.Fetch(time.Now())
+	assert.Equal(t, ErrUnmodified, err)
+
+	assert.NoError(t, sink.UpdateFrom(strings.NewReader("v2")))
+	rc, err = downstream.Fetch(modTime)
+	if assert.NoError(t, err) {
+		b, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		assert.Equal(t, "v2", string(b))
+	}
+}
+
+func TestPipe(t *testing.T) {
+	origin := &staticSource{data: "v1", lastModified: time.Now().Add(-time.Hour)}
+	sink, source := Pipe()
+	assert.Equal(t, sink.String(), describe(source))
+	final := &recordingSink{}
+	upstream, downstream := New(origin, sink), New(source, final)
+
+	downstream.InitFrom(source)
+	assert.Empty(t, final.received, "nothing to fetch before the first write")
+	upstream.InitFrom(origin)
+	downstream.InitFrom(source)
+	downstream.InitFrom(source)
+	if assert.Len(t, final.received, 1, "should be unmodified until written again") {
+		assert.Equal(t, "v1", string(final.received[0]))
+	}
+	assert.EqualValues(t, 2, downstream.UnmodifiedCount())
+
+	origin.data, origin.lastModified = "v2", time.Now().Add(time.Hour)
+	upstream.InitFrom(origin)
+	downstream.InitFrom(source)
+	if assert.Len(t, final.received, 2) {
+		assert.Equal(t, "v2", string(final.received[1]))
+	}
+}
+
+type failingWriter struct{}
+
+func (w failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func TestToWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keep_current_test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	s := &staticSource{data: strings.Repeat("data", 100000), lastModified: time.Now().Add(-time.Hour)}
+	var buf bytes.Buffer
+	path := filepath.Join(dir, "data")
+	failing := ToWriter(failingWriter{})
+	runner := New(s, ToWriter(&buf), failing, ToFile(path))
+	var sinkErr error
+	runner.OnSinkError = func(sink Sink, err error) {
+		sinkErr = err
+	}
+	runner.InitFrom(s)
+	assert.Equal(t, s.data, buf.String())
+	b, _ := ioutil.ReadFile(path)
+	assert.Equal(t, s.data, string(b), "failing writer should not affect the other sinks")
+	assert.EqualError(t, sinkErr, "broken pipe")
+	assert.Equal(t, "writer keepcurrent.failingWriter", failing.String())
+	assert.Equal(t, "stdout", ToStdout().String())
+}
+
+func TestSinkPipeline(t *testing.T) {
+	upper := func(r io.Reader) (io.Reader, error) {
+		b, err := ioutil.ReadAll(r)
+		return strings.NewReader(strings.ToUpper(string(b))), err
+	}
+	inner := &recordingSink{}
+	s := SinkPipeline(inner, upper, GzipTransform)
+	assert.NoError(t, s.UpdateFrom(strings.NewReader("abcde")))
+	if assert.Len(t, inner.received, 1) {
+		gzr, err := gzip.NewReader(bytes.NewReader(inner.received[0]))
+		if assert.NoError(t, err) {
+			b, _ := ioutil.ReadAll(gzr)
+			assert.Equal(t, "ABCDE", string(b))
+		}
+	}
+	assert.Equal(t, "pipeline to recording sink", s.String())
+
+	failing := func(r io.Reader) (io.Reader, error) {
+		return nil, errors.New("transform failed")
+	}
+	assert.EqualError(t, SinkPipeline(inner, GzipTransform, failing).UpdateFrom(strings.NewReader("abcde")), "transform failed")
+	assert.Len(t, inner.received, 1)
+}
+
+func TestWithTransform(t *testing.T) {
+	upper := func(r io.Reader) (io.Reader, error) {
+		b, err := ioutil.ReadAll(r)
+		return strings.NewReader(strings.ToUpper(string(b))), err
+	}
+	gzipped, plain, uppered, capped := &recordingSink{}, &recordingSink{}, &recordingSink{}, &recordingSink{}
+	s := &staticSource{data: "abcde"}
+	runner := New(s, WithTransform(0, GzipTransform)(gzipped), plain, WithTransform(5, upper)(uppered), WithTransform(4, upper)(capped))
+	var sinkErrs []error
+	runner.OnSinkError = func(sink Sink, err error) {
+		sinkErrs = append(sinkErrs, err)
+	}
+	runner.InitFrom(s)
+	if assert.Len(t, gzipped.received, 1) {
+		gzr, err := gzip.NewReader(bytes.NewReader(gzipped.received[0]))
+		if assert.NoError(t, err) {
+			b, _ := ioutil.ReadAll(gzr)
+			assert.Equal(t, "abcde", string(b))
+		}
+	}
+	assert.Equal(t, [][]byte{[]byte("abcde")}, plain.received)
+	assert.Equal(t, [][]byte{[]byte("ABCDE")}, uppered.received)
+	assert.Empty(t, capped.received)
+	assert.Equal(t, []error{ErrTransformInputTooLarge}, sinkErrs)
+	assert.Equal(t, "transformed recording sink", ChainSink(plain, WithTransform(0, upper)).String())
+}
+
+func TestWithinWindow(t *testing.T) {
+	var open int32
+	allowed := func(time.Time) bool { return atomic.LoadInt32(&open) == 1 }
+	inner := &recordingSink{}
+	s := WithinWindow(allowed)(inner)
+	assert.True(t, errors.Is(s.UpdateFrom(strings.NewReader("1")), ErrOutsideWindow))
+	atomic.StoreInt32(&open, 1)
+	assert.NoError(t, s.UpdateFrom(strings.NewReader("2")))
+	assert.Equal(t, [][]byte{[]byte("2")}, inner.received)
+
+	atomic.StoreInt32(&open, 0)
+	ch := make(chan []byte, 10)
+	s = WithinWindowDeferred(allowed, 5*time.Millisecond)(ToChannel(ch))
+	assert.Equal(t, ErrOutsideWindow, s.UpdateFrom(strings.NewReader("1")))
+	assert.Equal(t, ErrOutsideWindow, s.UpdateFrom(strings.NewReader("2")))
+	time.Sleep(20 * time.Millisecond)
+	assert.Empty(t, ch, "should not write while the window is closed")
+	atomic.StoreInt32(&open, 1)
+	select {
+	case b := <-ch:
+		assert.Equal(t, "2", string(b), "should write the latest deferred data")
+	case <-time.After(time.Second):
+		assert.Fail(t, "should write once the window reopens")
+	}
+	assert.NoError(t, s.UpdateFrom(strings.NewReader("3")))
+	assert.Equal(t, "3", string(<-ch))
+	assert.Empty(t, ch)
+
+	// A deferral is as good as a write, so the data is not fetched again
+	atomic.StoreInt32(&open, 0)
+	src := &staticSource{data: "4", lastModified: time.Now().Add(-time.Hour)}
+	runner := New(src, WithinWindowDeferred(allowed, time.Hour)(ToChannel(ch)))
+	assert.True(t, runner.Sync().Changed)
+	assert.True(t, runner.Sync().Unmodified, "should not fetch again while the window is closed")
+}
+
+func TestRateLimitSink(t *testing.T) {
+	ch := make(chan []byte, 10)
+	s := RateLimitSink(50 * time.Millisecond)(ToChannel(ch))
+	assert.NoError(t, s.UpdateFrom(strings.NewReader("1")))
+	assert.Equal(t, "1", string(<-ch), "first write should go through immediately")
+	assert.NoError(t, s.UpdateFrom(strings.NewReader("2")))
+	assert.NoError(t, s.UpdateFrom(strings.NewReader("3")))
+	assert.Empty(t, ch, "should hold back writes within the interval")
+	select {
+	case b := <-ch:
+		assert.Equal(t, "3", string(b), "should write the latest data after the interval")
+	case <-time.After(time.Second):
+		assert.Fail(t, "should write once the interval elapses")
+	}
+	time.Sleep(60 * time.Millisecond)
+	assert.Empty(t, ch, "should write the held back data only once")
+	assert.NoError(t, s.UpdateFrom(strings.NewReader("4")))
+	assert.Equal(t, "4", string(<-ch))
+
+	blocking := &blockingContextSink{chStarted: make(chan struct{})}
+	runner := New(&staticSource{data: "data"}, RateLimitSink(time.Minute)(blocking))
+	stop := runner.Start(time.Hour)
+	<-blocking.chStarted
+	stop()
+	assert.Equal(t, context.Canceled, blocking.err, "stopping the runner should cancel the write")
+}
+
+func TestToChannelContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &staticSource{data: "abcde"}
+	runner := New(s, ToChannelContext(ctx, make(chan []byte)))
+	chSinkErr := make(chan error, 1)
+	runner.OnSinkError = func(sink Sink, err error) {
+		chSinkErr <- err
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	runner.InitFrom(s)
+	assert.Equal(t, context.Canceled, <-chSinkErr, "canceling should unblock the send")
+
+	runner = New(s, ToChannelContext(context.Background(), make(chan []byte)))
+	stop := runner.Start(time.Hour)
+	chStopped := make(chan struct{})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		stop()
+		close(chStopped)
+	}()
+	select {
+	case <-chStopped:
+	case <-time.After(time.Second):
+		assert.Fail(t, "runner should stop even if nobody reads the channel")
+	}
+}
+
+func TestToDirTarGz(t *testing.T) {
+	parent, err := ioutil.TempDir("", "keep_current_test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(parent)
+	dir := filepath.Join(parent, "bundle")
+	s := ToDirTarGz(dir)
+	assert.NoError(t, s.UpdateFrom(strings.NewReader(makeTarGz(t, "a.txt", "a", "sub/b.txt", "b"))))
+	for name, content := range map[string]string{"a.txt": "a", "sub/b.txt": "b"} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		assert.NoError(t, err)
+		assert.Equal(t, content, string(b))
+	}
+	_, err = os.Stat(dir + ".manifest.json")
+	assert.NoError(t, err, "should write the manifest next to the directory")
+
+	// Unchanged files should not be rewritten
+	old := time.Now().Add(-time.Hour)
+	assert.NoError(t, os.Chtimes(filepath.Join(dir, "a.txt"), old, old))
+	assert.NoError(t, os.Chtimes(dir, old, old))
+	assert.NoError(t, os.Remove(filepath.Join(dir, "sub", "b.txt")))
+	assert.NoError(t, s.UpdateFrom(strings.NewReader(makeTarGz(t, "a.txt", "a", "sub/b.txt", "b"))))
+	fi, err := os.Stat(filepath.Join(dir, "a.txt"))
+	if assert.NoError(t, err) {
+		assert.True(t, fi.ModTime().Equal(old), "unchanged file should be kept as is")
+	}
+	fi, err = os.Stat(dir)
+	if assert.NoError(t, err) {
+		assert.True(t, fi.ModTime().Equal(old), "no temporary file should be written for an unchanged file")
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "sub", "b.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "b", string(b), "missing file should be extracted again")
+
+	assert.NoError(t, s.UpdateFrom(strings.NewReader(makeTarGz(t, "a.txt", "changed"))))
+	b, _ = ioutil.ReadFile(filepath.Join(dir, "a.txt"))
+	assert.Equal(t, "changed", string(b))
+
+	// Same size but different content past the start
+	large := strings.Repeat("x", 100000)
+	assert.NoError(t, s.UpdateFrom(strings.NewReader(makeTarGz(t, "large.txt", large))))
+	assert.NoError(t, s.UpdateFrom(strings.NewReader(makeTarGz(t, "large.txt", large[:50000]+"y"+large[50001:]))))
+	b, _ = ioutil.ReadFile(filepath.Join(dir, "large.txt"))
+	assert.Equal(t, large[:50000]+"y"+large[50001:], string(b))
+
+	assert.Error(t, s.UpdateFrom(strings.NewReader(makeTarGz(t, "../escape.txt", "x"))))
+	_, err = os.Stat(filepath.Join(parent, "escape.txt"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFlushOnStop(t *testing.T) {
+	s := &staticSource{data: "data", lastModified: time.Now().Add(time.Hour)}
+	batched := &recordingSink{}
+	ch := make(chan []byte, 10)
+	var open int32
+	allowed := func(time.Time) bool { return atomic.LoadInt32(&open) == 1 }
+	discarded := &recordingSink{}
+	var sinkErrs []error
+	runner := New(s, ChainSink(batched, ToBatched(10, 0), Required), WithinWindowDeferred(allowed, time.Hour)(ToChannel(ch)),
+		WithinWindowDeferred(func(time.Time) bool { return false }, time.Hour)(discarded))
+	runner.OnSinkError = func(sink Sink, err error) {
+		sinkErrs = append(sinkErrs, err)
+	}
+	stop := runner.Start(time.Hour)
+	assert.Eventually(t, func() bool { return runner.SyncCount() == 1 }, time.Second, time.Millisecond)
+	assert.Empty(t, batched.received)
+	assert.Empty(t, ch)
+	atomic.StoreInt32(&open, 1)
+	sinkErrs = nil
+	stop()
+	if assert.Len(t, batched.received, 1, "should forward the pending batch on stop") {
+		assert.Equal(t, "data", string(batched.received[0]))
+	}
+	if assert.Len(t, ch, 1, "should write the deferred data if the window is open on stop") {
+		assert.Equal(t, "data", string(<-ch))
+	}
+	assert.Empty(t, discarded.received, "should discard the deferred data if the window is closed on stop")
+	assert.Equal(t, []error{ErrOutsideWindow}, sinkErrs)
+}
+
+// tamperingSink writes the data to a file sink and then overwrites the file,
+// as a racing writer would.
+type tamperingSink struct {
+	Sink
+	path string
+}
+
+func (s *tamperingSink) UpdateFrom(r io.Reader) error {
+	if err := s.Sink.UpdateFrom(r); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.path, []byte("tampered"), 0644)
+}
+
+func (s *tamperingSink) ReadBack(md Metadata) (io.ReadCloser, error) {
+	return s.Sink.(ReadBackSink).ReadBack(md)
+}
+
+func TestVerified(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keep_current_test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "data")
+
+	s := Verified(ToFile(path))
+	assert.NoError(t, s.UpdateFrom(strings.NewReader("data")))
+	b, _ := ioutil.ReadFile(path)
+	assert.Equal(t, "data", string(b))
+	assert.Equal(t, ToFile(path).String()+" verified", s.String())
+
+	s = Verified(&tamperingSink{ToFile(path), path})
+	assert.True(t, errors.Is(s.UpdateFrom(strings.NewReader("data")), ErrVerificationFailed))
+
+	s = Verified(ToFileWithPreprocessor(path, func(r io.Reader) (io.Reader, error) { return r, nil }))
+	assert.Error(t, s.UpdateFrom(strings.NewReader("data")), "preprocessed data can't be verified")
+	assert.Error(t, Verified(&recordingSink{}).UpdateFrom(strings.NewReader("data")), "sinks which can't be read back can't be verified")
+
+	gzipped := Verified(ToFileKeepEncoding(path))
+	assert.NoError(t, gzipped.(MetadataSink).UpdateWithMetadata(strings.NewReader("gzipped"), Metadata{ContentEncoding: "gzip"}))
+	b, _ = ioutil.ReadFile(path + ".gz")
+	assert.Equal(t, "gzipped", string(b))
+}
+
+func TestToReaderChannel(t *testing.T) {
+	s := &staticSource{data: "abcde"}
+	ch := make(chan io.ReadCloser)
+	other := &recordingSink{}
+	runner := New(s, ToReaderChannel(ch), other)
+	received := make(chan string, 1)
+	go func() {
+		rc := <-ch
+		b, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		received <- string(b)
+	}()
+	runner.InitFrom(s)
+	assert.Equal(t, "abcde", <-received)
+	assert.Equal(t, [][]byte{[]byte("abcde")}, other.received)
+	assert.NoError(t, runner.SinkStatus()[ToReaderChannel(ch).String()].LastError)
+
+	runner = New(s, ToReaderChannel(ch))
+	stop := runner.Start(time.Hour)
+	rc := <-ch
+	stop()
+	_, err := rc.Read(make([]byte, 1))
+	assert.Equal(t, io.ErrClosedPipe, err, "should not read once the runner is stopped")
+}
+
+func TestToKeyed(t *testing.T) {
+	a, b := &recordingSink{}, &recordingSink{}
+	s := &staticSource{data: `{"a": "first", "b": {"n": 1}, "c": "extra"}`}
+	runner := New(s, ToKeyed(SplitJSONObject, map[string]Sink{"a": a, "b": b}))
+	runner.InitFrom(s)
+	assert.Equal(t, [][]byte{[]byte("first")}, a.received)
+	assert.Equal(t, [][]byte{[]byte(`{"n": 1}`)}, b.received)
+
+	err := ToKeyedWithOptions(SplitJSONObject, map[string]Sink{"a": a}, KeyedOptions{RejectUnexpected: true}).
+		UpdateFrom(strings.NewReader(s.data))
+	if assert.IsType(t, &KeyedError{}, err) {
+		assert.Equal(t, []string{"b", "c"}, err.(*KeyedError).Unexpected)
+	}
+	assert.Len(t, a.received, 1, "should not write with unexpected keys")
+
+	err = ToKeyed(SplitJSONObject, map[string]Sink{"a": a, "d": b}).UpdateFrom(strings.NewReader(s.data))
+	if assert.IsType(t, &KeyedError{}, err) {
+		assert.Equal(t, []string{"d"}, err.(*KeyedError).Missing)
+	}
+	assert.Len(t, a.received, 1, "should not write with missing keys")
+
+	err = ToKeyed(SplitJSONObject, map[string]Sink{"a": a, "b": failingSink{}}).UpdateFrom(strings.NewReader(s.data))
+	if assert.IsType(t, &KeyedError{}, err) {
+		assert.Len(t, err.(*KeyedError).SinkErrs, 1)
+		assert.Error(t, err.(*KeyedError).SinkErrs["b"])
+	}
+	assert.Len(t, a.received, 2, "should write the other sinks despite a failing one")
+
+	assert.Error(t, ToKeyed(SplitJSONObject, nil).UpdateFrom(strings.NewReader("[]")))
+}
+
+func TestPatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "patch")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "data")
+	appendPatch := func(base, patch []byte) ([]byte, error) {
+		return append(base, patch...), nil
+	}
+	s := &appendingSource{data: "a"}
+	runner := New(s, ToPatchable(ToFile(path).(ReadBackSink), appendPatch))
+	runner.InitFrom(s)
+	s.data += "b"
+	runner.InitFrom(s)
+	b, _ := ioutil.ReadFile(path)
+	assert.Equal(t, "ab", string(b))
+	assert.Equal(t, 1, s.fullFetches, "should fetch in full only without a base")
+	assert.Equal(t, 1, s.patchFetches)
+
+	s.data = "xyz"
+	runner.InitFrom(s)
+	b, _ = ioutil.ReadFile(path)
+	assert.Equal(t, "xyz", string(b), "should fetch in full without a patch")
+	assert.Equal(t, 2, s.fullFetches)
+
+	s.data += "!"
+	runner = New(s, ToPatchable(ToFile(path).(ReadBackSink), func(base, patch []byte) ([]byte, error) {
+		return nil, errors.New("corrupt base")
+	}))
+	runner.InitFrom(s)
+	s.data += "?"
+	runner.InitFrom(s)
+	b, _ = ioutil.ReadFile(path)
+	assert.Equal(t, "xyz!?", string(b), "should fetch in full if the patch fails")
+	assert.Equal(t, 4, s.fullFetches)
+	assert.Equal(t, 3, s.patchFetches)
+
+	runner = New(s, ToPatchable(ToFile(path).(ReadBackSink), appendPatch))
+	runner.InitFrom(s)
+	s.data += "."
+	s.corrupt = true
+	runner.InitFrom(s)
+	b, _ = ioutil.ReadFile(path)
+	assert.Equal(t, "xyz!?.", string(b), "should fetch in full if the patched data doesn't match")
+	assert.Equal(t, 6, s.fullFetches)
+	assert.Equal(t, 4, s.patchFetches)
+	hash := sha256.Sum256([]byte("xyz!?."))
+	assert.Equal(t, hash[:], runner.LastHash())
+}
+
+// appendingSource serves data which only grows, with the patch from any
+// earlier version being what was appended since.
+type appendingSource struct {
+	data         string
+	fullFetches  int
+	patchFetches int
+	// corrupt makes the patches append a byte too many
+	corrupt bool
+}
+
+func (s *appendingSource) Fetch(ifNewerThan time.Time) (io.ReadCloser, error) {
+	s.fullFetches++
+	return ioutil.NopCloser(strings.NewReader(s.data)), nil
+}
+
+func (s *appendingSource) FetchPatch(ifNewerThan time.Time, base []byte) (io.ReadCloser, []byte, error) {
+	s.patchFetches++
+	target := sha256.Sum256([]byte(s.data))
+	for i := 0; i <= len(s.data); i++ {
+		if h := sha256.Sum256([]byte(s.data[:i])); bytes.Equal(h[:], base) {
+			patch := s.data[i:]
+			if s.corrupt {
+				patch += "!"
+			}
+			return ioutil.NopCloser(strings.NewReader(patch)), target[:], nil
+		}
+	}
+	return nil, nil, ErrNoPatch
+}
+
+func TestToGRPCStream(t *testing.T) {
+	var opened int
+	var sent []string
+	fail := false
+	sink, stop := ToGRPCStream(func(ctx context.Context) (StreamSender, error) {
+		opened++
+		return senderFunc(func(msg []byte) error {
+			if fail {
+				return errors.New("stream broken")
+			}
+			sent = append(sent, string(msg))
+			return nil
+		}), nil
+	})
+	defer stop()
+	assert.NoError(t, sink.UpdateFrom(strings.NewReader("v1")))
+	assert.NoError(t, sink.UpdateFrom(strings.NewReader("v2")))
+	assert.Equal(t, 1, opened, "should keep the stream open")
+	fail = true
+	assert.Error(t, sink.UpdateFrom(strings.NewReader("v3")))
+	fail = false
+	assert.NoError(t, sink.UpdateFrom(strings.NewReader("v4")))
+	assert.Equal(t, 2, opened, "should open the stream again after failing")
+	assert.Equal(t, []string{"v1", "v2", "v4"}, sent)
+
+	stop()
+	fail = true
+	sink.UpdateFrom(strings.NewReader("v5"))
+	assert.Error(t, sink.UpdateFrom(strings.NewReader("v6")), "should not open the stream once stopped")
+	assert.Equal(t, 2, opened)
+}
+
+type senderFunc func([]byte) error
+
+func (f senderFunc) Send(msg []byte) error {
+	return f(msg)
+}
+
+func TestContentType(t *testing.T) {
+	sink, stop, err := ToServe("127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer stop()
+	downstream := FromWeb("http://" + sink.(*serveSink).addr)
+	contentType := func() string {
+		rc, err := downstream.Fetch(time.Time{})
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		rc.Close()
+		return metadataOf(rc).ContentType
+	}
+
+	s := &staticSource{data: "<html><body>hi</body></html>"}
+	New(s, sink).InitFrom(s)
+	assert.Equal(t, "text/html; charset=utf-8", contentType(), "should sniff the content type")
+
+	ct := WithContentType("application/json")(&staticSource{data: `{"a": 1}`})
+	New(ct, sink).InitFrom(ct)
+	assert.Equal(t, "application/json", contentType())
+
+	// Relayed from one server to another
+	relay, stopRelay, err := ToServe("127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer stopRelay()
+	New(downstream, relay).InitFrom(downstream)
+	downstream = FromWeb("http://" + relay.(*serveSink).addr)
+	assert.Equal(t, "application/json", contentType(), "should take the content type from the header")
+}
+
+func TestContentTypeSniffFails(t *testing.T) {
+	s := SourceFunc(func(ifNewerThan time.Time) (io.ReadCloser, error) {
+		failOnce := &errorOnceReader{errors.New("connection reset")}
+		return ioutil.NopCloser(io.MultiReader(strings.NewReader("partial"), failOnce)), nil
+	})
+	sink := &recordingSink{}
+	result := New(s, sink).Sync()
+	assert.False(t, result.Changed)
+	assert.Error(t, result.Err, "failing to read the data to sniff should fail the sync")
+	assert.Empty(t, sink.received, "partial data should not be written")
+}
+
+// errorOnceReader fails once and then reads as empty.
+type errorOnceReader struct {
+	err error
+}
+
+func (r *errorOnceReader) Read(p []byte) (int, error) {
+	if err := r.err; err != nil {
+		r.err = nil
+		return 0, err
+	}
+	return 0, io.EOF
+}
@@ -1,21 +1,215 @@
 package keepcurrent
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"hash"
+	"hash/fnv"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mholt/archiver/v3"
 )
 
+// WebOptions configures a source constructed by FromWebWithOptions.
+type WebOptions struct {
+	// Client is used to send the requests. Defaults to http.DefaultClient.
+	Client *http.Client
+	// Header is added to every request, e.g. for authorization or the
+	// Content-Type of a POST body.
+	Header http.Header
+	// AcceptGzip explicitly asks the server for gzip-compressed data and
+	// decompresses it if the server complies. Unlike the transparent
+	// decompression of http.Transport, it takes effect regardless of any
+	// other headers on the request. Without it, data the server encodes
+	// because of an Accept-Encoding in Header is passed on as is, with the
+	// encoding in Metadata.ContentEncoding.
+	AcceptGzip bool
+	// If given, OnResponse is called with every response received, e.g. to
+	// log the caching headers of a CDN, including the responses telling that
+	// the data is unmodified or failed. It's called before the body is read,
+	// and must neither read nor close the body.
+	OnResponse func(resp *http.Response)
+	// StatusPolicy tells what to make of a response by its status, e.g. to
+	// treat a 204 as unmodified for an origin which uses it that way. It's
+	// called before the body is read, and must neither read nor close the
+	// body. Defaults to DefaultStatusPolicy.
+	StatusPolicy func(resp *http.Response) (StatusAction, error)
+	// MaxRedirects caps how many redirects a fetch follows before failing
+	// with a *TooManyRedirectsError. Defaults to 10, the same as
+	// http.Client. A redirect back to a URL already visited fails right away
+	// as a loop, whatever the cap.
+	MaxRedirects int
+	// NoRedirects makes a fetch not follow redirects at all, so that a 3xx
+	// response goes through the StatusPolicy as is, which makes the fetch
+	// fail with an *HTTPStatusError by default.
+	NoRedirects bool
+	// CompareByLength is a last resort to tell that the data is unmodified
+	// for servers which send neither an ETag nor a Last-Modified header, by
+	// the Content-Length along with a 64-bit FNV-1a hash of the body. A
+	// response of the same length as the last one is buffered in memory to
+	// hash it, and is unmodified if the hash is the same too. It's opt-in as
+	// it's not as reliable as the validators: the server still sends the
+	// whole body every time, and the hash isn't cryptographic, so a
+	// deliberate change keeping the length may go unnoticed. Responses
+	// without a Content-Length, e.g. chunked ones, are always modified.
+	CompareByLength bool
+}
+
+// defaultMaxRedirects is the same as the limit of http.Client.
+const defaultMaxRedirects = 10
+
+// TooManyRedirectsError is returned by web sources when a fetch is
+// redirected more than WebOptions.MaxRedirects times, or in a loop.
+type TooManyRedirectsError struct {
+	// URL is the URL the fetch was last redirected to.
+	URL string
+	// Redirects is how many redirects were followed.
+	Redirects int
+	// Loop is true if the fetch was redirected back to a URL already
+	// visited.
+	Loop bool
+}
+
+func (e *TooManyRedirectsError) Error() string {
+	if e.Loop {
+		return fmt.Sprintf("redirect loop at %v after %d redirects", e.URL, e.Redirects)
+	}
+	return fmt.Sprintf("stopped after %d redirects at %v", e.Redirects, e.URL)
+}
+
+// Temporary is always false, as the redirects are down to the configuration
+// of the server, so that StopAfter gives up right away.
+func (e *TooManyRedirectsError) Temporary() bool {
+	return false
+}
+
+// HTTPStatusError is returned by web sources for a response with a status
+// that's treated as an error, see WebOptions.StatusPolicy.
+type HTTPStatusError struct {
+	StatusCode int
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("unexpected HTTP status %v", e.StatusCode)
+}
+
+// Temporary tells if the request may succeed if retried. That's the case for
+// server errors, 408 Request Timeout, 425 Too Early and 429 Too Many Requests,
+// but not for the rest of the client errors, e.g. 404 Not Found, so that
+// StopAfter gives up on them right away.
+func (e *HTTPStatusError) Temporary() bool {
+	switch {
+	case e.StatusCode == http.StatusRequestTimeout, e.StatusCode == http.StatusTooEarly, e.StatusCode == http.StatusTooManyRequests:
+		return true
+	case e.StatusCode >= 400 && e.StatusCode < 500:
+		return false
+	default:
+		return true
+	}
+}
+
+// StatusAction is what a web source does with a response, as returned by
+// WebOptions.StatusPolicy.
+type StatusAction int
+
+const (
+	// UseBody passes on the body of the response as the data.
+	UseBody StatusAction = iota
+	// TreatAsUnmodified makes the fetch return ErrUnmodified.
+	TreatAsUnmodified
+	// TreatAsError makes the fetch fail with the error returned along with
+	// it, or an *HTTPStatusError if that's nil.
+	TreatAsError
+)
+
+// DefaultStatusPolicy uses the body of 200 responses, treats 304 as
+// unmodified, and any other status as an error. Custom policies can fall back
+// to it for the statuses they don't care about.
+func DefaultStatusPolicy(resp *http.Response) (StatusAction, error) {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return UseBody, nil
+	case http.StatusNotModified:
+		return TreatAsUnmodified, nil
+	default:
+		return TreatAsError, nil
+	}
+}
+
+// maxDrainBytes is the most drainAndClose reads from a body. Draining a larger
+// body costs more than establishing a new connection.
+const maxDrainBytes = 64 << 10
+
+// ResettableSource is an optional interface a Source can implement if it
+// remembers what it last fetched to tell that the data is unmodified, e.g. its
+// ETag or hash, rather than going by ifNewerThan alone. The runner calls
+// ResetConditions when the data fetched couldn't be delivered, e.g. as all of
+// the sinks failed, so that it's not found unmodified when fetched again.
+// The sources wrapping others in this package forward it to the sources they
+// wrap.
+type ResettableSource interface {
+	Source
+	// ResetConditions forgets the state and makes the next fetch
+	// unconditional, regardless of ifNewerThan, to force a full re-fetch.
+	ResetConditions()
+}
+
+// resetConditions resets those of the sources which are ResettableSource.
+func resetConditions(sources ...Source) {
+	for _, s := range sources {
+		if rs, ok := s.(ResettableSource); ok {
+			rs.ResetConditions()
+		}
+	}
+}
+
+// ConditionalSource is implemented by the sources returned by the FromWeb
+// family to expose the state they keep for conditional requests, e.g. to
+// persist it across restarts.
+type ConditionalSource interface {
+	ResettableSource
+	// ETag returns the entity tag of the last response, if any.
+	ETag() string
+	// LastModified returns the Last-Modified time of the last response, if
+	// any.
+	LastModified() time.Time
+	// SetETag and SetLastModified seed the state, e.g. from persisted
+	// storage. Once seeded, the next fetch is conditional even if ifNewerThan
+	// is zero, which is the case for the first fetch by a Runner.
+	SetETag(etag string)
+	SetLastModified(t time.Time)
+}
+
 type webSource struct {
-	url    string
-	etag   string
-	mx     sync.RWMutex
-	client *http.Client
+	url          string
+	body         []byte
+	etag         string
+	lastModified time.Time
+	hash         []byte
+	length       int64
+	lengthHash   uint64
+	nextPoll     time.Time
+	seeded       bool
+	reset        bool
+	mx           sync.RWMutex
+	client       *http.Client
+	opts         WebOptions
 }
 
 // FromWeb constructs a source from the given URL.
@@ -25,81 +219,565 @@ func FromWeb(url string) Source {
 
 // FromWebWithClient is the same as FromWeb but with a custom http.Client
 func FromWebWithClient(url string, client *http.Client) Source {
-	return &webSource{url: url, client: client}
+	return FromWebWithOptions(url, WebOptions{Client: client})
+}
+
+// FromWebWithTransport is the same as FromWeb but sends the requests through
+// the given transport, to tune e.g. MaxIdleConnsPerHost, keep-alives or
+// HTTP/2 without building the whole client. Sharing one transport among the
+// sources polling the same host lets them reuse connections.
+func FromWebWithTransport(url string, transport *http.Transport) Source {
+	return FromWebWithOptions(url, WebOptions{Client: &http.Client{Transport: transport}})
+}
+
+// FromWebWithTLS is the same as FromWeb but authenticates to the server with
+// the client certificate, i.e. mutual TLS, and trusts only the server
+// certificates signed by rootCAs, or the system roots if rootCAs is nil. The
+// rest of the transport is the same as http.DefaultTransport.
+func FromWebWithTLS(url string, cert tls.Certificate, rootCAs *x509.CertPool) Source {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      rootCAs,
+	}
+	return FromWebWithTransport(url, transport)
+}
+
+// FromWebWithOptions is the same as FromWeb but with the given options.
+func FromWebWithOptions(url string, opts WebOptions) Source {
+	return newWebSource(url, nil, opts)
+}
+
+// FromWebPost constructs a source which POSTs the body to the given URL on
+// every fetch, e.g. to query a GraphQL API. As conditional requests don't
+// apply to POST, the response is buffered and compared with the last one by
+// its SHA-256 hash to tell if it's unmodified.
+func FromWebPost(url string, body []byte, client *http.Client) Source {
+	return FromWebPostWithOptions(url, body, WebOptions{Client: client})
+}
+
+// FromWebPostWithOptions is the same as FromWebPost but with the given
+// options. Use WebOptions.Header to set the Content-Type and authorization.
+func FromWebPostWithOptions(url string, body []byte, opts WebOptions) Source {
+	if body == nil {
+		body = []byte{}
+	}
+	return newWebSource(url, body, opts)
+}
+
+func newWebSource(url string, body []byte, opts WebOptions) *webSource {
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	// Copy the client to control the redirects without affecting the other
+	// users of it.
+	redirecting := *client
+	redirecting.CheckRedirect = checkRedirect(opts, client.CheckRedirect)
+	return &webSource{url: url, body: body, client: &redirecting, opts: opts}
+}
+
+// checkRedirect returns the http.Client.CheckRedirect applying the redirect
+// options, and then next if it's not nil.
+func checkRedirect(opts WebOptions, next func(*http.Request, []*http.Request) error) func(*http.Request, []*http.Request) error {
+	max := opts.MaxRedirects
+	if max <= 0 {
+		max = defaultMaxRedirects
+	}
+	return func(req *http.Request, via []*http.Request) error {
+		if opts.NoRedirects {
+			return http.ErrUseLastResponse
+		}
+		for _, prev := range via {
+			if prev.URL.String() == req.URL.String() {
+				return &TooManyRedirectsError{URL: req.URL.String(), Redirects: len(via), Loop: true}
+			}
+		}
+		if len(via) > max {
+			return &TooManyRedirectsError{URL: req.URL.String(), Redirects: len(via) - 1}
+		}
+		// The validators are specific to the server which issued them, so
+		// only keep the conditional headers on the same origin.
+		first := via[0]
+		if req.URL.Scheme == first.URL.Scheme && req.URL.Host == first.URL.Host {
+			for _, key := range []string{"If-None-Match", "If-Modified-Since"} {
+				if value := first.Header.Get(key); value != "" {
+					req.Header.Set(key, value)
+				}
+			}
+		} else {
+			req.Header.Del("If-None-Match")
+			req.Header.Del("If-Modified-Since")
+		}
+		if next != nil {
+			return next(req, via)
+		}
+		return nil
+	}
 }
 
 // Fetch implements the Source interface
 func (s *webSource) Fetch(ifNewerThan time.Time) (io.ReadCloser, error) {
-	req, err := http.NewRequest(http.MethodGet, s.url, nil)
+	return s.FetchContext(context.Background(), ifNewerThan)
+}
+
+// FetchContext implements the ContextSource interface
+func (s *webSource) FetchContext(ctx context.Context, ifNewerThan time.Time) (io.ReadCloser, error) {
+	method, body := http.MethodGet, io.Reader(nil)
+	if s.body != nil {
+		method, body = http.MethodPost, bytes.NewReader(s.body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.url, body)
 	if err != nil {
 		return nil, err
 	}
-	if !ifNewerThan.IsZero() {
-		req.Header.Add("If-Modified-Since", ifNewerThan.Format(http.TimeFormat))
+	for key, values := range s.opts.Header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
 	}
-	if s.getETag() != "" {
-		req.Header.Add("If-None-Match", s.etag)
+	// A zero ifNewerThan asks for the data unconditionally, so don't send the
+	// ETag either, unless the state was seeded since the last fetch.
+	s.mx.RLock()
+	etag, lastModified, seeded, reset := s.etag, s.lastModified, s.seeded, s.reset
+	s.mx.RUnlock()
+	if (!ifNewerThan.IsZero() || seeded) && !reset && s.body == nil {
+		if ifNewerThan.IsZero() {
+			ifNewerThan = lastModified
+		}
+		if !ifNewerThan.IsZero() {
+			req.Header.Add("If-Modified-Since", ifNewerThan.Format(http.TimeFormat))
+		}
+		if etag != "" {
+			req.Header.Add("If-None-Match", etag)
+		}
+	}
+	if s.opts.AcceptGzip {
+		req.Header.Set("Accept-Encoding", "gzip")
 	}
 	resp, err := s.client.Do(req)
 	if err != nil {
+		var redirectsErr *TooManyRedirectsError
+		if errors.As(err, &redirectsErr) {
+			// Unwrap it from the *url.Error, which would pass for a
+			// transient net.Error.
+			return nil, redirectsErr
+		}
 		return nil, err
 	}
-	if resp.StatusCode == http.StatusNotModified {
+	if s.opts.OnResponse != nil {
+		s.opts.OnResponse(resp)
+	}
+	nextPoll := freshUntil(resp.Header, time.Now())
+	s.mx.Lock()
+	s.nextPoll = nextPoll
+	s.mx.Unlock()
+	policy := s.opts.StatusPolicy
+	if policy == nil {
+		policy = DefaultStatusPolicy
+	}
+	switch action, err := policy(resp); action {
+	case UseBody:
+	case TreatAsUnmodified:
+		drainAndClose(resp.Body)
+		return nil, ErrUnmodified
+	default:
+		drainAndClose(resp.Body)
+		if err == nil {
+			err = &HTTPStatusError{StatusCode: resp.StatusCode}
+		}
+		return nil, err
+	}
+	etag = resp.Header.Get("ETag")
+	if sent := req.Header.Get("If-None-Match"); sent != "" && etagWeakMatch(sent, etag) {
+		// The server ignored the conditional request but the data is the same
+		drainAndClose(resp.Body)
 		return nil, ErrUnmodified
 	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected HTTP status %v", resp.StatusCode)
+	md := Metadata{ContentType: resp.Header.Get("Content-Type")}
+	if lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		md.ModTime = lastModified
 	}
-	etag := resp.Header.Get("ETag")
+	s.mx.Lock()
 	if etag != "" {
-		s.setETag(etag)
+		s.etag = etag
+	}
+	if !md.ModTime.IsZero() {
+		s.lastModified = md.ModTime
+	}
+	s.seeded, s.reset = false, false
+	s.mx.Unlock()
+	var rc io.ReadCloser = resp.Body
+	if s.opts.CompareByLength && s.body == nil && etag == "" && md.ModTime.IsZero() && resp.ContentLength >= 0 {
+		rc, err = s.unlessSameLength(rc, resp.ContentLength, ifNewerThan, reset)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.opts.AcceptGzip && resp.Header.Get("Content-Encoding") == "gzip" {
+		gzr, err := gzip.NewReader(rc)
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		rc = chainedCloser{gzr, rc}
+	} else if encoding := resp.Header.Get("Content-Encoding"); encoding != "identity" {
+		// The data is passed on still encoded, e.g. if Accept-Encoding was
+		// set in the Header.
+		md.ContentEncoding = encoding
+	}
+	if s.body != nil {
+		rc, err = s.unlessSameHash(rc, ifNewerThan, reset)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return withMetadata(rc, md), nil
+}
+
+// Describe implements DescribedSource
+func (s *webSource) Describe() string {
+	if s.body != nil {
+		return "POST " + s.url
+	}
+	return s.url
+}
+
+// NextPoll implements NextPollSource, by the Cache-Control or Expires header
+// of the last response.
+func (s *webSource) NextPoll() time.Time {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return s.nextPoll
+}
+
+// freshUntil returns until when a response with the header is fresh, by the
+// max-age of Cache-Control less the Age, or else by Expires, or zero if the
+// header doesn't tell or forbids caching.
+func freshUntil(header http.Header, now time.Time) time.Time {
+	if cc := header.Get("Cache-Control"); cc != "" {
+		for _, directive := range strings.Split(cc, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+			if directive == "no-cache" || directive == "no-store" {
+				return time.Time{}
+			}
+			if !strings.HasPrefix(directive, "max-age=") {
+				continue
+			}
+			maxAge, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+			if err != nil {
+				return time.Time{}
+			}
+			age, _ := strconv.Atoi(header.Get("Age"))
+			return now.Add(time.Duration(maxAge-age) * time.Second)
+		}
+	}
+	if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+		return expires
+	}
+	return time.Time{}
+}
+
+// unlessSameHash buffers the data and returns ErrUnmodified if it hashes the
+// same as the last time, unless ifNewerThan is zero.
+func (s *webSource) unlessSameHash(rc io.ReadCloser, ifNewerThan time.Time, reset bool) (io.ReadCloser, error) {
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
 	}
-	return resp.Body, nil
+	hash := sha256.Sum256(data)
+	s.mx.Lock()
+	unmodified := bytes.Equal(s.hash, hash[:])
+	s.hash = hash[:]
+	s.mx.Unlock()
+	if unmodified && !ifNewerThan.IsZero() && !reset {
+		return nil, ErrUnmodified
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
 }
 
-func (s *webSource) getETag() string {
+// unlessSameLength returns ErrUnmodified if the body has the same length and
+// hash as the last one read in full, see WebOptions.CompareByLength.
+func (s *webSource) unlessSameLength(rc io.ReadCloser, length int64, ifNewerThan time.Time, reset bool) (io.ReadCloser, error) {
+	s.mx.RLock()
+	sameLength := s.length == length && s.lengthHash != 0
+	s.mx.RUnlock()
+	if !sameLength {
+		// Modified for sure, so just remember the length and hash once read
+		return &lengthHashReader{ReadCloser: rc, s: s, h: fnv.New64a(), length: length}, nil
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	h := fnv.New64a()
+	h.Write(data)
+	s.mx.Lock()
+	unmodified := s.lengthHash == h.Sum64()
+	s.length, s.lengthHash = int64(len(data)), h.Sum64()
+	s.mx.Unlock()
+	if unmodified && !ifNewerThan.IsZero() && !reset {
+		return nil, ErrUnmodified
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// lengthHashReader hashes the body as it's read and remembers the length and
+// hash once it's read in full.
+type lengthHashReader struct {
+	io.ReadCloser
+	s      *webSource
+	h      hash.Hash64
+	n      int64
+	length int64
+}
+
+func (r *lengthHashReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.h.Write(p[:n])
+	r.n += int64(n)
+	if err == io.EOF && r.n == r.length {
+		r.s.mx.Lock()
+		r.s.length, r.s.lengthHash = r.length, r.h.Sum64()
+		r.s.mx.Unlock()
+	}
+	return n, err
+}
+
+// drainAndClose reads what's left of a response body, or any data fetched
+// from a source, up to a limit, before closing it so that the connection can
+// be reused.
+func drainAndClose(body io.ReadCloser) {
+	io.Copy(ioutil.Discard, io.LimitReader(body, maxDrainBytes))
+	body.Close()
+}
+
+// etagWeakMatch tells if two entity tags match using the weak comparison of
+// RFC 7232, i.e. regardless of whether either is weak.
+func etagWeakMatch(a, b string) bool {
+	a, b = strings.TrimPrefix(a, "W/"), strings.TrimPrefix(b, "W/")
+	return a != "" && a == b
+}
+
+// ETag implements ConditionalSource
+func (s *webSource) ETag() string {
 	s.mx.RLock()
 	defer s.mx.RUnlock()
 	return s.etag
 }
 
-func (s *webSource) setETag(etag string) {
+// LastModified implements ConditionalSource
+func (s *webSource) LastModified() time.Time {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return s.lastModified
+}
+
+// SetETag implements ConditionalSource
+func (s *webSource) SetETag(etag string) {
+	s.mx.Lock()
+	s.etag, s.seeded, s.reset = etag, true, false
+	s.mx.Unlock()
+}
+
+// SetLastModified implements ConditionalSource
+func (s *webSource) SetLastModified(t time.Time) {
+	s.mx.Lock()
+	s.lastModified, s.seeded, s.reset = t, true, false
+	s.mx.Unlock()
+}
+
+// ResetConditions implements ConditionalSource
+func (s *webSource) ResetConditions() {
 	s.mx.Lock()
-	s.etag = etag
+	s.etag, s.lastModified, s.hash = "", time.Time{}, nil
+	s.length, s.lengthHash = 0, 0
+	s.seeded, s.reset = false, true
 	s.mx.Unlock()
 }
 
-type tarGzSource struct {
-	s            Source
-	expectedName string
+// errNotFoundInArchive is returned when the archive has no file by the
+// expected name.
+var errNotFoundInArchive = errors.New("not found in archive")
+
+// errUnknownArchiveFormat is returned by sources wrapped with FromArchive
+// when the data is not in any of the supported formats.
+var errUnknownArchiveFormat = errors.New("unknown archive format")
+
+type archiveSource struct {
+	s      Source
+	member string
+	match  func(name string) (bool, error)
+	latest bool
+	detect bool
+	tarGz  *archiver.TarGz
 }
 
 // FromTarGz wraps a source to decompress one specific file from the gzipped
 // tarball.
 func FromTarGz(s Source, expectedName string) Source {
-	return &tarGzSource{s, expectedName}
+	return &archiveSource{s: s, member: expectedName, match: func(name string) (bool, error) {
+		return name == expectedName, nil
+	}}
+}
+
+// FromTarGzWithArchiver is the same as FromTarGz but reads the tarball with a
+// copy of the given archiver, e.g. to set ContinueOnError. The archiver itself
+// is never opened, so it can be shared.
+func FromTarGzWithArchiver(s Source, expectedName string, tarGz *archiver.TarGz) Source {
+	return &archiveSource{s: s, member: expectedName, tarGz: tarGz, match: func(name string) (bool, error) {
+		return name == expectedName, nil
+	}}
+}
+
+// FromTarGzMatch is the same as FromTarGz but picks the first file in the
+// tarball whose name matches the pattern, as defined by filepath.Match, e.g.
+// "config-*.json".
+func FromTarGzMatch(s Source, pattern string) Source {
+	return &archiveSource{s: s, member: pattern, match: func(name string) (bool, error) {
+		return filepath.Match(pattern, name)
+	}}
+}
+
+// FromTarGzMatchLatest is the same as FromTarGzMatch but picks the matching
+// file with the lexically greatest name, e.g. the latest of files named by
+// date. As the tarball can only be read sequentially, the best match so far is
+// buffered in memory until the whole tarball has been scanned.
+func FromTarGzMatchLatest(s Source, pattern string) Source {
+	return &archiveSource{s: s, member: pattern, latest: true, match: func(name string) (bool, error) {
+		return filepath.Match(pattern, name)
+	}}
 }
 
-func (s *tarGzSource) Fetch(ifNewerThan time.Time) (io.ReadCloser, error) {
+// FromArchive is the same as FromTarGz but detects the format of the archive
+// from its first bytes, so it also extracts from a plain tarball, a tarball
+// compressed with bzip2, or a zip file. As reading a zip file needs random
+// access, a zip file is buffered in memory as a whole.
+func FromArchive(s Source, expectedName string) Source {
+	return &archiveSource{s: s, member: expectedName, detect: true, match: func(name string) (bool, error) {
+		return name == expectedName, nil
+	}}
+}
+
+func (s *archiveSource) Fetch(ifNewerThan time.Time) (io.ReadCloser, error) {
 	rc, err := s.s.Fetch(ifNewerThan)
 	if err != nil {
 		return nil, err
 	}
-	unzipper := archiver.NewTarGz()
-	if err := unzipper.Open(rc, 0); err != nil {
+	unzipper, err := s.open(rc)
+	if err != nil {
+		rc.Close()
 		return nil, err
 	}
+	var bestName string
+	var best []byte
 	for {
 		f, err := unzipper.Read()
+		if err == io.EOF && best != nil {
+			rc.Close()
+			return ioutil.NopCloser(bytes.NewReader(best)), nil
+		}
+		if err == io.EOF {
+			err = errNotFoundInArchive
+		}
 		if err != nil {
+			rc.Close()
 			return nil, err
 		}
-		if f.Name() == s.expectedName {
+		matched, err := s.match(f.Name())
+		if err != nil {
+			f.Close()
+			rc.Close()
+			return nil, err
+		}
+		if !matched {
+			f.Close()
+			continue
+		}
+		if !s.latest {
 			return chainedCloser{f, rc}, nil
 		}
+		if best == nil || f.Name() > bestName {
+			best, err = ioutil.ReadAll(f)
+			if err != nil {
+				f.Close()
+				rc.Close()
+				return nil, err
+			}
+			bestName = f.Name()
+		}
+		f.Close()
+	}
+}
+
+// Describe implements DescribedSource
+func (s *archiveSource) Describe() string {
+	format := "tar.gz"
+	if s.detect {
+		format = "archive"
+	}
+	return fmt.Sprintf("%v in %v from %v", s.member, format, describe(s.s))
+}
+
+// ResetConditions implements ResettableSource
+func (s *archiveSource) ResetConditions() {
+	resetConditions(s.s)
+}
+
+// open opens the archive for reading, as a gzipped tarball unless the format
+// is to be detected.
+func (s *archiveSource) open(r io.Reader) (archiver.Reader, error) {
+	if !s.detect {
+		unzipper := s.newTarGz()
+		return unzipper, unzipper.Open(r, 0)
+	}
+	// The magic of tarballs is at offset 257
+	br := bufio.NewReaderSize(r, 512)
+	magic, err := br.Peek(262)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		unzipper := s.newTarGz()
+		return unzipper, unzipper.Open(br, 0)
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		unzipper := archiver.NewTarBz2()
+		return unzipper, unzipper.Open(br, 0)
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")) || bytes.HasPrefix(magic, []byte("PK\x05\x06")):
+		data, err := ioutil.ReadAll(br)
+		if err != nil {
+			return nil, err
+		}
+		unzipper := archiver.NewZip()
+		return unzipper, unzipper.Open(bytes.NewReader(data), int64(len(data)))
+	case len(magic) == 262 && bytes.HasPrefix(magic[257:], []byte("ustar")):
+		unzipper := archiver.NewTar()
+		return unzipper, unzipper.Open(br, 0)
+	default:
+		return nil, errUnknownArchiveFormat
 	}
 }
 
+// newTarGz returns a fresh archiver for gzipped tarballs, configured the same
+// as the one given to FromTarGzWithArchiver, if any, as an archiver keeps the
+// state of reading an archive.
+func (s *archiveSource) newTarGz() *archiver.TarGz {
+	if s.tarGz == nil {
+		return archiver.NewTarGz()
+	}
+	tarGz := *s.tarGz
+	if tarGz.Tar != nil {
+		tar := *tarGz.Tar
+		tarGz.Tar = &tar
+	} else {
+		tarGz.Tar = archiver.NewTar()
+	}
+	return &tarGz
+}
+
 type chainedCloser []io.ReadCloser
 
 func (cc chainedCloser) Read(p []byte) (n int, err error) {
@@ -109,6 +787,9 @@ func (cc chainedCloser) Read(p []byte) (n int, err error) {
 func (cc chainedCloser) Close() error {
 	var lastError error
 	for _, c := range cc {
+		if c == nil {
+			continue
+		}
 		if err := c.Close(); err != nil {
 			lastError = err
 		}
@@ -116,40 +797,341 @@ func (cc chainedCloser) Close() error {
 	return lastError
 }
 
+// mtimeGranularity is the coarsest granularity of the modification times of
+// common file systems, e.g. 2 seconds on FAT, within which the modification
+// time alone can't tell if the file has changed.
+const mtimeGranularity = 2 * time.Second
+
 type fileSource struct {
 	path         string
 	preprocessor func(io.ReadCloser) (io.ReadCloser, error)
+
+	mx      sync.Mutex
+	hash    []byte
+	settled time.Time
+	reset   bool
 }
 
 // FromFile constructs a source from the given file path.
 func FromFile(path string) Source {
-	return &fileSource{path, nil}
+	return &fileSource{path: path}
 }
 
 // FromFileWithPreprocessor constructs a source from the given file path, while modifying the file data using preprocessor function
 func FromFileWithPreprocessor(path string, preprocessor func(io.ReadCloser) (io.ReadCloser, error)) Source {
-	return &fileSource{path, preprocessor}
+	return &fileSource{path: path, preprocessor: preprocessor}
 }
 
 func (s *fileSource) Fetch(ifNewerThan time.Time) (io.ReadCloser, error) {
+	return s.fetchUnlessWritten(ifNewerThan, nil)
+}
+
+// fetchUnlessWritten is the same as Fetch but also returns ErrUnmodified if
+// written tells that the file was last written by the runner itself.
+func (s *fileSource) fetchUnlessWritten(ifNewerThan time.Time, written func(path string, modTime time.Time) bool) (io.ReadCloser, error) {
 	f, err := os.Open(s.path)
 	if err != nil {
 		return nil, err
 	}
 	fi, err := f.Stat()
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
-	if !ifNewerThan.IsZero() && ifNewerThan.Before(fi.ModTime()) {
+	s.mx.Lock()
+	if s.reset {
+		ifNewerThan, s.reset = time.Time{}, false
+	}
+	s.mx.Unlock()
+	// The runner's own write to the file is not a change, otherwise reading
+	// from and writing to the same file would sync again on every interval.
+	if !ifNewerThan.IsZero() && written != nil && written(s.path, fi.ModTime()) {
+		f.Close()
 		return nil, ErrUnmodified
 	}
-	var result io.ReadCloser
-	result = f
+	var result io.ReadCloser = &fileHashReader{f: f, s: s, h: sha256.New()}
+	if !ifNewerThan.IsZero() && !fi.ModTime().After(ifNewerThan) {
+		if ifNewerThan.Sub(fi.ModTime()) >= mtimeGranularity || s.isSettled(fi.ModTime()) {
+			f.Close()
+			return nil, ErrUnmodified
+		}
+		// The file may have been modified after ifNewerThan within the
+		// granularity of its modification time, so tell by the content.
+		result, err = s.unlessSameContent(f, fi.ModTime())
+		if err != nil {
+			return nil, err
+		}
+	}
 	if s.preprocessor != nil {
-		result, err = s.preprocessor(f)
+		result, err = s.preprocessor(result)
 		if err != nil {
 			return nil, err
 		}
 	}
-	return result, nil
+	return withMetadata(result, Metadata{ModTime: fi.ModTime()}), nil
+}
+
+// ResetConditions implements ResettableSource
+func (s *fileSource) ResetConditions() {
+	s.mx.Lock()
+	s.hash, s.settled, s.reset = nil, time.Time{}, true
+	s.mx.Unlock()
+}
+
+// isSettled tells if the content of the file with the modification time was
+// already compared once it could no longer change without the modification
+// time changing too.
+func (s *fileSource) isSettled(modTime time.Time) bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.settled.Equal(modTime)
+}
+
+// unlessSameContent reads the file in full and returns ErrUnmodified if it
+// hashes the same as when last read in full.
+func (s *fileSource) unlessSameContent(f *os.File, modTime time.Time) (io.ReadCloser, error) {
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(data)
+	s.mx.Lock()
+	unmodified := bytes.Equal(s.hash, hash[:])
+	s.hash = hash[:]
+	if time.Since(modTime) >= mtimeGranularity {
+		s.settled = modTime
+	}
+	s.mx.Unlock()
+	if unmodified {
+		return nil, ErrUnmodified
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// fileHashReader remembers the hash of the file once it's read in full.
+type fileHashReader struct {
+	f *os.File
+	s *fileSource
+	h hash.Hash
+}
+
+func (r *fileHashReader) Read(p []byte) (int, error) {
+	n, err := r.f.Read(p)
+	r.h.Write(p[:n])
+	if err == io.EOF {
+		r.s.mx.Lock()
+		r.s.hash = r.h.Sum(nil)
+		r.s.mx.Unlock()
+	}
+	return n, err
+}
+
+func (r *fileHashReader) Close() error {
+	return r.f.Close()
+}
+
+// Describe implements DescribedSource
+func (s *fileSource) Describe() string {
+	return absPath(s.path)
+}
+
+type readerSource struct {
+	r    io.Reader
+	desc string
+
+	mx      sync.Mutex
+	fetched bool
+}
+
+// FromReader constructs a source which reads the data from r once, as a
+// single update, and is unmodified ever after, as a stream can't be read
+// again. That includes when reading the data fails partway, so the runner
+// doesn't get to retry. r is not closed.
+func FromReader(r io.Reader) Source {
+	return &readerSource{r: r, desc: fmt.Sprintf("reader %T", r)}
+}
+
+// FromStdin is the same as FromReader(os.Stdin), e.g. for a tool to be fed
+// the data with "cat config.json | tool". The data is everything up to EOF,
+// so the update only completes once the writing end closes the pipe.
+func FromStdin() Source {
+	return &readerSource{r: os.Stdin, desc: "stdin"}
+}
+
+func (s *readerSource) Fetch(ifNewerThan time.Time) (io.ReadCloser, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.fetched {
+		return nil, ErrUnmodified
+	}
+	s.fetched = true
+	return ioutil.NopCloser(s.r), nil
+}
+
+// Describe implements DescribedSource
+func (s *readerSource) Describe() string {
+	return s.desc
+}
+
+// ErrFetchTimeout is returned by sources wrapped with WithTimeout when the
+// fetch doesn't complete in time.
+var ErrFetchTimeout = errors.New("fetch timed out")
+
+type timeoutSource struct {
+	s Source
+	d time.Duration
+}
+
+// WithTimeout makes a source give up if its Fetch doesn't return within d, in
+// which case ErrFetchTimeout is returned. The slow fetch is abandoned and
+// its result is closed whenever it eventually completes. Note that if the
+// underlying fetch is stuck for good, the goroutine running it lingers. Only
+// the Fetch call is timed, not reading from the returned data.
+func WithTimeout(d time.Duration) SourceMiddleware {
+	return func(s Source) Source {
+		return &timeoutSource{s, d}
+	}
+}
+
+func (s *timeoutSource) Fetch(ifNewerThan time.Time) (io.ReadCloser, error) {
+	type result struct {
+		rc  io.ReadCloser
+		err error
+	}
+	chResult := make(chan result, 1)
+	go func() {
+		rc, err := s.s.Fetch(ifNewerThan)
+		chResult <- result{rc, err}
+	}()
+	timer := time.NewTimer(s.d)
+	defer timer.Stop()
+	select {
+	case r := <-chResult:
+		return r.rc, r.err
+	case <-timer.C:
+		go func() {
+			if r := <-chResult; r.rc != nil {
+				r.rc.Close()
+			}
+		}()
+		return nil, ErrFetchTimeout
+	}
+}
+
+// Describe implements DescribedSource
+func (s *timeoutSource) Describe() string {
+	return fmt.Sprintf("%v with timeout %v", describe(s.s), s.d)
+}
+
+// ResetConditions implements ResettableSource
+func (s *timeoutSource) ResetConditions() {
+	resetConditions(s.s)
+}
+
+// ErrReadIdleTimeout is returned when reading from sources wrapped with
+// WithReadIdleTimeout if no data arrives in time.
+var ErrReadIdleTimeout = errors.New("read idle timeout")
+
+type idleTimeoutSource struct {
+	s Source
+	d time.Duration
+}
+
+// WithReadIdleTimeout makes a source fail reading the data with
+// ErrReadIdleTimeout if a read gets no data for d, e.g. when the connection
+// is up but the server has stopped sending. Unlike WithTimeout, it doesn't
+// limit how long the whole data takes as long as it keeps coming. The reader
+// returned by the source is closed on timeout to unblock the read, which
+// works for network connections but not necessarily for other readers.
+func WithReadIdleTimeout(d time.Duration) SourceMiddleware {
+	return func(s Source) Source {
+		return &idleTimeoutSource{s, d}
+	}
+}
+
+func (s *idleTimeoutSource) Fetch(ifNewerThan time.Time) (io.ReadCloser, error) {
+	rc, err := s.s.Fetch(ifNewerThan)
+	if err != nil {
+		return nil, err
+	}
+	r := &idleTimeoutReader{rc: rc, d: s.d}
+	r.timer = time.AfterFunc(s.d, r.onTimeout)
+	r.timer.Stop()
+	return withMetadata(r, metadataOf(rc)), nil
+}
+
+// Describe implements DescribedSource
+func (s *idleTimeoutSource) Describe() string {
+	return fmt.Sprintf("%v with read idle timeout %v", describe(s.s), s.d)
+}
+
+// ResetConditions implements ResettableSource
+func (s *idleTimeoutSource) ResetConditions() {
+	resetConditions(s.s)
+}
+
+type idleTimeoutReader struct {
+	rc        io.ReadCloser
+	d         time.Duration
+	timer     *time.Timer
+	timedOut  int32
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	// Only the time blocked in Read counts, not that spent by the caller
+	r.timer.Reset(r.d)
+	n, err := r.rc.Read(p)
+	r.timer.Stop()
+	if atomic.LoadInt32(&r.timedOut) == 1 {
+		return n, ErrReadIdleTimeout
+	}
+	return n, err
+}
+
+func (r *idleTimeoutReader) onTimeout() {
+	atomic.StoreInt32(&r.timedOut, 1)
+	r.close()
+}
+
+func (r *idleTimeoutReader) Close() error {
+	r.timer.Stop()
+	return r.close()
+}
+
+func (r *idleTimeoutReader) close() error {
+	r.closeOnce.Do(func() {
+		r.closeErr = r.rc.Close()
+	})
+	return r.closeErr
+}
+
+type unconditionalSource struct {
+	s Source
+}
+
+// Unconditional wraps a source to always fetch the data, ignoring
+// ifNewerThan, for sources where conditional requests are counterproductive,
+// e.g. signed URLs which rotate. The tradeoff is that the whole data is
+// downloaded on every fetch, so it's usually combined with
+// Runner.DedupeByContent to avoid writing the same data to the sinks over and
+// over again.
+func Unconditional(s Source) Source {
+	return &unconditionalSource{s}
+}
+
+func (s *unconditionalSource) Fetch(ifNewerThan time.Time) (io.ReadCloser, error) {
+	return s.s.Fetch(time.Time{})
+}
+
+// Describe implements DescribedSource
+func (s *unconditionalSource) Describe() string {
+	return describe(s.s) + " unconditionally"
+}
+
+// ResetConditions implements ResettableSource
+func (s *unconditionalSource) ResetConditions() {
+	resetConditions(s.s)
 }
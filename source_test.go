@@ -0,0 +1,1636 @@
+package keepcurrent
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/mholt/archiver/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+type slowSource struct {
+	delay  time.Duration
+	closed int32
+}
+
+func (s *slowSource) Fetch(ifNewerThan time.Time) (io.ReadCloser, error) {
+	time.Sleep(s.delay)
+	return &closeTracker{ioutil.NopCloser(strings.NewReader("abcde")), &s.closed}, nil
+}
+
+type closeTracker struct {
+	io.ReadCloser
+	closed *int32
+}
+
+func (c *closeTracker) Close() error {
+	atomic.StoreInt32(c.closed, 1)
+	return c.ReadCloser.Close()
+}
+
+func TestWithTimeout(t *testing.T) {
+	s := &slowSource{delay: 50 * time.Millisecond}
+	_, err := WithTimeout(10 * time.Millisecond)(s).Fetch(time.Time{})
+	assert.Equal(t, ErrFetchTimeout, err)
+	time.Sleep(100 * time.Millisecond)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&s.closed), "abandoned fetch should be closed")
+
+	s = &slowSource{delay: 0}
+	rc, err := WithTimeout(time.Second)(s).Fetch(time.Time{})
+	if assert.NoError(t, err) {
+		b, _ := ioutil.ReadAll(rc)
+		assert.Equal(t, "abcde", string(b))
+		rc.Close()
+	}
+}
+
+type staticSource struct {
+	data         string
+	lastModified time.Time
+}
+
+func (s *staticSource) Fetch(ifNewerThan time.Time) (io.ReadCloser, error) {
+	if !ifNewerThan.IsZero() && !ifNewerThan.Before(s.lastModified) {
+		return nil, ErrUnmodified
+	}
+	return ioutil.NopCloser(strings.NewReader(s.data)), nil
+}
+
+func TestFromConcat(t *testing.T) {
+	now := time.Now()
+	base := &staticSource{"base", now.Add(-time.Hour)}
+	overlay := &staticSource{"overlay", now.Add(-time.Hour)}
+	s := FromConcatWithSeparator([]byte("\n"), base, overlay)
+	fetch := func(ifNewerThan time.Time) (string, error) {
+		rc, err := s.Fetch(ifNewerThan)
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+		b, err := ioutil.ReadAll(rc)
+		return string(b), err
+	}
+
+	data, err := fetch(time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, "base\noverlay", data)
+
+	_, err = fetch(now)
+	assert.Equal(t, ErrUnmodified, err)
+
+	overlay.data = "changed"
+	overlay.lastModified = now.Add(time.Hour)
+	data, err = fetch(now)
+	assert.NoError(t, err)
+	assert.Equal(t, "base\nchanged", data, "unmodified sources should be fetched again")
+}
+
+func TestFromWebAcceptGzip(t *testing.T) {
+	payload := strings.Repeat("compressible ", 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Accept-Encoding") != "gzip" {
+			io.WriteString(w, payload)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gzw := gzip.NewWriter(w)
+		io.WriteString(gzw, payload)
+		gzw.Close()
+	}))
+	defer srv.Close()
+
+	ch := make(chan []byte, 1)
+	runner := New(FromWebWithOptions(srv.URL, WebOptions{AcceptGzip: true}), ToChannel(ch))
+	runner.OnSourceError = func(err error, tries int) time.Duration {
+		assert.NoError(t, err)
+		return 0
+	}
+	runner.InitFrom(runner.source)
+	assert.Equal(t, payload, string(<-ch))
+}
+
+func TestFromWebWithTransport(t *testing.T) {
+	lastModified := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.ServeContent(w, req, "", lastModified, strings.NewReader("data"))
+	}))
+	defer srv.Close()
+
+	var dials int32
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+	defer transport.CloseIdleConnections()
+	s := FromWebWithTransport(srv.URL, transport)
+	rc, err := s.Fetch(time.Time{})
+	if assert.NoError(t, err) {
+		b, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		assert.Equal(t, "data", string(b))
+	}
+	_, err = s.Fetch(lastModified)
+	assert.Equal(t, ErrUnmodified, err, "conditional requests should still apply")
+	assert.EqualValues(t, 1, atomic.LoadInt32(&dials), "should send the requests through the transport, reusing the connection")
+}
+
+func TestFromWebPost(t *testing.T) {
+	response := "v1"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if req.Method != http.MethodPost || string(body) != `{"query":"{config}"}` ||
+			req.Header.Get("Content-Type") != "application/json" || req.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		io.WriteString(w, response)
+	}))
+	defer srv.Close()
+
+	s := FromWebPostWithOptions(srv.URL, []byte(`{"query":"{config}"}`), WebOptions{Header: http.Header{
+		"Content-Type":  []string{"application/json"},
+		"Authorization": []string{"Bearer token"},
+	}})
+	rc, err := s.Fetch(time.Time{})
+	if assert.NoError(t, err) {
+		b, _ := ioutil.ReadAll(rc)
+		assert.Equal(t, "v1", string(b))
+	}
+	_, err = s.Fetch(time.Now())
+	assert.Equal(t, ErrUnmodified, err, "same response should be unmodified")
+	response = "v2"
+	rc, err = s.Fetch(time.Now())
+	if assert.NoError(t, err) {
+		b, _ := ioutil.ReadAll(rc)
+		assert.Equal(t, "v2", string(b))
+	}
+}
+
+func TestFromWebPostRetriesAfterSinkError(t *testing.T) {
+	response := "v1"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, response)
+	}))
+	defer srv.Close()
+
+	sink := &flakySink{}
+	runner := New(FromWebPost(srv.URL, []byte("query"), nil), sink)
+	assert.True(t, runner.Sync().Changed)
+	response = "v2"
+	sink.err = errors.New("unavailable")
+	assert.False(t, runner.Sync().Changed)
+	sink.err = nil
+	result := runner.Sync()
+	assert.True(t, result.Changed, "data which failed to be written should not be unmodified")
+	assert.False(t, result.Unmodified)
+	assert.Equal(t, [][]byte{[]byte("v1"), []byte("v2")}, sink.received)
+	assert.True(t, runner.Sync().Unmodified)
+}
+
+func TestWrappedWebRetriesAfterSinkError(t *testing.T) {
+	response := "v1"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("ETag", `"`+response+`"`)
+		if req.Header.Get("If-None-Match") == `"`+response+`"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		io.WriteString(w, response)
+	}))
+	defer srv.Close()
+
+	wrappers := map[string]func(Source) Source{
+		"timeout":      func(s Source) Source { return Chain(s, WithTimeout(time.Minute)) },
+		"fallback":     func(s Source) Source { return FromFallback(s) },
+		"content type": func(s Source) Source { return Chain(s, WithContentType("text/plain")) },
+	}
+	for name, wrap := range wrappers {
+		response = "v1"
+		sink := &flakySink{}
+		runner := New(wrap(FromWeb(srv.URL)), sink)
+		assert.True(t, runner.Sync().Changed, name)
+		response = "v2"
+		sink.err = errors.New("unavailable")
+		assert.False(t, runner.Sync().Changed, name)
+		sink.err = nil
+		assert.True(t, runner.Sync().Changed, "%v: data which failed to be written should not be unmodified", name)
+		assert.Equal(t, [][]byte{[]byte("v1"), []byte("v2")}, sink.received, name)
+	}
+}
+
+func TestFromWebReusesConnectionOnError(t *testing.T) {
+	var newConns int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "try again later")
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&newConns, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	s := FromWebWithClient(srv.URL, srv.Client())
+	for i := 0; i < 20; i++ {
+		_, err := s.Fetch(time.Time{})
+		assert.Error(t, err)
+	}
+	assert.EqualValues(t, 1, atomic.LoadInt32(&newConns), "connection should be reused")
+}
+
+func TestWithJSONSchema(t *testing.T) {
+	schema := []byte(`{
+		"type": "object",
+		"properties": {"port": {"type": "integer"}},
+		"required": ["port"]
+	}`)
+	rc, err := WithJSONSchema(schema)(&staticSource{data: `{"port": 8080}`}).Fetch(time.Time{})
+	if assert.NoError(t, err) {
+		b, _ := ioutil.ReadAll(rc)
+		assert.Equal(t, `{"port": 8080}`, string(b))
+	}
+	_, err = WithJSONSchema(schema)(&staticSource{data: `{"port": "8080"}`}).Fetch(time.Time{})
+	assert.Error(t, err)
+	_, err = WithJSONSchema(schema)(&staticSource{data: `not json`}).Fetch(time.Time{})
+	assert.Error(t, err)
+	_, err = WithJSONSchema([]byte(`{`))(&staticSource{data: `{"port": 8080}`}).Fetch(time.Time{})
+	assert.Error(t, err)
+}
+
+func makeTar(t *testing.T, nameAndContents ...string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for i := 0; i < len(nameAndContents); i += 2 {
+		content := nameAndContents[i+1]
+		assert.NoError(t, tw.WriteHeader(&tar.Header{Name: nameAndContents[i], Mode: 0644, Size: int64(len(content))}))
+		_, err := io.WriteString(tw, content)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func makeTarGz(t *testing.T, nameAndContents ...string) string {
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	_, err := gzw.Write(makeTar(t, nameAndContents...))
+	assert.NoError(t, err)
+	assert.NoError(t, gzw.Close())
+	return buf.String()
+}
+
+func TestFromTarGzMatch(t *testing.T) {
+	archive := &staticSource{data: makeTarGz(t,
+		"README", "readme",
+		"config-20240101.json", "old",
+		"config-20240301.json", "new",
+		"config-20240201.json", "middle")}
+	fetch := func(s Source) (string, error) {
+		rc, err := s.Fetch(time.Time{})
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+		b, err := ioutil.ReadAll(rc)
+		return string(b), err
+	}
+
+	data, err := fetch(FromTarGz(archive, "README"))
+	assert.NoError(t, err)
+	assert.Equal(t, "readme", data)
+	data, err = fetch(FromTarGzMatch(archive, "config-*.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, "old", data)
+	data, err = fetch(FromTarGzMatchLatest(archive, "config-*.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, "new", data)
+
+	_, err = fetch(FromTarGzMatch(archive, "*.yaml"))
+	assert.Equal(t, errNotFoundInArchive, err)
+	_, err = fetch(FromTarGzMatchLatest(archive, "*.yaml"))
+	assert.Equal(t, errNotFoundInArchive, err)
+	_, err = fetch(FromTarGzMatch(archive, "[bad"))
+	assert.Error(t, err)
+}
+
+func TestFromTarGzWithArchiver(t *testing.T) {
+	archive := &staticSource{data: makeTarGz(t, "config.json", "data")}
+	tarGz := archiver.NewTarGz()
+	tarGz.SingleThreaded = true
+	tarGz.ContinueOnError = true
+	for _, tg := range []*archiver.TarGz{tarGz, {}} {
+		s := FromTarGzWithArchiver(archive, "config.json", tg)
+		for i := 0; i < 2; i++ {
+			rc, err := s.Fetch(time.Time{})
+			if assert.NoError(t, err) {
+				b, _ := ioutil.ReadAll(rc)
+				rc.Close()
+				assert.Equal(t, "data", string(b), "archiver should be reusable")
+			}
+		}
+	}
+}
+
+func TestFromWebETags(t *testing.T) {
+	for _, etag := range []string{`"v1"`, `W/"v1"`} {
+		var ifNoneMatch string
+		honorConditional := true
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			ifNoneMatch = req.Header.Get("If-None-Match")
+			if honorConditional && ifNoneMatch != "" && etagWeakMatch(ifNoneMatch, etag) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", etag)
+			io.WriteString(w, "data")
+		}))
+
+		s := FromWeb(srv.URL)
+		_, err := s.Fetch(time.Time{})
+		assert.NoError(t, err)
+		_, err = s.Fetch(time.Now())
+		assert.Equal(t, ErrUnmodified, err)
+		assert.Equal(t, etag, ifNoneMatch, "ETag should be sent back verbatim")
+
+		honorConditional = false
+		_, err = s.Fetch(time.Now())
+		assert.Equal(t, ErrUnmodified, err, "same ETag should be unmodified even if the server ignores If-None-Match")
+		srv.Close()
+	}
+
+	assert.True(t, etagWeakMatch(`W/"v1"`, `"v1"`))
+	assert.True(t, etagWeakMatch(`W/"v1"`, `W/"v1"`))
+	assert.False(t, etagWeakMatch(`W/"v1"`, `W/"v2"`))
+	assert.False(t, etagWeakMatch(`"v1"`, ``))
+}
+
+func TestFromWebNotModifiedSkipsSinks(t *testing.T) {
+	var requests, notModified int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		io.WriteString(w, "data")
+	}))
+	defer srv.Close()
+
+	sink := &recordingSink{}
+	s := FromWeb(srv.URL)
+	runner := New(s, sink)
+	runner.InitFrom(s)
+	runner.InitFrom(s)
+	runner.InitFrom(s)
+	assert.EqualValues(t, 3, atomic.LoadInt32(&requests))
+	assert.EqualValues(t, 2, atomic.LoadInt32(&notModified))
+	assert.Len(t, sink.received, 1, "a 304 should not write to the sinks")
+	assert.EqualValues(t, 1, runner.SyncCount())
+	assert.EqualValues(t, 2, runner.UnmodifiedCount())
+}
+
+func TestFromWebWithTLS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if !assert.NoError(t, err) {
+		return
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "client"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if !assert.NoError(t, err) {
+		return
+	}
+	clientCert, _ := x509.ParseCertificate(der)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Encoding", "gzip")
+		gzw := gzip.NewWriter(w)
+		io.WriteString(gzw, "secret config")
+		gzw.Close()
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	srv.StartTLS()
+	defer srv.Close()
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(srv.Certificate())
+
+	s := FromWebWithTLS(srv.URL, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, rootCAs)
+	rc, err := s.Fetch(time.Time{})
+	if assert.NoError(t, err) {
+		b, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		assert.Equal(t, "secret config", string(b), "should decompress transparently")
+	}
+	_, err = s.Fetch(time.Now())
+	assert.Equal(t, ErrUnmodified, err)
+
+	_, err = FromWebWithTLS(srv.URL, tls.Certificate{}, rootCAs).Fetch(time.Time{})
+	assert.Error(t, err, "should fail without client certificate")
+}
+
+func TestFromArchive(t *testing.T) {
+	plain := makeTar(t, "README", "readme", "config.json", "config")
+	var bz2 bytes.Buffer
+	assert.NoError(t, archiver.NewBz2().Compress(bytes.NewReader(plain), &bz2))
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	for _, name := range []string{"README", "config.json"} {
+		w, err := zw.Create(name)
+		if assert.NoError(t, err) {
+			io.WriteString(w, strings.ToLower(strings.TrimSuffix(name, ".json")))
+		}
+	}
+	assert.NoError(t, zw.Close())
+
+	for format, archive := range map[string]string{
+		"tar":     string(plain),
+		"tar.gz":  makeTarGz(t, "README", "readme", "config.json", "config"),
+		"tar.bz2": bz2.String(),
+		"zip":     zipped.String(),
+	} {
+		rc, err := FromArchive(&staticSource{data: archive}, "config.json").Fetch(time.Time{})
+		if assert.NoError(t, err, format) {
+			b, _ := ioutil.ReadAll(rc)
+			rc.Close()
+			assert.Equal(t, "config", string(b), format)
+		}
+		_, err = FromArchive(&staticSource{data: archive}, "missing").Fetch(time.Time{})
+		assert.Equal(t, errNotFoundInArchive, err, format)
+	}
+	_, err := FromArchive(&staticSource{data: "not an archive"}, "config.json").Fetch(time.Time{})
+	assert.Equal(t, errUnknownArchiveFormat, err)
+}
+
+type flakySource struct {
+	staticSource
+	err error
+}
+
+func (s *flakySource) Fetch(ifNewerThan time.Time) (io.ReadCloser, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.staticSource.Fetch(ifNewerThan)
+}
+
+func TestWithCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keep_current_test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	cachePath := filepath.Join(dir, "cache")
+	origin := &flakySource{staticSource: staticSource{data: "v1", lastModified: time.Now().Add(-time.Hour)}}
+	s := WithCache(cachePath)(origin)
+	fetch := func(ifNewerThan time.Time) (string, Metadata, error) {
+		rc, err := s.Fetch(ifNewerThan)
+		if err != nil {
+			return "", Metadata{}, err
+		}
+		defer rc.Close()
+		b, err := ioutil.ReadAll(rc)
+		return string(b), metadataOf(rc), err
+	}
+
+	origin.err = errors.New("unavailable")
+	_, _, err = fetch(time.Time{})
+	assert.EqualError(t, err, "unavailable", "nothing to fall back to")
+
+	origin.err = nil
+	data, md, err := fetch(time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, "v1", data)
+	assert.False(t, md.Stale)
+	cached, _ := ioutil.ReadFile(cachePath)
+	assert.Equal(t, "v1", string(cached), "should write through to the cache")
+
+	// As after a restart
+	data, md, err = fetch(time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, "v1", data, "should serve the cache if the source is unmodified since")
+	assert.False(t, md.Stale)
+	_, _, err = fetch(time.Now())
+	assert.Equal(t, ErrUnmodified, err)
+
+	origin.err = errors.New("unavailable")
+	data, md, err = fetch(time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, "v1", data)
+	assert.True(t, md.Stale, "should serve the cache as stale if the source fails")
+	_, _, err = fetch(time.Now())
+	assert.EqualError(t, err, "unavailable", "caller already has the cached data")
+
+	origin.err = nil
+	origin.data, origin.lastModified = "v2", time.Now().Add(time.Hour)
+	data, _, err = fetch(time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, "v2", data)
+	cached, _ = ioutil.ReadFile(cachePath)
+	assert.Equal(t, "v2", string(cached))
+}
+
+func TestWithCacheStaleSince(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keep_current_test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	origin := &flakySource{staticSource: staticSource{data: "v1", lastModified: time.Now().Add(-time.Hour)}}
+	s := WithCache(filepath.Join(dir, "cache"))(origin)
+	New(s, &recordingSink{}).InitFrom(s)
+
+	// As after a restart
+	origin.err = errors.New("unavailable")
+	sink := &recordingSink{}
+	runner := New(s, sink)
+	runner.InitFrom(s)
+	assert.Len(t, sink.received, 1, "should sync from the cache")
+	staleSince := runner.StaleSince()
+	assert.False(t, staleSince.IsZero(), "sync from the cache should be stale")
+	assert.Equal(t, staleSince, runner.Snapshot().StaleSince)
+
+	origin.err = nil
+	origin.data, origin.lastModified = "v2", time.Now().Add(time.Hour)
+	runner.InitFrom(s)
+	assert.True(t, runner.StaleSince().IsZero(), "sync from the source should not be stale")
+}
+
+func TestFromWebOnResponse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Cache", "HIT")
+		w.Header().Set("Age", "42")
+		io.WriteString(w, "data")
+	}))
+	defer srv.Close()
+
+	var headers []http.Header
+	s := FromWebWithOptions(srv.URL, WebOptions{OnResponse: func(resp *http.Response) {
+		headers = append(headers, resp.Header)
+	}})
+	rc, err := s.Fetch(time.Time{})
+	if assert.NoError(t, err) {
+		b, _ := ioutil.ReadAll(rc)
+		assert.NoError(t, rc.Close())
+		assert.Equal(t, "data", string(b), "body should be intact")
+	}
+	if assert.Len(t, headers, 1) {
+		assert.Equal(t, "HIT", headers[0].Get("X-Cache"))
+		assert.Equal(t, "42", headers[0].Get("Age"))
+	}
+}
+
+func TestFromReader(t *testing.T) {
+	s := FromReader(strings.NewReader("data"))
+	sink := &recordingSink{}
+	runner := New(s, sink)
+	runner.InitFrom(s)
+	runner.InitFrom(s)
+	if assert.Len(t, sink.received, 1, "reader should only be read once") {
+		assert.Equal(t, "data", string(sink.received[0]))
+	}
+	assert.EqualValues(t, 1, runner.UnmodifiedCount())
+	assert.Equal(t, "stdin", describe(FromStdin()))
+}
+
+func TestFreshUntil(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	expires := now.Add(time.Hour).Format(http.TimeFormat)
+	for _, c := range []struct {
+		header http.Header
+		want   time.Time
+	}{
+		{http.Header{}, time.Time{}},
+		{http.Header{"Cache-Control": {"public, max-age=300"}}, now.Add(5 * time.Minute)},
+		{http.Header{"Cache-Control": {"max-age=300"}, "Age": {"100"}}, now.Add(200 * time.Second)},
+		{http.Header{"Cache-Control": {"max-age=300"}, "Expires": {expires}}, now.Add(5 * time.Minute)},
+		{http.Header{"Expires": {expires}}, now.Add(time.Hour)},
+		{http.Header{"Cache-Control": {"no-cache"}, "Expires": {expires}}, time.Time{}},
+		{http.Header{"Cache-Control": {"max-age=bad"}}, time.Time{}},
+	} {
+		assert.True(t, c.want.Equal(freshUntil(c.header, now)), "%v", c.header)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=600")
+		io.WriteString(w, "data")
+	}))
+	defer srv.Close()
+	s := FromWeb(srv.URL).(NextPollSource)
+	assert.True(t, s.NextPoll().IsZero())
+	rc, err := s.Fetch(time.Time{})
+	if assert.NoError(t, err) {
+		rc.Close()
+	}
+	assert.InDelta(t, float64(10*time.Minute), float64(time.Until(s.NextPoll())), float64(time.Second))
+}
+
+func TestFromWebStatusPolicy(t *testing.T) {
+	status := http.StatusNoContent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(status)
+		io.WriteString(w, "data")
+	}))
+	defer srv.Close()
+
+	errTeapot := errors.New("teapot")
+	s := FromWebWithOptions(srv.URL, WebOptions{StatusPolicy: func(resp *http.Response) (StatusAction, error) {
+		switch resp.StatusCode {
+		case http.StatusNoContent:
+			return TreatAsUnmodified, nil
+		case http.StatusNonAuthoritativeInfo:
+			return UseBody, nil
+		case http.StatusTeapot:
+			return TreatAsError, errTeapot
+		}
+		return DefaultStatusPolicy(resp)
+	}})
+	_, err := s.Fetch(time.Time{})
+	assert.Equal(t, ErrUnmodified, err)
+
+	status = http.StatusNonAuthoritativeInfo
+	rc, err := s.Fetch(time.Time{})
+	if assert.NoError(t, err) {
+		b, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		assert.Equal(t, "data", string(b))
+	}
+
+	status = http.StatusTeapot
+	_, err = s.Fetch(time.Time{})
+	assert.Equal(t, errTeapot, err)
+
+	status = http.StatusInternalServerError
+	_, err = s.Fetch(time.Time{})
+	assert.EqualError(t, err, "unexpected HTTP status 500")
+	_, err = FromWeb(srv.URL).Fetch(time.Time{})
+	assert.EqualError(t, err, "unexpected HTTP status 500")
+	var statusErr *HTTPStatusError
+	if assert.True(t, errors.As(err, &statusErr)) {
+		assert.Equal(t, http.StatusInternalServerError, statusErr.StatusCode)
+		assert.True(t, statusErr.Temporary())
+	}
+}
+
+func TestFromWebRedirects(t *testing.T) {
+	var crossOriginHeader http.Header
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		crossOriginHeader = req.Header
+		io.WriteString(w, "data")
+	}))
+	defer other.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/loop":
+			http.Redirect(w, req, "/loop2", http.StatusFound)
+		case "/loop2":
+			http.Redirect(w, req, "/loop", http.StatusFound)
+		case "/chain/3":
+			http.Redirect(w, req, "/chain/2", http.StatusFound)
+		case "/chain/2":
+			http.Redirect(w, req, "/chain/1", http.StatusFound)
+		case "/chain/1":
+			http.Redirect(w, req, "/data", http.StatusFound)
+		case "/cross-origin":
+			http.Redirect(w, req, other.URL, http.StatusFound)
+		case "/data":
+			if req.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"v1"`)
+			io.WriteString(w, "data")
+		}
+	}))
+	defer srv.Close()
+
+	_, err := FromWeb(srv.URL + "/loop").Fetch(time.Time{})
+	var redirectsErr *TooManyRedirectsError
+	if assert.True(t, errors.As(err, &redirectsErr)) {
+		assert.True(t, redirectsErr.Loop)
+		assert.Equal(t, srv.URL+"/loop", redirectsErr.URL)
+		assert.Equal(t, 2, redirectsErr.Redirects)
+	}
+	assert.True(t, isPermanent(err), "redirect errors should not be retried")
+
+	_, err = FromWebWithOptions(srv.URL+"/chain/3", WebOptions{MaxRedirects: 2}).Fetch(time.Time{})
+	if assert.True(t, errors.As(err, &redirectsErr)) {
+		assert.False(t, redirectsErr.Loop)
+		assert.Equal(t, 2, redirectsErr.Redirects)
+		assert.EqualError(t, err, "stopped after 2 redirects at "+srv.URL+"/data")
+	}
+
+	_, err = FromWebWithOptions(srv.URL+"/chain/1", WebOptions{NoRedirects: true}).Fetch(time.Time{})
+	var statusErr *HTTPStatusError
+	if assert.True(t, errors.As(err, &statusErr)) {
+		assert.Equal(t, http.StatusFound, statusErr.StatusCode)
+	}
+
+	s := FromWebWithOptions(srv.URL+"/chain/3", WebOptions{MaxRedirects: 3})
+	rc, err := s.Fetch(time.Time{})
+	if assert.NoError(t, err) {
+		rc.Close()
+	}
+	_, err = s.Fetch(time.Now())
+	assert.Equal(t, ErrUnmodified, err, "conditional headers should be kept on the same origin")
+
+	s = FromWeb(srv.URL + "/cross-origin")
+	s.(ConditionalSource).SetETag(`"v1"`)
+	rc, err = s.Fetch(time.Now())
+	if assert.NoError(t, err) {
+		rc.Close()
+	}
+	assert.Empty(t, crossOriginHeader.Get("If-None-Match"))
+	assert.Empty(t, crossOriginHeader.Get("If-Modified-Since"))
+}
+
+func TestFromJSONMerge(t *testing.T) {
+	now := time.Now()
+	base := &staticSource{`{"port": 80, "tls": {"enabled": false, "cert": "a.pem"}, "hosts": ["a", "b"]}`, now.Add(-time.Hour)}
+	overlay := &staticSource{`{"tls": {"enabled": true}, "hosts": ["c"], "debug": true}`, now.Add(-time.Hour)}
+	fetch := func(s Source, ifNewerThan time.Time) (string, error) {
+		rc, err := s.Fetch(ifNewerThan)
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+		b, err := ioutil.ReadAll(rc)
+		return string(b), err
+	}
+
+	s := FromJSONMerge(base, overlay)
+	data, err := fetch(s, time.Time{})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"port": 80, "tls": {"enabled": true, "cert": "a.pem"}, "hosts": ["c"], "debug": true}`, data)
+	_, err = fetch(s, now)
+	assert.Equal(t, ErrUnmodified, err)
+
+	_, err = fetch(FromJSONMerge(base, &staticSource{data: `{"tls": "off"}`}), time.Time{})
+	assert.EqualError(t, err, "merging source 1: conflicting types at /tls: map[string]interface {} and string")
+	_, err = fetch(FromJSONMerge(base, &staticSource{data: `["not", "an", "object"]`}), time.Time{})
+	assert.Error(t, err)
+	_, err = fetch(FromJSONMerge(base, &staticSource{data: `not json`}), time.Time{})
+	assert.Error(t, err)
+}
+
+func TestWithReadIdleTimeout(t *testing.T) {
+	chDone := make(chan struct{})
+	defer close(chDone)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for i := 0; i < 5; i++ {
+			io.WriteString(w, "x")
+			w.(http.Flusher).Flush()
+			time.Sleep(20 * time.Millisecond)
+		}
+		if req.URL.Path == "/stall" {
+			select {
+			case <-chDone:
+			case <-req.Context().Done():
+			}
+		}
+	}))
+	defer srv.Close()
+
+	rc, err := WithReadIdleTimeout(60 * time.Millisecond)(FromWeb(srv.URL + "/trickle")).Fetch(time.Time{})
+	if assert.NoError(t, err) {
+		b, err := ioutil.ReadAll(rc)
+		assert.NoError(t, err, "data trickling in should not time out")
+		assert.Equal(t, "xxxxx", string(b))
+		rc.Close()
+	}
+
+	rc, err = WithReadIdleTimeout(60 * time.Millisecond)(FromWeb(srv.URL + "/stall")).Fetch(time.Time{})
+	if assert.NoError(t, err) {
+		b, err := ioutil.ReadAll(rc)
+		assert.Equal(t, ErrReadIdleTimeout, err)
+		assert.Equal(t, "xxxxx", string(b))
+		rc.Close()
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	web := FromWeb("https://example.com/config.json")
+	wd, _ := os.Getwd()
+	file := FromFile("config.json")
+	for _, c := range []struct {
+		s    Source
+		desc string
+	}{
+		{web, "https://example.com/config.json"},
+		{FromWebPost("https://example.com/graphql", nil, nil), "POST https://example.com/graphql"},
+		{file, filepath.Join(wd, "config.json")},
+		{FromTarGz(web, "config.json"), "config.json in tar.gz from https://example.com/config.json"},
+		{FromArchive(file, "a.json"), "a.json in archive from " + filepath.Join(wd, "config.json")},
+		{WithTimeout(time.Second)(web), "https://example.com/config.json with timeout 1s"},
+		{FromConcat(web, &staticSource{}), "concatenation of https://example.com/config.json, *keepcurrent.staticSource"},
+		{FromJSONMerge(web, web), "JSON merge of https://example.com/config.json, https://example.com/config.json"},
+	} {
+		assert.Equal(t, c.desc, describe(c.s))
+	}
+	err := &SourceError{Source: web, Err: errors.New("timeout"), Tries: 2}
+	assert.Equal(t, "error fetching from https://example.com/config.json after 2 tries: timeout", err.Error())
+}
+
+func TestChain(t *testing.T) {
+	web := FromWeb("https://example.com/config.json")
+	s := Chain(web, WithTimeout(time.Second), WithCache("cache.json"), Unconditional)
+	assert.Equal(t, "https://example.com/config.json with timeout 1s cached at "+absPath("cache.json")+" unconditionally", describe(s))
+	assert.Equal(t, web, Chain(web))
+
+	sink := ChainSink(ToFile("config.json"), Required)
+	assert.True(t, isRequired(sink))
+	sink = ChainSink(ToFile("config.json"), Verified, RateLimitSink(time.Minute), ToBatched(10, 0), WithinWindow(func(time.Time) bool { return true }), Required)
+	assert.True(t, isRequired(sink))
+	assert.Equal(t, "batched rate limited file sink to "+absPath("config.json")+" verified within window", sink.String())
+}
+
+func TestFromWebConditionalState(t *testing.T) {
+	lastModified := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var ifNoneMatch, ifModifiedSince string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ifNoneMatch = req.Header.Get("If-None-Match")
+		ifModifiedSince = req.Header.Get("If-Modified-Since")
+		if ifNoneMatch == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		io.WriteString(w, "data")
+	}))
+	defer srv.Close()
+
+	s := FromWeb(srv.URL).(ConditionalSource)
+	_, err := s.Fetch(time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, `"v1"`, s.ETag())
+	assert.True(t, lastModified.Equal(s.LastModified()))
+
+	restored := FromWeb(srv.URL).(ConditionalSource)
+	restored.SetETag(s.ETag())
+	restored.SetLastModified(s.LastModified())
+	_, err = restored.Fetch(time.Time{})
+	assert.Equal(t, ErrUnmodified, err, "seeded state should make the first fetch conditional")
+	assert.Equal(t, lastModified.Format(http.TimeFormat), ifModifiedSince)
+
+	restored.ResetConditions()
+	rc, err := restored.Fetch(time.Now())
+	if assert.NoError(t, err, "reset should force a full fetch") {
+		rc.Close()
+	}
+	assert.Empty(t, ifNoneMatch)
+	assert.Empty(t, ifModifiedSince)
+	_, err = restored.Fetch(time.Now())
+	assert.Equal(t, ErrUnmodified, err, "fetches after the reset should be conditional again")
+}
+
+func TestFromDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keep_current_test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	old := time.Now().Add(-time.Hour)
+	write := func(name, data string) {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, ioutil.WriteFile(path, []byte(data), 0644))
+		assert.NoError(t, os.Chtimes(path, old, old))
+	}
+	write("20-b.conf", "b\n")
+	write("10-a.conf", "a\n")
+	write("ignored.txt", "x\n")
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "sub.conf"), 0755))
+
+	s := FromDir(dir, "*.conf")
+	fetch := func(ifNewerThan time.Time) (string, error) {
+		rc, err := s.Fetch(ifNewerThan)
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+		b, err := ioutil.ReadAll(rc)
+		return string(b), err
+	}
+	data, err := fetch(time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, "a\nb\n", data, "files should be concatenated in order")
+	_, err = fetch(time.Now())
+	assert.Equal(t, ErrUnmodified, err)
+
+	write("15-c.conf", "c\n")
+	data, err = fetch(time.Now())
+	assert.NoError(t, err, "added file should be a change even if it looks older")
+	assert.Equal(t, "a\nc\nb\n", data)
+
+	assert.NoError(t, os.Remove(filepath.Join(dir, "20-b.conf")))
+	data, err = fetch(time.Now())
+	assert.NoError(t, err, "removed file should be a change")
+	assert.Equal(t, "a\nc\n", data)
+	_, err = fetch(time.Now())
+	assert.Equal(t, ErrUnmodified, err)
+}
+
+func TestAutoDecompress(t *testing.T) {
+	fetch := func(data string) (string, error) {
+		rc, err := AutoDecompress(&staticSource{data: data}).Fetch(time.Time{})
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+		b, err := ioutil.ReadAll(rc)
+		return string(b), err
+	}
+	var gzipped bytes.Buffer
+	gzw := gzip.NewWriter(&gzipped)
+	gzw.Write([]byte("gzipped"))
+	gzw.Close()
+	data, err := fetch(gzipped.String())
+	assert.NoError(t, err)
+	assert.Equal(t, "gzipped", data)
+
+	enc, _ := zstd.NewWriter(nil)
+	data, err = fetch(string(enc.EncodeAll([]byte("zstd"), nil)))
+	assert.NoError(t, err)
+	assert.Equal(t, "zstd", data)
+
+	rc, err := AutoDecompress(Chain(&staticSource{data: gzipped.String()}, WithContentType("application/gzip"))).Fetch(time.Time{})
+	if assert.NoError(t, err) {
+		rc.Close()
+		assert.Empty(t, metadataOf(rc).ContentType, "should not label the decompressed data with the type of the compressed data")
+	}
+
+	data, err = fetch("plain")
+	assert.NoError(t, err)
+	assert.Equal(t, "plain", data, "unknown format should be passed on as is")
+	data, err = fetch("")
+	assert.NoError(t, err)
+	assert.Equal(t, "", data)
+
+	RegisterDecompressor([]byte("ROT13:"), func(r io.Reader) (io.ReadCloser, error) {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(strings.NewReader(strings.Map(func(r rune) rune {
+			if r >= 'a' && r <= 'z' {
+				return 'a' + (r-'a'+13)%26
+			}
+			return r
+		}, strings.TrimPrefix(string(b), "ROT13:")))), nil
+	})
+	data, err = fetch("ROT13:phfgbz")
+	assert.NoError(t, err)
+	assert.Equal(t, "custom", data)
+}
+
+func TestFromFallback(t *testing.T) {
+	primary := &flakySource{staticSource: staticSource{data: "primary"}}
+	secondary := &flakySource{staticSource: staticSource{data: "secondary"}}
+	tertiary := &flakySource{staticSource: staticSource{data: "tertiary"}}
+	type failover struct {
+		from, to int
+		err      error
+	}
+	failovers := make(chan failover, 10)
+	recovers := make(chan int, 10)
+	s := FromFallbackWithOptions(FallbackOptions{
+		OnFailover: func(from, to int, err error) { failovers <- failover{from, to, err} },
+		OnRecover:  func(from int) { recovers <- from },
+	}, primary, secondary, tertiary)
+	fetch := func() (string, error) {
+		rc, err := s.Fetch(time.Time{})
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+		b, err := ioutil.ReadAll(rc)
+		return string(b), err
+	}
+
+	data, err := fetch()
+	assert.NoError(t, err)
+	assert.Equal(t, "primary", data)
+
+	primary.err, secondary.err = errors.New("primary down"), errors.New("secondary down")
+	data, err = fetch()
+	assert.NoError(t, err)
+	assert.Equal(t, "tertiary", data)
+	assert.ElementsMatch(t, []failover{{0, 1, primary.err}, {1, 2, secondary.err}}, []failover{<-failovers, <-failovers})
+
+	tertiary.err = errors.New("tertiary down")
+	_, err = fetch()
+	assert.Equal(t, tertiary.err, err, "should fail with the last error")
+	<-failovers
+	<-failovers
+
+	primary.err = nil
+	data, err = fetch()
+	assert.NoError(t, err)
+	assert.Equal(t, "primary", data)
+	assert.Equal(t, 2, <-recovers)
+	assert.Empty(t, failovers)
+	assert.Equal(t, "fallback of *keepcurrent.flakySource, *keepcurrent.flakySource, *keepcurrent.flakySource", describe(s))
+}
+
+func TestFromWebCompareByLength(t *testing.T) {
+	body := "data"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer srv.Close()
+
+	fetch := func(s Source) (string, error) {
+		rc, err := s.Fetch(time.Now())
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+		b, err := ioutil.ReadAll(rc)
+		return string(b), err
+	}
+	s := FromWebWithOptions(srv.URL, WebOptions{CompareByLength: true})
+	data, err := fetch(s)
+	assert.NoError(t, err)
+	assert.Equal(t, "data", data)
+	_, err = fetch(s)
+	assert.Equal(t, ErrUnmodified, err, "same length and hash should be unmodified")
+
+	body = "DATA"
+	data, err = fetch(s)
+	assert.NoError(t, err, "same length but different hash should be modified")
+	assert.Equal(t, "DATA", data)
+	_, err = fetch(s)
+	assert.Equal(t, ErrUnmodified, err)
+
+	body = "new data"
+	data, err = fetch(s)
+	assert.NoError(t, err)
+	assert.Equal(t, "new data", data)
+	_, err = fetch(s)
+	assert.Equal(t, ErrUnmodified, err)
+
+	rc, err := s.Fetch(time.Time{})
+	if assert.NoError(t, err, "unconditional fetch should not be unmodified") {
+		rc.Close()
+	}
+
+	data, err = fetch(FromWeb(srv.URL))
+	assert.NoError(t, err, "should be opt-in")
+	assert.Equal(t, "new data", data)
+}
+
+func TestFromWebCompareByLengthGzip(t *testing.T) {
+	var compressed bytes.Buffer
+	gzw := gzip.NewWriter(&compressed)
+	io.WriteString(gzw, strings.Repeat("compressible ", 100))
+	gzw.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.Itoa(compressed.Len()))
+		w.Write(compressed.Bytes())
+	}))
+	defer srv.Close()
+
+	s := FromWebWithOptions(srv.URL, WebOptions{CompareByLength: true, AcceptGzip: true})
+	rc, err := s.Fetch(time.Now())
+	if assert.NoError(t, err) {
+		b, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		assert.Equal(t, strings.Repeat("compressible ", 100), string(b))
+	}
+	_, err = s.Fetch(time.Now())
+	assert.Equal(t, ErrUnmodified, err, "same length and hash should be unmodified when decompressing")
+}
+
+func TestFromManifest(t *testing.T) {
+	artifacts := map[string]string{"/v1": "version 1", "/v2": "version 2", "/v3": "tampered"}
+	var artifactFetches int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		data, found := artifacts[req.URL.Path]
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		atomic.AddInt32(&artifactFetches, 1)
+		io.WriteString(w, data)
+	}))
+	defer srv.Close()
+
+	manifest := &staticSource{data: "/v1", lastModified: time.Now()}
+	resolve := func(data []byte) (string, []byte, error) {
+		if len(data) == 0 {
+			return "", nil, errors.New("empty manifest")
+		}
+		sha := sha256.Sum256([]byte(artifacts[string(data)]))
+		return srv.URL + string(data), sha[:], nil
+	}
+	s := FromManifest(manifest, resolve)
+	sink := &recordingSink{}
+	runner := New(s, sink)
+	runner.InitFrom(s)
+	if assert.Len(t, sink.received, 1) {
+		assert.Equal(t, "version 1", string(sink.received[0]))
+	}
+
+	_, err := s.Fetch(time.Now().Add(time.Hour))
+	assert.Equal(t, ErrUnmodified, err, "should be unmodified if the manifest is")
+	manifest.lastModified = time.Now().Add(2 * time.Hour)
+	_, err = s.Fetch(time.Now().Add(time.Hour))
+	assert.Equal(t, ErrUnmodified, err, "should be unmodified if the manifest resolves to the same artifact")
+	assert.EqualValues(t, 1, atomic.LoadInt32(&artifactFetches))
+
+	manifest.data = "/v2"
+	runner.InitFrom(s)
+	if assert.Len(t, sink.received, 2) {
+		assert.Equal(t, "version 2", string(sink.received[1]))
+	}
+
+	var manifestErr *ManifestError
+	manifest.data = ""
+	_, err = s.Fetch(time.Time{})
+	if assert.True(t, errors.As(err, &manifestErr)) {
+		assert.EqualError(t, manifestErr.Err, "empty manifest")
+	}
+
+	var artifactErr *ArtifactError
+	manifest.data = "/missing"
+	_, err = s.Fetch(time.Time{})
+	if assert.True(t, errors.As(err, &artifactErr)) {
+		assert.Equal(t, srv.URL+"/missing", artifactErr.URL)
+		assert.EqualError(t, artifactErr.Err, "unexpected HTTP status 404")
+	}
+
+	manifest.data = "/v3"
+	s = FromManifest(manifest, func(data []byte) (string, []byte, error) {
+		sha := sha256.Sum256([]byte("version 3"))
+		return srv.URL + string(data), sha[:], nil
+	})
+	rc, err := s.Fetch(time.Time{})
+	if assert.NoError(t, err) {
+		_, err = ioutil.ReadAll(rc)
+		rc.Close()
+		assert.True(t, errors.Is(err, ErrChecksumMismatch))
+		assert.True(t, errors.As(err, &artifactErr))
+	}
+	rc, err = s.Fetch(time.Now().Add(time.Hour))
+	if assert.NoError(t, err, "should not remember an artifact failing verification as synced") {
+		rc.Close()
+	}
+}
+
+func TestFromManifestRetriesArtifact(t *testing.T) {
+	var down int32
+	manifest := "/v1"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/manifest" {
+			w.Header().Set("ETag", `"`+manifest+`"`)
+			if req.Header.Get("If-None-Match") == `"`+manifest+`"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			io.WriteString(w, manifest)
+			return
+		}
+		if atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, req.URL.Path)
+	}))
+	defer srv.Close()
+
+	sink := &recordingSink{}
+	runner := New(FromManifest(FromWeb(srv.URL+"/manifest"), func(data []byte) (string, []byte, error) {
+		return srv.URL + string(data), nil, nil
+	}), sink)
+	assert.True(t, runner.Sync().Changed)
+	manifest = "/v2"
+	atomic.StoreInt32(&down, 1)
+	assert.Error(t, runner.Sync().Err)
+	atomic.StoreInt32(&down, 0)
+	assert.True(t, runner.Sync().Changed, "should retry the artifact while the manifest is unmodified")
+	assert.Equal(t, [][]byte{[]byte("/v1"), []byte("/v2")}, sink.received)
+	assert.True(t, runner.Sync().Unmodified)
+}
+
+func TestFromManifestWithOptions(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		io.WriteString(w, "artifact")
+	}))
+	defer srv.Close()
+
+	manifest := &staticSource{data: "/artifact", lastModified: time.Now()}
+	resolve := func(data []byte) (string, []byte, error) {
+		return srv.URL + string(data), nil, nil
+	}
+	_, err := FromManifest(manifest, resolve).Fetch(time.Time{})
+	assert.EqualError(t, err, "artifact "+srv.URL+"/artifact: unexpected HTTP status 403")
+
+	s := FromManifestWithOptions(manifest, resolve, WebOptions{Header: http.Header{"Authorization": {"Bearer token"}}})
+	rc, err := s.Fetch(time.Time{})
+	if assert.NoError(t, err, "should fetch the artifact with the options") {
+		data, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		assert.Equal(t, "artifact", string(data))
+	}
+}
+
+func TestFromDiscovered(t *testing.T) {
+	var down int32
+	mirror := func(data string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if atomic.LoadInt32(&down) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Set("ETag", `"`+data+`"`)
+			if req.Header.Get("If-None-Match") == `"`+data+`"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			io.WriteString(w, data)
+		}))
+	}
+	first, second := mirror("first"), mirror("second")
+	defer first.Close()
+	defer second.Close()
+
+	discovery := &staticSource{data: first.URL + " " + second.URL, lastModified: time.Now()}
+	var discoveries int32
+	parse := func(data []byte) ([]string, error) {
+		atomic.AddInt32(&discoveries, 1)
+		if len(data) == 0 {
+			return nil, errors.New("empty list")
+		}
+		return strings.Fields(string(data)), nil
+	}
+	fetch := func(s Source, ifNewerThan time.Time) (string, error) {
+		rc, err := s.Fetch(ifNewerThan)
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+		b, err := ioutil.ReadAll(rc)
+		return string(b), err
+	}
+
+	s := FromDiscovered(discovery, parse)
+	data, err := fetch(s, time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, "first", data)
+	_, err = fetch(s, time.Now())
+	assert.Equal(t, ErrUnmodified, err)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&discoveries), "unmodified list should not be parsed again")
+
+	discovery.data = "http://127.0.0.1:0 " + second.URL
+	discovery.lastModified = time.Now().Add(time.Hour)
+	data, err = fetch(s, time.Now())
+	assert.NoError(t, err, "should fall back to the next candidate")
+	assert.Equal(t, "second", data, "should fetch unconditionally from a new candidate")
+	_, err = fetch(s, time.Now())
+	assert.Equal(t, ErrUnmodified, err)
+
+	discovery.data = ""
+	discovery.lastModified = time.Now().Add(2 * time.Hour)
+	_, err = fetch(s, time.Now())
+	assert.Equal(t, ErrUnmodified, err, "should keep the last list if the discovery fails")
+
+	_, err = fetch(FromDiscovered(discovery, parse), time.Time{})
+	assert.EqualError(t, err, "empty list")
+	_, err = fetch(FromDiscovered(discovery, func([]byte) ([]string, error) { return nil, nil }), time.Time{})
+	assert.Equal(t, ErrNoCandidates, err)
+
+	atomic.StoreInt32(&down, 1)
+	_, err = fetch(s, time.Now())
+	assert.EqualError(t, err, "unexpected HTTP status 503")
+
+	discovery.data = first.URL
+	cached := FromDiscoveredWithRefresh(discovery, parse, time.Hour)
+	before := atomic.LoadInt32(&discoveries)
+	fetch(cached, time.Time{})
+	fetch(cached, time.Time{})
+	assert.EqualValues(t, before+1, atomic.LoadInt32(&discoveries), "should only refresh the list once due")
+
+	private := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		io.WriteString(w, "private")
+	}))
+	defer private.Close()
+	discovery.data = private.URL
+	_, err = fetch(FromDiscovered(discovery, parse), time.Time{})
+	assert.EqualError(t, err, "unexpected HTTP status 403")
+	data, err = fetch(FromDiscoveredWithOptions(discovery, parse, 0, WebOptions{Header: http.Header{"Authorization": {"Bearer token"}}}), time.Time{})
+	assert.NoError(t, err, "should fetch from the candidates with the options")
+	assert.Equal(t, "private", data)
+}
+
+func TestFromFileCoarseModTime(t *testing.T) {
+	path, _ := writeTempFile(t, []byte("v1"))
+	defer os.Remove(path)
+	// Simulate a file system keeping the modification time to the second
+	modTime := time.Now().Truncate(time.Second)
+	write := func(data string) {
+		assert.NoError(t, ioutil.WriteFile(path, []byte(data), 0644))
+		assert.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+	write("v1")
+
+	s := FromFile(path)
+	sink := &recordingSink{}
+	runner := New(s, sink)
+	runner.InitFrom(s)
+	write("v2")
+	runner.InitFrom(s)
+	write("v3")
+	runner.InitFrom(s)
+	assert.Equal(t, [][]byte{[]byte("v1"), []byte("v2"), []byte("v3")}, sink.received, "should pick up changes within the same second")
+	runner.InitFrom(s)
+	assert.Len(t, sink.received, 3)
+	assert.EqualValues(t, 1, runner.UnmodifiedCount(), "same content should be unmodified")
+}
+
+func TestFromTemplate(t *testing.T) {
+	tmpl := template.Must(template.New("config").Parse("port: {{.Port}}\n"))
+	changed := time.Now().Add(-time.Hour)
+	env := map[string]string{"Port": "8080"}
+	s := FromTemplate(tmpl, func() (interface{}, time.Time) { return env, changed })
+	rc, err := s.Fetch(time.Time{})
+	if assert.NoError(t, err) {
+		b, _ := ioutil.ReadAll(rc)
+		assert.Equal(t, "port: 8080\n", string(b))
+		assert.Equal(t, changed, metadataOf(rc).ModTime)
+	}
+	_, err = s.Fetch(changed)
+	assert.Equal(t, ErrUnmodified, err)
+
+	env, changed = map[string]string{"Port": "9090"}, time.Now()
+	rc, err = s.Fetch(changed.Add(-time.Minute))
+	if assert.NoError(t, err) {
+		b, _ := ioutil.ReadAll(rc)
+		assert.Equal(t, "port: 9090\n", string(b))
+	}
+
+	broken := template.Must(template.New("broken").Parse("{{.Port.Missing}}"))
+	sink := &recordingSink{}
+	s = FromTemplate(broken, func() (interface{}, time.Time) { return struct{ Port int }{8080}, time.Time{} })
+	_, err = s.Fetch(time.Time{})
+	assert.Error(t, err)
+	New(s, sink).InitFrom(s)
+	assert.Empty(t, sink.received, "should not write the output of a broken template")
+}
+
+func TestOffline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keep_current_test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		io.WriteString(w, "data")
+	}))
+	defer srv.Close()
+
+	sink := &recordingSink{}
+	runner := New(FromWeb(srv.URL), sink)
+	runner.Offline(true)
+	var sourceErrors int
+	runner.OnSourceError = func(err error, tries int) time.Duration {
+		sourceErrors++
+		return 0
+	}
+	assert.True(t, runner.Sync().Unmodified)
+	assert.Empty(t, sink.received)
+	assert.Zero(t, sourceErrors)
+	runner.Offline(false)
+	assert.True(t, runner.Sync().Changed)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&requests))
+
+	s := WithCache(filepath.Join(dir, "cache"))(FromWeb(srv.URL))
+	New(s, &recordingSink{}).InitFrom(s)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&requests))
+
+	// As after a restart
+	sink = &recordingSink{}
+	runner = New(s, sink)
+	runner.Offline(true)
+	runner.InitFrom(s)
+	runner.InitFrom(s)
+	assert.Equal(t, [][]byte{[]byte("data")}, sink.received, "should sync from the cache once")
+	assert.False(t, runner.StaleSince().IsZero(), "sync from the cache should be stale")
+	assert.EqualValues(t, 2, atomic.LoadInt32(&requests), "should not connect while offline")
+}
+
+func TestFromGRPCStream(t *testing.T) {
+	var opened int32
+	streams := make(chan chan []byte, 2)
+	s, stop := FromGRPCStream(func(ctx context.Context) (StreamReceiver, error) {
+		atomic.AddInt32(&opened, 1)
+		msgs := make(chan []byte, 2)
+		streams <- msgs
+		return &chanReceiver{ctx, msgs}, nil
+	})
+	defer stop()
+	go func() {
+		msgs := <-streams
+		msgs <- []byte("v1")
+		streams <- msgs
+	}()
+	rc, err := s.Fetch(time.Time{})
+	if assert.NoError(t, err, "should wait for the first message") {
+		b, _ := ioutil.ReadAll(rc)
+		assert.Equal(t, "v1", string(b))
+	}
+	_, err = s.Fetch(time.Now())
+	assert.Equal(t, ErrUnmodified, err, "no message since")
+
+	sink := &recordingSink{}
+	runner := New(s, sink)
+	runner.InitFrom(s)
+	assert.Equal(t, [][]byte{[]byte("v1")}, sink.received)
+
+	// The stream ends
+	close(<-streams)
+	assert.Eventually(t, func() bool {
+		_, err := s.Fetch(time.Now())
+		return err == errStreamEnded
+	}, time.Second, time.Millisecond)
+	go func() { (<-streams) <- []byte("v2") }()
+	runner.InitFrom(s)
+	assert.Equal(t, [][]byte{[]byte("v1"), []byte("v2")}, sink.received, "should reconnect")
+	assert.EqualValues(t, 2, atomic.LoadInt32(&opened))
+}
+
+// chanReceiver receives the messages from a channel until it's closed.
+type chanReceiver struct {
+	ctx  context.Context
+	msgs chan []byte
+}
+
+func (r *chanReceiver) Recv() ([]byte, error) {
+	select {
+	case msg, ok := <-r.msgs:
+		if !ok {
+			return nil, io.EOF
+		}
+		return msg, nil
+	case <-r.ctx.Done():
+		return nil, r.ctx.Err()
+	}
+}
+
+func TestFromJSONEnvelope(t *testing.T) {
+	updated := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	origin := &staticSource{data: `{"data": "` + base64.StdEncoding.EncodeToString([]byte("payload")) + `", "updated": "2024-01-01T00:00:00Z"}`, lastModified: time.Now()}
+	s := FromJSONEnvelope(origin, "data", "updated")
+	rc, err := s.Fetch(time.Time{})
+	if assert.NoError(t, err) {
+		b, _ := ioutil.ReadAll(rc)
+		assert.Equal(t, "payload", string(b))
+		assert.True(t, updated.Equal(metadataOf(rc).ModTime))
+	}
+	_, err = s.Fetch(updated)
+	assert.Equal(t, ErrUnmodified, err)
+	_, err = s.Fetch(updated.Add(-time.Second))
+	assert.NoError(t, err)
+
+	origin.data = `{"data": "cGF5bG9hZA==", "updated": 1704067200}`
+	_, err = s.Fetch(updated)
+	assert.Equal(t, ErrUnmodified, err, "should take Unix seconds")
+
+	for _, malformed := range []string{
+		`not json`,
+		`{"updated": "2024-01-01T00:00:00Z"}`,
+		`{"data": 42, "updated": "2024-01-01T00:00:00Z"}`,
+		`{"data": "not base64!", "updated": "2024-01-01T00:00:00Z"}`,
+		`{"data": "cGF5bG9hZA==", "updated": "yesterday"}`,
+		`{"data": "cGF5bG9hZA=="}`,
+	} {
+		origin.data = malformed
+		_, err := s.Fetch(time.Time{})
+		assert.Error(t, err, malformed)
+	}
+
+	origin.data = `{"data": "cGF5bG9hZA=="}`
+	rc, err = FromJSONEnvelope(origin, "data", "").Fetch(time.Time{})
+	if assert.NoError(t, err, "time field should be optional") {
+		b, _ := ioutil.ReadAll(rc)
+		assert.Equal(t, "payload", string(b))
+	}
+}
+
+func TestWithArchiveCache(t *testing.T) {
+	origin := &countingSource{staticSource: staticSource{
+		data:         makeTarGz(t, "a.json", "a1", "b.json", "b1"),
+		lastModified: time.Now().Add(-time.Hour),
+	}}
+	cache := NewArchiveCache(1<<20, time.Hour)
+	archive := WithArchiveCache(cache)(origin)
+	a, b := FromTarGz(archive, "a.json"), FromTarGz(archive, "b.json")
+	sinkA, sinkB := &recordingSink{}, &recordingSink{}
+	runnerA, runnerB := New(a, sinkA), New(b, sinkB)
+	runnerA.InitFrom(a)
+	runnerB.InitFrom(b)
+	assert.Equal(t, [][]byte{[]byte("a1")}, sinkA.received)
+	assert.Equal(t, [][]byte{[]byte("b1")}, sinkB.received)
+	assert.Equal(t, 1, origin.fetches, "should download the archive once")
+	runnerA.InitFrom(a)
+	assert.Len(t, sinkA.received, 1, "should be unmodified for the runner which has it")
+
+	// Once stale, the archive is fetched again only if modified
+	cache.freshness = 0
+	runnerA.InitFrom(a)
+	assert.Len(t, sinkA.received, 1)
+	assert.Equal(t, 2, origin.fetches)
+	origin.data, origin.lastModified = makeTarGz(t, "a.json", "a2", "b.json", "b2"), time.Now()
+	runnerA.InitFrom(a)
+	cache.freshness = time.Hour
+	runnerB.InitFrom(b)
+	assert.Equal(t, [][]byte{[]byte("a1"), []byte("a2")}, sinkA.received)
+	assert.Equal(t, [][]byte{[]byte("b1"), []byte("b2")}, sinkB.received)
+	assert.Equal(t, 3, origin.fetches)
+	assert.EqualValues(t, len(origin.data), cache.size, "should evict the old version")
+
+	// Too large to buffer
+	small := NewArchiveCache(10, time.Hour)
+	archive = WithArchiveCache(small)(origin)
+	a, b = FromTarGz(archive, "a.json"), FromTarGz(archive, "b.json")
+	for _, s := range []Source{a, b} {
+		rc, err := s.Fetch(time.Time{})
+		if assert.NoError(t, err) {
+			ioutil.ReadAll(rc)
+			rc.Close()
+		}
+	}
+	assert.Equal(t, 5, origin.fetches)
+	assert.Zero(t, small.size)
+}
+
+type countingSource struct {
+	staticSource
+	fetches int
+}
+
+func (s *countingSource) Fetch(ifNewerThan time.Time) (io.ReadCloser, error) {
+	s.fetches++
+	rc, err := s.staticSource.Fetch(ifNewerThan)
+	if err != nil {
+		return nil, err
+	}
+	return withMetadata(rc, Metadata{ModTime: s.lastModified}), nil
+}
@@ -0,0 +1,75 @@
+package keepcurrent
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type symlinkSwapSink struct {
+	linkPath string
+	extract  func(r io.Reader, dir string) error
+}
+
+// ToSymlinkSwap constructs a sink which calls extract to write the data into a
+// fresh timestamped directory next to linkPath, then atomically repoints the
+// symlink at linkPath to it, so that readers going through linkPath never see
+// a partially written tree. The directory previously pointed to is removed if
+// it was created by this sink. Atomicity relies on renaming over an existing
+// symlink, which holds on POSIX systems.
+func ToSymlinkSwap(linkPath string, extract func(r io.Reader, dir string) error) Sink {
+	return &symlinkSwapSink{linkPath, extract}
+}
+
+func (s *symlinkSwapSink) UpdateFrom(r io.Reader) error {
+	parent, prefix := filepath.Dir(s.linkPath), s.dirPrefix()
+	dir, err := ioutil.TempDir(parent, prefix+time.Now().Format("20060102T150405")+"-")
+	if err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			os.RemoveAll(dir)
+		}
+	}()
+	if err := os.Chmod(dir, 0755); err != nil {
+		return err
+	}
+	if err := s.extract(r, dir); err != nil {
+		return err
+	}
+
+	previous, _ := os.Readlink(s.linkPath)
+	tmpLink := dir + ".link"
+	if err := os.Symlink(filepath.Base(dir), tmpLink); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpLink, s.linkPath); err != nil {
+		os.Remove(tmpLink)
+		return err
+	}
+	committed = true
+
+	if previous != "" {
+		if !filepath.IsAbs(previous) {
+			previous = filepath.Join(parent, previous)
+		}
+		// Only clean up what we created ourselves
+		if filepath.Dir(previous) == parent && strings.HasPrefix(filepath.Base(previous), prefix) && previous != dir {
+			os.RemoveAll(previous)
+		}
+	}
+	return nil
+}
+
+func (s *symlinkSwapSink) dirPrefix() string {
+	return "." + filepath.Base(s.linkPath) + "-"
+}
+
+func (s *symlinkSwapSink) String() string {
+	return "symlink swap sink to " + absPath(s.linkPath)
+}
@@ -0,0 +1,41 @@
+package keepcurrent
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"text/template"
+	"time"
+)
+
+type templateSource struct {
+	tmpl *template.Template
+	data func() (interface{}, time.Time)
+}
+
+// FromTemplate constructs a source which renders the template with the data
+// returned by data, e.g. to generate the config from the environment. data
+// also returns when the data last changed, and the source is modified if
+// that's after ifNewerThan, or always if it's zero. An error executing the
+// template fails the fetch, so a broken template never reaches the sinks.
+func FromTemplate(tmpl *template.Template, data func() (interface{}, time.Time)) Source {
+	return &templateSource{tmpl, data}
+}
+
+func (s *templateSource) Fetch(ifNewerThan time.Time) (io.ReadCloser, error) {
+	data, modTime := s.data()
+	if !ifNewerThan.IsZero() && !modTime.IsZero() && !modTime.After(ifNewerThan) {
+		return nil, ErrUnmodified
+	}
+	var buf bytes.Buffer
+	if err := s.tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("unable to execute template %v: %v", s.tmpl.Name(), err)
+	}
+	return withMetadata(ioutil.NopCloser(&buf), Metadata{ModTime: modTime}), nil
+}
+
+// Describe implements DescribedSource
+func (s *templateSource) Describe() string {
+	return "template " + s.tmpl.Name()
+}
@@ -0,0 +1,41 @@
+package keepcurrent
+
+import "time"
+
+// TickStats tells how long a sync took, for OnTick.
+type TickStats struct {
+	// FetchDuration is how long fetching from the source took, until it
+	// returned the data, or that it's unmodified, or an error.
+	FetchDuration time.Duration
+	// SinkDuration is how long reading the data and writing it to the sinks
+	// took. Reading is included as it overlaps with writing when the data is
+	// streamed to the sinks.
+	SinkDuration time.Duration
+	// Bytes is how much data was read from the source.
+	Bytes int64
+	// Unmodified is true if the source reported the data as unmodified.
+	Unmodified bool
+}
+
+// tickStart returns when a step of the sync starts, if the stats of the tick
+// are collected.
+func (runner *Runner) tickStart(l *loop) time.Time {
+	if l.stats == nil {
+		return time.Time{}
+	}
+	return runner.clock().Now()
+}
+
+// tickFetched adds the time since start to the fetch duration of the tick.
+func (runner *Runner) tickFetched(l *loop, start time.Time) {
+	if l.stats != nil {
+		l.stats.FetchDuration += runner.clock().Now().Sub(start)
+	}
+}
+
+// tickDelivered adds the time since start to the sink duration of the tick.
+func (runner *Runner) tickDelivered(l *loop, start time.Time) {
+	if l.stats != nil {
+		l.stats.SinkDuration += runner.clock().Now().Sub(start)
+	}
+}
@@ -0,0 +1,167 @@
+// Package vault syncs data with secrets in the KV version 2 secrets engine of
+// HashiCorp Vault.
+package vault
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/keepcurrent"
+	"github.com/hashicorp/vault/api"
+)
+
+// splitPath splits a path into the mount path, i.e. its first element, and
+// the path of the secret under the mount.
+func splitPath(path string) (mount string, secretPath string) {
+	path = strings.Trim(path, "/")
+	if i := strings.Index(path, "/"); i >= 0 {
+		return path[:i], path[i+1:]
+	}
+	return path, ""
+}
+
+type vaultSink struct {
+	kv    *api.KVv2
+	path  string
+	field string
+}
+
+// ToVault constructs a sink which writes the data as a string to the given
+// field of the secret at path. The first element of path is the mount path of
+// the KV version 2 secrets engine, e.g. "secret/myapp". Use ToKV if the
+// engine is mounted at a nested path.
+func ToVault(client *api.Client, path, field string) keepcurrent.Sink {
+	mount, secretPath := splitPath(path)
+	return ToKV(client.KVv2(mount), secretPath, field)
+}
+
+// ToKV is the same as ToVault but writes via the given KV version 2 client
+// to the secret at secretPath under its mount.
+//
+// Other fields of the secret are preserved. The secret is read and written
+// back with check-and-set, so a concurrent write to the same secret makes the
+// update fail rather than being overwritten.
+func ToKV(kv *api.KVv2, secretPath, field string) keepcurrent.Sink {
+	return &vaultSink{kv, secretPath, field}
+}
+
+func (s *vaultSink) UpdateFrom(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	data := make(map[string]interface{})
+	version := 0
+	current, err := s.kv.Get(ctx, s.path)
+	switch {
+	case errors.Is(err, api.ErrSecretNotFound):
+	case err != nil:
+		return err
+	default:
+		for k, v := range current.Data {
+			data[k] = v
+		}
+		if current.VersionMetadata != nil {
+			version = current.VersionMetadata.Version
+		}
+	}
+	data[s.field] = string(b)
+	_, err = s.kv.Put(ctx, s.path, data, api.WithCheckAndSet(version))
+	return err
+}
+
+// ReusableReader implements keepcurrent.ReusableReaderSink
+func (s *vaultSink) ReusableReader() bool {
+	return true
+}
+
+func (s *vaultSink) String() string {
+	return fmt.Sprintf("vault sink to field %v of %v", s.field, s.path)
+}
+
+type vaultSource struct {
+	kv    *api.KVv2
+	path  string
+	field string
+
+	mx      sync.Mutex
+	version int
+}
+
+// FromVault constructs a source which reads the given field of the secret at
+// path, which has the same form as for ToVault. The version of the secret is
+// used to tell if it's unmodified since the last fetch.
+func FromVault(client *api.Client, path, field string) keepcurrent.Source {
+	mount, secretPath := splitPath(path)
+	return FromKV(client.KVv2(mount), secretPath, field)
+}
+
+// FromKV is the same as FromVault but reads via the given KV version 2 client
+// from the secret at secretPath under its mount.
+func FromKV(kv *api.KVv2, secretPath, field string) keepcurrent.Source {
+	return &vaultSource{kv: kv, path: secretPath, field: field}
+}
+
+func (s *vaultSource) Fetch(ifNewerThan time.Time) (io.ReadCloser, error) {
+	secret, err := s.kv.Get(context.Background(), s.path)
+	if err != nil {
+		return nil, err
+	}
+	if secret.VersionMetadata == nil || secret.Data == nil {
+		return nil, fmt.Errorf("latest version of secret %v is deleted", s.path)
+	}
+	s.mx.Lock()
+	unmodified := secret.VersionMetadata.Version == s.version
+	s.mx.Unlock()
+	if unmodified && !ifNewerThan.IsZero() {
+		return nil, keepcurrent.ErrUnmodified
+	}
+	value, found := secret.Data[s.field]
+	if !found {
+		return nil, fmt.Errorf("field %v not found in secret %v", s.field, s.path)
+	}
+	str, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("field %v of secret %v is a %T rather than a string", s.field, s.path, value)
+	}
+	// Only remember the version once it's read, so that an error reading it
+	// is returned again on the next fetch
+	s.mx.Lock()
+	s.version = secret.VersionMetadata.Version
+	s.mx.Unlock()
+	return &secretReader{
+		ReadCloser: ioutil.NopCloser(bytes.NewReader([]byte(str))),
+		md:         keepcurrent.Metadata{ModTime: secret.VersionMetadata.CreatedTime},
+	}, nil
+}
+
+// ResetConditions implements keepcurrent.ResettableSource, so that a secret
+// which failed to be delivered isn't unmodified when fetched again.
+func (s *vaultSource) ResetConditions() {
+	s.mx.Lock()
+	s.version = 0
+	s.mx.Unlock()
+}
+
+// Describe implements keepcurrent.DescribedSource
+func (s *vaultSource) Describe() string {
+	return fmt.Sprintf("field %v of vault secret %v", s.field, s.path)
+}
+
+type secretReader struct {
+	io.ReadCloser
+	md keepcurrent.Metadata
+}
+
+// Metadata implements keepcurrent.MetadataReader
+func (r *secretReader) Metadata() keepcurrent.Metadata {
+	return r.md
+}
@@ -0,0 +1,138 @@
+package vault
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/keepcurrent"
+	"github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeKV serves the subset of the KV version 2 HTTP API used by the package.
+type fakeKV struct {
+	mx      sync.Mutex
+	data    map[string]interface{}
+	version int
+}
+
+func (kv *fakeKV) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	kv.mx.Lock()
+	defer kv.mx.Unlock()
+	if req.URL.Path != "/v1/secret/data/myapp" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	metadata := map[string]interface{}{"created_time": time.Now().Format(time.RFC3339), "deletion_time": "", "version": kv.version}
+	switch req.Method {
+	case http.MethodGet:
+		if kv.version == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"data": kv.data, "metadata": metadata}})
+	case http.MethodPut, http.MethodPost:
+		var body struct {
+			Data    map[string]interface{}
+			Options struct{ CAS int }
+		}
+		json.NewDecoder(req.Body).Decode(&body)
+		if body.Options.CAS != kv.version {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{"check-and-set parameter did not match the current version"}})
+			return
+		}
+		kv.data = body.Data
+		kv.version++
+		metadata["version"] = kv.version
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": metadata})
+	}
+}
+
+func TestVault(t *testing.T) {
+	kv := &fakeKV{}
+	srv := httptest.NewServer(kv)
+	defer srv.Close()
+	client, err := api.NewClient(&api.Config{Address: srv.URL})
+	if !assert.NoError(t, err) {
+		return
+	}
+	client.SetToken("token")
+
+	sink := ToVault(client, "secret/myapp", "config")
+	assert.NoError(t, sink.UpdateFrom(strings.NewReader("v1")))
+	kv.data["other"] = "kept"
+	assert.NoError(t, sink.UpdateFrom(strings.NewReader("v2")))
+	assert.Equal(t, map[string]interface{}{"config": "v2", "other": "kept"}, kv.data)
+	assert.Equal(t, 2, kv.version)
+
+	ch := make(chan []byte, 10)
+	runner := keepcurrent.New(FromVault(client, "secret/myapp", "config"), keepcurrent.ToChannel(ch))
+	runner.OnSourceError = func(err error, tries int) time.Duration {
+		assert.NoError(t, err)
+		return 0
+	}
+	stop := runner.Start(10 * time.Millisecond)
+	defer stop()
+	assert.Equal(t, "v2", string(<-ch))
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, ch, 0, "unmodified secret should not be synced again")
+	assert.NoError(t, sink.UpdateFrom(strings.NewReader("v3")))
+	assert.Equal(t, "v3", string(<-ch))
+}
+
+func TestVaultRefetches(t *testing.T) {
+	kv := &fakeKV{}
+	srv := httptest.NewServer(kv)
+	defer srv.Close()
+	client, err := api.NewClient(&api.Config{Address: srv.URL})
+	if !assert.NoError(t, err) {
+		return
+	}
+	client.SetToken("token")
+	sink := ToVault(client, "secret/myapp", "config")
+	assert.NoError(t, sink.UpdateFrom(strings.NewReader("v1")))
+
+	flaky := &flakySink{}
+	runner := keepcurrent.New(FromVault(client, "secret/myapp", "config"), flaky)
+	assert.True(t, runner.Sync().Changed)
+	assert.NoError(t, sink.UpdateFrom(strings.NewReader("v2")))
+	flaky.err = errors.New("unavailable")
+	assert.False(t, runner.Sync().Changed)
+	flaky.err = nil
+	assert.True(t, runner.Sync().Changed, "secret failing to be delivered should be fetched again")
+	assert.Equal(t, "v2", flaky.received)
+
+	kv.mx.Lock()
+	delete(kv.data, "config")
+	kv.version++
+	kv.mx.Unlock()
+	assert.Error(t, runner.Sync().Err)
+	assert.Error(t, runner.Sync().Err, "missing field should keep failing")
+}
+
+type flakySink struct {
+	err      error
+	received string
+}
+
+func (s *flakySink) UpdateFrom(r io.Reader) error {
+	if s.err != nil {
+		return s.err
+	}
+	b, err := ioutil.ReadAll(r)
+	s.received = string(b)
+	return err
+}
+
+func (s *flakySink) String() string {
+	return "flaky sink"
+}
@@ -0,0 +1,78 @@
+package keepcurrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrVerificationFailed is returned by sinks wrapped with Verified when the
+// data read back differs from what was written, so that OnSinkError can tell
+// it from a failure to write using errors.Is.
+var ErrVerificationFailed = errors.New("data read back differs from what was written")
+
+// ReadBackSink is optionally implemented by a Sink which can read back the
+// data it last wrote, for Verified. The metadata is the same as given along
+// with the data, in case it affects where the data is written. The file sinks
+// implement it.
+type ReadBackSink interface {
+	Sink
+	ReadBack(md Metadata) (io.ReadCloser, error)
+}
+
+type verifiedSink struct {
+	inner Sink
+}
+
+// Verified wraps a sink to read back the data after every write and compare
+// its SHA-256 hash with that of the data written, failing with
+// ErrVerificationFailed if they differ, e.g. because of silent disk
+// corruption or another process writing to the same file. It's meant for the
+// sinks where writing the wrong data is costly, as the data is read twice.
+// Writing to a sink not implementing ReadBackSink always fails. Combine it
+// with Required to fail the sync as a whole.
+func Verified(s Sink) Sink {
+	return &verifiedSink{s}
+}
+
+func (s *verifiedSink) UpdateFrom(r io.Reader) error {
+	return s.UpdateWithMetadata(r, Metadata{})
+}
+
+// UpdateWithMetadata implements MetadataSink
+func (s *verifiedSink) UpdateWithMetadata(r io.Reader, md Metadata) error {
+	rb, ok := unwrapRequired(s.inner).(ReadBackSink)
+	if !ok {
+		return fmt.Errorf("%v can't be read back to verify", s.inner)
+	}
+	hasher := sha256.New()
+	if err := updateSink(context.Background(), s.inner, io.TeeReader(r, hasher), md); err != nil {
+		return err
+	}
+	rc, err := rb.ReadBack(md)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	readHasher := sha256.New()
+	if _, err := io.Copy(readHasher, rc); err != nil {
+		return err
+	}
+	if !bytes.Equal(hasher.Sum(nil), readHasher.Sum(nil)) {
+		return ErrVerificationFailed
+	}
+	return nil
+}
+
+// ReusableReader implements ReusableReaderSink
+func (s *verifiedSink) ReusableReader() bool {
+	rs, ok := s.inner.(ReusableReaderSink)
+	return ok && rs.ReusableReader()
+}
+
+func (s *verifiedSink) String() string {
+	return fmt.Sprintf("%v verified", s.inner)
+}
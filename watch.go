@@ -0,0 +1,101 @@
+package keepcurrent
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+type watchedSource struct {
+	s      Source
+	events <-chan struct{}
+	quiet  time.Duration
+}
+
+// FromWatched constructs a source which fetches from s, and makes the loop
+// of the runner or group sync as soon as something is received from events
+// as well as on every tick, e.g. for the events of a file system watcher on
+// the file s reads. A burst of events is coalesced into a single sync once no
+// event is received for quiet, so that an editor writing a temporary file,
+// renaming it and changing its mode triggers one sync rather than three. The
+// events are watched until the channel is closed, with a burst in progress
+// still synced.
+func FromWatched(s Source, events <-chan struct{}, quiet time.Duration) Source {
+	return &watchedSource{s: s, events: events, quiet: quiet}
+}
+
+// Events implements WatchedSource
+func (s *watchedSource) Events() (<-chan struct{}, time.Duration) {
+	return s.events, s.quiet
+}
+
+// Fetch implements the Source interface
+func (s *watchedSource) Fetch(ifNewerThan time.Time) (io.ReadCloser, error) {
+	return s.s.Fetch(ifNewerThan)
+}
+
+// FetchContext implements the ContextSource interface
+func (s *watchedSource) FetchContext(ctx context.Context, ifNewerThan time.Time) (io.ReadCloser, error) {
+	if cs, ok := s.s.(ContextSource); ok {
+		return cs.FetchContext(ctx, ifNewerThan)
+	}
+	return s.s.Fetch(ifNewerThan)
+}
+
+// Describe implements DescribedSource
+func (s *watchedSource) Describe() string {
+	return "watched " + describe(s.s)
+}
+
+// ResetConditions implements ResettableSource
+func (s *watchedSource) ResetConditions() {
+	resetConditions(s.s)
+}
+
+// unwrapWatched returns the source wrapped by FromWatched, if it is.
+func unwrapWatched(s Source) Source {
+	if ws, ok := s.(*watchedSource); ok {
+		return ws.s
+	}
+	return s
+}
+
+// watch returns a channel which receives a change once a burst of events of
+// the source is over, as told by the clock, until the context is done. It
+// returns nil if the source is not a WatchedSource.
+func watch(ctx context.Context, clock Clock, s Source) <-chan struct{} {
+	ws, ok := s.(WatchedSource)
+	if !ok {
+		return nil
+	}
+	events, quiet := ws.Events()
+	changes := make(chan struct{}, 1)
+	go func() {
+		notify := func() {
+			// Don't block if a change is already pending
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+		var settled <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-events:
+				if !ok {
+					if settled != nil {
+						notify()
+					}
+					return
+				}
+				settled = clock.After(quiet)
+			case <-settled:
+				settled = nil
+				notify()
+			}
+		}
+	}()
+	return changes
+}
@@ -0,0 +1,167 @@
+package keepcurrent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// ErrOutsideWindow is returned by sinks wrapped with WithinWindow or
+// WithinWindowDeferred when an update comes outside of the allowed window, so
+// that OnSinkError can tell it from a real failure using errors.Is.
+var ErrOutsideWindow = errors.New("outside of the allowed window")
+
+type windowSink struct {
+	inner   Sink
+	allowed func(time.Time) bool
+}
+
+// WithinWindow makes a sink only be written when allowed returns true for
+// the current time, e.g. to avoid pushing to production during a change
+// freeze. Updates outside of the window are dropped with ErrOutsideWindow.
+// Use WithinWindowDeferred to write the latest of them once the window
+// reopens.
+func WithinWindow(allowed func(time.Time) bool) SinkMiddleware {
+	return func(inner Sink) Sink {
+		return &windowSink{inner, allowed}
+	}
+}
+
+func (s *windowSink) UpdateFrom(r io.Reader) error {
+	return s.UpdateWithMetadata(r, Metadata{})
+}
+
+// UpdateWithMetadata implements MetadataSink
+func (s *windowSink) UpdateWithMetadata(r io.Reader, md Metadata) error {
+	if !s.allowed(time.Now()) {
+		return ErrOutsideWindow
+	}
+	return updateSink(context.Background(), s.inner, r, md)
+}
+
+// ReusableReader implements ReusableReaderSink
+func (s *windowSink) ReusableReader() bool {
+	rs, ok := s.inner.(ReusableReaderSink)
+	return ok && rs.ReusableReader()
+}
+
+func (s *windowSink) String() string {
+	return fmt.Sprintf("%v within window", s.inner)
+}
+
+type deferredWindowSink struct {
+	inner   Sink
+	allowed func(time.Time) bool
+	recheck time.Duration
+
+	mx       sync.Mutex
+	pending  []byte
+	md       Metadata
+	timer    *time.Timer
+	flushErr error
+}
+
+// WithinWindowDeferred is the same as WithinWindow but keeps the latest data
+// which came outside of the window, checking every recheck if the window has
+// reopened to write it then. ErrOutsideWindow is still returned for the
+// deferred updates, but the runner counts them as written, so that it doesn't
+// fetch the data again on every tick while the window is closed. An error
+// writing the deferred data is returned by the next call to UpdateFrom. Data
+// arriving within the window supersedes any deferred data. When the runner
+// stops, the deferred data is written if the window is open, and discarded
+// otherwise, see FlushingSink.
+func WithinWindowDeferred(allowed func(time.Time) bool, recheck time.Duration) SinkMiddleware {
+	return func(inner Sink) Sink {
+		return &deferredWindowSink{inner: inner, allowed: allowed, recheck: recheck}
+	}
+}
+
+func (s *deferredWindowSink) UpdateFrom(r io.Reader) error {
+	return s.UpdateWithMetadata(r, Metadata{})
+}
+
+// UpdateWithMetadata implements MetadataSink
+func (s *deferredWindowSink) UpdateWithMetadata(r io.Reader, md Metadata) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	err, s.flushErr = s.flushErr, nil
+	if s.allowed(time.Now()) {
+		s.pending = nil
+		if s.timer != nil {
+			s.timer.Stop()
+			s.timer = nil
+		}
+		return updateSink(context.Background(), s.inner, bytes.NewReader(data), md)
+	}
+	s.pending, s.md = data, md
+	if s.timer == nil {
+		s.timer = time.AfterFunc(s.recheck, s.onRecheck)
+	}
+	if err != nil {
+		return err
+	}
+	return ErrOutsideWindow
+}
+
+// isDeferral tells if the error writing to the sink is an update deferred by
+// WithinWindowDeferred.
+func isDeferral(s Sink, err error) bool {
+	_, ok := unwrapRequired(s).(*deferredWindowSink)
+	return ok && err == ErrOutsideWindow
+}
+
+func (s *deferredWindowSink) onRecheck() {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.pending == nil {
+		return
+	}
+	if !s.allowed(time.Now()) {
+		s.timer.Reset(s.recheck)
+		return
+	}
+	data := s.pending
+	s.pending, s.timer = nil, nil
+	s.flushErr = updateSink(context.Background(), s.inner, bytes.NewReader(data), s.md)
+}
+
+// Flush implements FlushingSink, writing the deferred data if the window is
+// open, or else discarding it with ErrOutsideWindow, so that it's not written
+// behind the back of the stopped runner.
+func (s *deferredWindowSink) Flush() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	err := s.flushErr
+	s.flushErr = nil
+	if s.pending == nil {
+		return err
+	}
+	data := s.pending
+	s.pending = nil
+	if !s.allowed(time.Now()) {
+		return ErrOutsideWindow
+	}
+	return updateSink(context.Background(), s.inner, bytes.NewReader(data), s.md)
+}
+
+// ReusableReader implements ReusableReaderSink
+func (s *deferredWindowSink) ReusableReader() bool {
+	return true
+}
+
+func (s *deferredWindowSink) String() string {
+	return fmt.Sprintf("%v within window, deferred", s.inner)
+}